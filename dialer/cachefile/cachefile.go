@@ -0,0 +1,55 @@
+// Package cachefile keeps the state the client remembers across restarts,
+// like the detour results, the fake-IP mapping and the downloaded lists.
+package cachefile
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Write replaces path with b atomically, through a temporary file of its
+// own in the same directory, so that a crash or another process writing
+// the same path never leaves it half written.
+func Write(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// AutoSave calls save every interval until done is closed, then a last
+// time. Failures are logged with path.
+func AutoSave(path string, save func() error, interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			if err := save(); err != nil {
+				log.Printf("failed to save %s: %v", path, err)
+			}
+			return
+		case <-t.C:
+			if err := save(); err != nil {
+				log.Printf("failed to save %s: %v", path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package cachefile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sub", "state.json")
+	for _, s := range []string{"first", "second"} {
+		if err := Write(path, []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != s {
+			t.Fatalf("read %q, %v", b, err)
+		}
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Fatalf("%d files left next to it", len(files))
+	}
+}
+
+func TestAutoSave(t *testing.T) {
+	var saves int32
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		AutoSave("test", func() error {
+			atomic.AddInt32(&saves, 1)
+			return nil
+		}, 10*time.Millisecond, done)
+		close(finished)
+	}()
+
+	time.Sleep(35 * time.Millisecond)
+	close(done)
+	<-finished
+	if n := atomic.LoadInt32(&saves); n < 2 {
+		t.Fatalf("saved %d times", n)
+	}
+}
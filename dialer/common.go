@@ -9,17 +9,59 @@ import (
 
 type DialFunc func(network, address string, timeout time.Duration) (net.Conn, error)
 
+// HostDialFunc connects to address like DialFunc, host is a domain name known
+// for address (e.g. sniffed from the connection) to choose the route by.
+type HostDialFunc func(network, address, host string, timeout time.Duration) (net.Conn, error)
+
 type ProxyProtocol interface {
 	ServerListen(
 		addr string,
 		listenFunc func(net, laddr string) (net.Listener, error),
 		handler func(ForwardConnection),
 		ctx context.Context,
+		opts ...ServerOption,
 	) (err error)
 
 	ClientWrapDial(d DialFunc) DialFunc
 }
 
+// Outbound connects a server to the targets its clients ask for.
+type Outbound interface {
+	// LookupIP resolves host to the addresses to try, in order.
+	LookupIP(host string) ([]net.IP, error)
+	// ForClient returns the dial func for the connections of client. The
+	// address it is given is an IP, host the domain it was resolved from.
+	ForClient(client net.Addr) HostDialFunc
+}
+
+// ServerOptions are set by the ServerOption given to ServerListen.
+type ServerOptions struct {
+	Outbound Outbound // nil to connect with net.Dial
+}
+
+type ServerOption func(*ServerOptions)
+
+func WithOutbound(o Outbound) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.Outbound = o
+	}
+}
+
+// ClientProtocol is the client side of a ProxyProtocol, or of a proxy the
+// client can only connect through, like SOCKS5 or HTTP.
+type ClientProtocol interface {
+	ClientWrapDial(d DialFunc) DialFunc
+}
+
+// Chain reaches the target through each hop in turn, hops[0] is dialed with
+// d and each following hop through the previous ones.
+func Chain(d DialFunc, hops ...ClientProtocol) DialFunc {
+	for _, hop := range hops {
+		d = hop.ClientWrapDial(d)
+	}
+	return d
+}
+
 type CommonConnection interface {
 	net.Conn
 	Init(parent net.Conn, config interface{}) error
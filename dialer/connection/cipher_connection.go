@@ -70,7 +70,7 @@ func (cc *CipherConn) RemoteAddr() net.Addr {
 }
 
 func (cc *CipherConn) SetDeadline(t time.Time) error {
-	return cc.wrapConn.SetReadDeadline(t)
+	return cc.wrapConn.SetDeadline(t)
 }
 
 func (cc *CipherConn) SetReadDeadline(t time.Time) error {
@@ -0,0 +1,339 @@
+package connection
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/FTwOoO/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KCPConfig tunes the KCP sessions of both ends. The server and the client
+// must agree on the timing, the MTU, the FEC shards and the crypt: Dial
+// sends them in a hello and fails with a *KCPMismatchError if the answer of
+// the server differs. The windows and DSCP are each end's own.
+type KCPConfig struct {
+	NoDelay      int // 1 to resend without waiting for the interval
+	Interval     int // ms between flushes
+	Resend       int // fast resend after this many skipping acks, 0 off
+	NoCongestion int // 1 to turn congestion control off
+
+	SndWnd int // packets
+	RcvWnd int
+	MTU    int
+
+	// Reed-Solomon forward error correction, off if DataShard is 0
+	DataShard   int
+	ParityShard int
+
+	DSCP int
+
+	// block crypt under the KCP header, none or one of KCPCrypts, with a key
+	// derived from Key
+	Crypt string
+	Key   string
+}
+
+// kcpModes are the presets for NoDelay, Interval, Resend and NoCongestion,
+// the same as kcptun's.
+var kcpModes = map[string][4]int{
+	"normal": {0, 40, 2, 1},
+	"fast":   {0, 30, 2, 1},
+	"fast2":  {1, 20, 2, 1},
+	"fast3":  {1, 10, 2, 1},
+}
+
+// KCPModes lists the presets SetMode takes, from the slowest.
+var KCPModes = []string{"normal", "fast", "fast2", "fast3"}
+
+var kcpCrypts = map[string]struct {
+	keyLen int
+	new    func(key []byte) (kcp.BlockCrypt, error)
+}{
+	"aes":      {32, kcp.NewAESBlockCrypt},
+	"aes-128":  {16, kcp.NewAESBlockCrypt},
+	"aes-192":  {24, kcp.NewAESBlockCrypt},
+	"salsa20":  {32, kcp.NewSalsa20BlockCrypt},
+	"blowfish": {32, kcp.NewBlowfishBlockCrypt},
+	"twofish":  {32, kcp.NewTwofishBlockCrypt},
+	"cast5":    {16, kcp.NewCast5BlockCrypt},
+	"3des":     {24, kcp.NewTripleDESBlockCrypt},
+	"tea":      {16, kcp.NewTEABlockCrypt},
+	"xtea":     {16, kcp.NewXTEABlockCrypt},
+	"xor":      {32, kcp.NewSimpleXORBlockCrypt},
+}
+
+// KCPCrypts lists the block crypts besides none.
+var KCPCrypts = []string{"aes", "aes-128", "aes-192", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor"}
+
+// DefaultKCPConfig returns the fast preset, FEC with 10 data and 3 parity
+// shards and aes keyed with key.
+func DefaultKCPConfig(key string) *KCPConfig {
+	c := &KCPConfig{
+		SndWnd:      1024,
+		RcvWnd:      1024,
+		MTU:         1350,
+		DataShard:   10,
+		ParityShard: 3,
+		Crypt:       "aes",
+		Key:         key,
+	}
+	c.SetMode("fast")
+	return c
+}
+
+// SetMode sets NoDelay, Interval, Resend and NoCongestion to the preset
+// name, manual keeps them.
+func (c *KCPConfig) SetMode(name string) error {
+	if name == "manual" {
+		return nil
+	}
+	m, ok := kcpModes[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown kcp mode %q", name)
+	}
+	c.NoDelay, c.Interval, c.Resend, c.NoCongestion = m[0], m[1], m[2], m[3]
+	return nil
+}
+
+func (c *KCPConfig) blockCrypt() (kcp.BlockCrypt, error) {
+	name := strings.ToLower(c.Crypt)
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+	crypt, ok := kcpCrypts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown kcp crypt %q", c.Crypt)
+	}
+	key := pbkdf2.Key([]byte(c.Key), []byte("kcp-go"), 4096, crypt.keyLen, sha1.New)
+	return crypt.new(key)
+}
+
+func (c *KCPConfig) setup(s *kcp.UDPSession) {
+	s.SetStreamMode(true)
+	s.SetNoDelay(c.NoDelay, c.Interval, c.Resend, c.NoCongestion)
+	s.SetWindowSize(c.SndWnd, c.RcvWnd)
+	s.SetMtu(c.MTU)
+	if c.DSCP > 0 {
+		if err := s.SetDSCP(c.DSCP); err != nil {
+			log.Printf("failed to set dscp: %v", err)
+		}
+	}
+}
+
+// Dial is a dialer.DialFunc connecting over KCP, whatever network is.
+func (c *KCPConfig) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	block, err := c.blockCrypt()
+	if err != nil {
+		return nil, err
+	}
+	s, err := kcp.DialWithOptions(address, block, c.DataShard, c.ParityShard)
+	if err != nil {
+		return nil, err
+	}
+	c.setup(s)
+
+	if timeout <= 0 {
+		timeout = handshakeTimeout
+	}
+	s.SetDeadline(time.Now().Add(timeout))
+	if err := c.hello(s); err != nil {
+		s.Close()
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil, fmt.Errorf("no kcp answer from %s, check the crypt, key and FEC shards agree with the server: %v", address, err)
+		}
+		return nil, err
+	}
+	s.SetDeadline(time.Time{})
+	return s, nil
+}
+
+// Listen listens for KCP on the udp port of laddr, whatever network is.
+// Only the sessions agreeing with c are accepted.
+func (c *KCPConfig) Listen(network, laddr string) (net.Listener, error) {
+	block, err := c.blockCrypt()
+	if err != nil {
+		return nil, err
+	}
+	l, err := kcp.ListenWithOptions(laddr, block, c.DataShard, c.ParityShard)
+	if err != nil {
+		return nil, err
+	}
+	if c.DSCP > 0 {
+		if err := l.SetDSCP(c.DSCP); err != nil {
+			log.Printf("failed to set dscp: %v", err)
+		}
+	}
+
+	kl := &kcpListener{Listener: l, config: c, conns: make(chan net.Conn), done: make(chan struct{})}
+	go kl.serve()
+	return kl, nil
+}
+
+type kcpListener struct {
+	*kcp.Listener
+	config *KCPConfig
+	conns  chan net.Conn
+	done   chan struct{}
+	err    error // why serve stopped, set before done is closed
+}
+
+func (l *kcpListener) serve() {
+	for {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		l.config.setup(s)
+		go l.accept(s)
+	}
+}
+
+func (l *kcpListener) accept(s *kcp.UDPSession) {
+	s.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := l.config.answer(s); err != nil {
+		log.Printf("kcp session from %s refused: %v", s.RemoteAddr(), err)
+		s.Close()
+		return
+	}
+	s.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- s:
+	case <-l.done:
+		s.Close()
+	}
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Each KCP session starts with the parameters of the client:
+//
+//	+---------+---------+----------+--------+----+-----+------+--------+-----------+-------+
+//	| version | nodelay | interval | resend | nc | mtu | data | parity | crypt len | crypt |
+//	+---------+---------+----------+--------+----+-----+------+--------+-----------+-------+
+//	|    1    |    2    |    2     |   2    | 2  |  2  |  2   |   2    |     1     |  var  |
+//	+---------+---------+----------+--------+----+-----+------+--------+-----------+-------+
+//
+// The server answers with its own the same way, and closes the session if
+// they differ. A mismatched crypt or FEC gets no answer at all, the packets
+// cannot be read.
+const kcpHelloVersion = 1
+
+const kcpHelloFixedLen = 1 + 7*2 + 1
+
+type kcpParams struct {
+	NoDelay, Interval, Resend, NoCongestion int
+	MTU, DataShard, ParityShard             int
+	Crypt                                   string
+}
+
+func (c *KCPConfig) params() kcpParams {
+	crypt := strings.ToLower(c.Crypt)
+	if crypt == "" {
+		crypt = "none"
+	}
+	return kcpParams{c.NoDelay, c.Interval, c.Resend, c.NoCongestion, c.MTU, c.DataShard, c.ParityShard, crypt}
+}
+
+func (p kcpParams) marshal() []byte {
+	b := make([]byte, kcpHelloFixedLen, kcpHelloFixedLen+len(p.Crypt))
+	b[0] = kcpHelloVersion
+	for i, v := range []int{p.NoDelay, p.Interval, p.Resend, p.NoCongestion, p.MTU, p.DataShard, p.ParityShard} {
+		binary.BigEndian.PutUint16(b[1+2*i:], uint16(v))
+	}
+	b[kcpHelloFixedLen-1] = byte(len(p.Crypt))
+	return append(b, p.Crypt...)
+}
+
+func readKCPParams(r io.Reader) (p kcpParams, err error) {
+	b := make([]byte, kcpHelloFixedLen)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	if b[0] != kcpHelloVersion {
+		return p, fmt.Errorf("unknown kcp hello version %d", b[0])
+	}
+	v := make([]int, 7)
+	for i := range v {
+		v[i] = int(binary.BigEndian.Uint16(b[1+2*i:]))
+	}
+	crypt := make([]byte, b[kcpHelloFixedLen-1])
+	if _, err = io.ReadFull(r, crypt); err != nil {
+		return
+	}
+	return kcpParams{v[0], v[1], v[2], v[3], v[4], v[5], v[6], string(crypt)}, nil
+}
+
+// diff lists the parameters of p differing from those of other, named peer.
+func (p kcpParams) diff(other kcpParams, peer string) string {
+	var d []string
+	check := func(name string, a, b interface{}) {
+		if a != b {
+			d = append(d, fmt.Sprintf("%s %v, %s %v", name, a, peer, b))
+		}
+	}
+	check("nodelay", p.NoDelay, other.NoDelay)
+	check("interval", p.Interval, other.Interval)
+	check("resend", p.Resend, other.Resend)
+	check("nc", p.NoCongestion, other.NoCongestion)
+	check("mtu", p.MTU, other.MTU)
+	check("datashard", p.DataShard, other.DataShard)
+	check("parityshard", p.ParityShard, other.ParityShard)
+	check("crypt", p.Crypt, other.Crypt)
+	return strings.Join(d, "; ")
+}
+
+// KCPMismatchError is the error of Dial for a server configured differently.
+type KCPMismatchError struct {
+	Diff string // e.g. "mtu 1350, server 1400; crypt aes, server none"
+}
+
+func (e *KCPMismatchError) Error() string {
+	return "kcp parameters differ from the server: " + e.Diff
+}
+
+func (c *KCPConfig) hello(conn net.Conn) error {
+	local := c.params()
+	if _, err := conn.Write(local.marshal()); err != nil {
+		return err
+	}
+	remote, err := readKCPParams(conn)
+	if err != nil {
+		return err
+	}
+	if d := local.diff(remote, "server"); d != "" {
+		return &KCPMismatchError{d}
+	}
+	return nil
+}
+
+func (c *KCPConfig) answer(conn net.Conn) error {
+	remote, err := readKCPParams(conn)
+	if err != nil {
+		return err
+	}
+	local := c.params()
+	if _, err := conn.Write(local.marshal()); err != nil {
+		return err
+	}
+	if d := local.diff(remote, "client"); d != "" {
+		return fmt.Errorf("kcp parameters differ: %s", d)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package connection
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKCPMode(t *testing.T) {
+	c := DefaultKCPConfig("test")
+	for _, mode := range KCPModes {
+		if err := c.SetMode(mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.NoDelay != 1 || c.Interval != 10 {
+		t.Fatalf("fast3 gave nodelay %d interval %d", c.NoDelay, c.Interval)
+	}
+	c.Interval = 15
+	if err := c.SetMode("manual"); err != nil || c.Interval != 15 {
+		t.Fatalf("manual changed the interval to %d: %v", c.Interval, err)
+	}
+	if err := c.SetMode("fastest"); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+
+	for _, crypt := range append(KCPCrypts, "none", "") {
+		c.Crypt = crypt
+		if _, err := c.blockCrypt(); err != nil {
+			t.Fatalf("crypt %q: %v", crypt, err)
+		}
+	}
+	c.Crypt = "rot13"
+	if _, err := c.blockCrypt(); err == nil {
+		t.Fatal("unknown crypt accepted")
+	}
+}
+
+// kcpHello runs the hello of client against server over a pipe.
+func kcpHello(client, server *KCPConfig) (clientErr, serverErr error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.answer(b)
+		b.Close()
+	}()
+	clientErr = client.hello(a)
+	return clientErr, <-errc
+}
+
+func TestKCPHello(t *testing.T) {
+	client, server := DefaultKCPConfig("test"), DefaultKCPConfig("other")
+	client.SndWnd, client.DSCP = 128, 46
+	if cerr, serr := kcpHello(client, server); cerr != nil || serr != nil {
+		t.Fatalf("client %v, server %v", cerr, serr)
+	}
+
+	server.SetMode("fast2")
+	server.MTU = 1400
+	cerr, serr := kcpHello(client, server)
+	e, ok := cerr.(*KCPMismatchError)
+	if !ok {
+		t.Fatalf("client got %v", cerr)
+	}
+	if want := "nodelay 0, server 1; interval 30, server 20; mtu 1350, server 1400"; e.Diff != want {
+		t.Fatalf("got %q, want %q", e.Diff, want)
+	}
+	if serr == nil || !strings.Contains(serr.Error(), "mtu 1400, client 1350") {
+		t.Fatalf("server got %v", serr)
+	}
+
+	client = DefaultKCPConfig("test")
+	client.Crypt = "salsa20"
+	if cerr, _ := kcpHello(client, DefaultKCPConfig("test")); cerr == nil || !strings.Contains(cerr.Error(), "crypt salsa20, server aes") {
+		t.Fatalf("client got %v", cerr)
+	}
+
+	a, b := net.Pipe()
+	go func() {
+		hello := client.params().marshal()
+		hello[0]++
+		b.Write(hello)
+		b.Close()
+	}()
+	if err := client.answer(a); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("bad version: %v", err)
+	}
+}
+
+func TestKCPDialListen(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	server := DefaultKCPConfig("test")
+	l, err := server.Listen("kcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	c, err := DefaultKCPConfig("test").Dial("kcp", addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("echoed %q: %v", b, err)
+	}
+
+	mismatched := DefaultKCPConfig("test")
+	mismatched.SetMode("normal")
+	if _, err := mismatched.Dial("kcp", addr, 0); err == nil {
+		t.Fatal("dialed with other parameters")
+	} else if _, ok := err.(*KCPMismatchError); !ok {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -1,167 +1,761 @@
 package connection
 
 import (
-	"time"
+	"bufio"
+	"errors"
+	"io"
+	"log"
 	"net"
+	"sort"
 	"sync"
-	"log"
-	"io"
+	"sync/atomic"
+	"time"
 )
 
-var pool = &sync.Pool{}
+const ByteItemLen = 1024
 
-func init() {
-	pool.New = func() interface{} {
-		return make([]byte, ByteItemLen)
-	}
-}
+const (
+	sendWindow    = 256 * 1024 // bytes sent but not acked before Write blocks
+	recvWindow    = 1024 * 1024
+	readWindow    = 256 * 1024 // bytes delivered but not read before the peer stops
+	initialRTO    = time.Second
+	maxRTO        = 30 * time.Second
+	lingerTimeout = 10 * time.Second // for the peer to ack what is left at Close
 
-const ByteItemLen = 1024
+	dupAckThreshold = 3
+)
 
+// minRTO is a var for tests.
+var minRTO = 200 * time.Millisecond
+
+var errMultiConnClosed = errors.New("multi connection closed")
+
+// MultiConnection is a byte stream over one or more paths, each a conn to
+// the same peer. Data is cut into frames numbered by their offset in the
+// stream and kept until the peer acks it, so that frames lost with a path
+// are sent again, and frames arriving twice or out of order on different
+// paths are delivered once and in order. Scheduler picks the paths each
+// frame is sent on, Redundant when nil.
+//
+// A path silent for 3 KeepAlive intervals, once pinged, is dropped. Every
+// Probe each path is pinged to time it, so that the scheduler knows the
+// paths it leaves idle. Redial,
+// when set, dials a path in place of a lost one. A session without paths
+// waits GracePeriod for one to come back before it closes, what was not
+// acked is sent again on it.
 type MultiConnection struct {
 	Connections     []*connectionChannel
 	connectionsLock sync.Mutex
+	Scheduler       Scheduler
+	KeepAlive       time.Duration
+	Probe           time.Duration
+	GracePeriod     time.Duration
+	Redial          func(lost net.Conn) (net.Conn, error)
 
-	ConnId         int
+	ConnId         SessionID
 	ReadBuffer     *DataBuffer
-	ReadBufferLock sync.Mutex
+	ReadBufferLock sync.Mutex // held while delivering, guards the receive state
+
+	// receive state
+	recvNext   uint64            // offset expected next
+	reorder    map[uint64]*frame // arrived ahead of recvNext, or waiting for room
+	eof        int32             // the fin was delivered
+	readClosed bool
+	advertised int // the window in the last ack
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	// send state, guarded by lock
+	lock     sync.Mutex
+	sendCond *sync.Cond
+	sendNext uint64  // offset of the next byte written
+	sendUna  uint64  // offset of the first byte not acked
+	sendEdge uint64  // offset past the last byte the peer takes
+	queue    []*sent // not acked yet, in offset order
+	rtxTimer *time.Timer
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	dupAcks  int           // acks for sendUna in a row
+	closing  bool          // Close was called, the fin is queued
+	closed   bool          // the paths are closed
+	drained  chan struct{} // closed when the fin is acked
+	onClose  func()        // set by the manager, called once the paths are closed
+	grace    *time.Timer   // runs while the session has no path
+
+	writeDeadline deadline
+}
+
+type sent struct {
+	*frame
+	sentAt        time.Time
+	retransmitted bool
+	paths         []*connectionChannel // once for each time it was sent
+	lost          int                  // paths before it failed to deliver it
 }
 
 type connectionChannel struct {
-	Id          int
-	Conn        net.Conn
-	ReadBuffer  *DataBuffer
-	WriteBuffer *DataBuffer
+	lastRecv int64 // unix nanoseconds, first for atomic alignment
+
+	Id      int
+	Conn    net.Conn
+	network string     // tcp or kcp
+	lock    sync.Mutex // a frame is written in one piece
+
+	done    chan struct{}
+	closing sync.Once
+
+	statsLock sync.Mutex
+	stats     pathStats
+	probeSeq  uint64               // of the last probe
+	probes    map[uint64]time.Time // sent and not answered yet, by seq
+}
+
+func (cc *connectionChannel) Stats() PathStats {
+	cc.statsLock.Lock()
+	defer cc.statsLock.Unlock()
+	return PathStats{
+		Network:    cc.network,
+		RTT:        cc.stats.srtt,
+		InFlight:   cc.stats.inFlight,
+		Throughput: cc.stats.rate,
+		Loss:       cc.stats.loss,
+	}
+}
+
+func (cc *connectionChannel) sent(n int) {
+	cc.statsLock.Lock()
+	cc.stats.sent(n)
+	cc.statsLock.Unlock()
+}
+
+func (cc *connectionChannel) acked(n int) {
+	cc.statsLock.Lock()
+	cc.stats.acked(n)
+	cc.statsLock.Unlock()
+}
+
+func (cc *connectionChannel) timed(rtt time.Duration) {
+	cc.statsLock.Lock()
+	cc.stats.timed(rtt)
+	cc.statsLock.Unlock()
+}
+
+func (cc *connectionChannel) outcome(lost bool) {
+	cc.statsLock.Lock()
+	cc.stats.outcome(lost)
+	cc.statsLock.Unlock()
+}
+
+func (cc *connectionChannel) write(b []byte) error {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	_, err := cc.Conn.Write(b)
+	return err
 }
 
 func (cc *connectionChannel) Close() {
-	cc.Conn.Close()
-	cc.ReadBuffer.Close()
-	cc.WriteBuffer.Close()
+	cc.closing.Do(func() {
+		close(cc.done)
+		cc.Conn.Close()
+	})
 }
 
-func NewMultiConnectionById(connId int) (cc *MultiConnection) {
+func NewMultiConnectionById(connId SessionID) (cc *MultiConnection) {
 	cc = &MultiConnection{}
 	cc.ConnId = connId
 
-	cc.ReadBuffer = NewBufferRead(ByteItemLen, 0)
+	cc.ReadBuffer = NewDataBuffer(readWindow)
+	cc.reorder = make(map[uint64]*frame)
+	cc.advertised = readWindow
+	cc.sendEdge = readWindow
+	cc.sendCond = sync.NewCond(&cc.lock)
+	cc.rto = initialRTO
+	cc.drained = make(chan struct{})
 	return
 }
 
+// Add makes conn a path of the session. An InnerConnection must be for
+// ConnId, other conns are used as they are.
 func (cc *MultiConnection) Add(conn net.Conn) {
-	cc.connectionsLock.Lock()
-	defer cc.connectionsLock.Unlock()
+	if innerConn, ok := conn.(*InnerConnection); ok && innerConn.Id() != cc.ConnId {
+		log.Printf("path of session %s added to session %s", innerConn.Id(), cc.ConnId)
+		conn.Close()
+		return
+	}
 
-	var innerConn *InnerConnection
-	innerConn, ok := conn.(*InnerConnection)
-	if !ok {
-		innerConn = NewInnerConnection(
-			conn,
-			cc.ConnId,
-		)
-	} else {
-		if innerConn.Id() != cc.ConnId {
-			log.Fatal("Id(%d) != ConnId(%d)", innerConn.Id(), cc.ConnId)
-		}
+	if cc.addPath(conn) {
+		cc.replay()
+	}
+}
+
+// addPath tells whether conn came back to a session without paths.
+func (cc *MultiConnection) addPath(conn net.Conn) (back bool) {
+	// closePaths must see the path once it is added
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if cc.closed {
+		conn.Close()
+		return
 	}
 
+	cc.connectionsLock.Lock()
+	defer cc.connectionsLock.Unlock()
+
 	connChannel := &connectionChannel{
-		Id:          time.Now().Nanosecond(),
-		Conn:        innerConn,
-		ReadBuffer:  NewBufferRead(ByteItemLen, 0),
-		WriteBuffer: NewBufferRead(ByteItemLen, 0),
+		lastRecv: time.Now().UnixNano(),
+		Id:       time.Now().Nanosecond(),
+		Conn:     conn,
+		network:  pathNetwork(conn),
+		done:     make(chan struct{}),
 	}
 
+	if len(cc.Connections) == 0 {
+		if cc.localAddr == nil {
+			cc.localAddr, cc.remoteAddr = conn.LocalAddr(), conn.RemoteAddr()
+		} else {
+			back = true
+		}
+	}
+	if cc.grace != nil {
+		cc.grace.Stop()
+		cc.grace = nil
+	}
 	cc.Connections = append(cc.Connections, connChannel)
-	go cc.readLoop(connChannel.ReadBuffer, connChannel.Conn)
-	go func() {
-		go io.Copy(connChannel.Conn, connChannel.WriteBuffer)
-		io.Copy(connChannel.ReadBuffer, connChannel.Conn)
-		connChannel.Close()
+	go cc.readLoop(connChannel)
+	if cc.KeepAlive > 0 {
+		go cc.keepAlive(connChannel)
+	}
+	if cc.Probe > 0 {
+		go cc.probe(connChannel)
+	}
+	return
+}
 
-	}()
+func (cc *MultiConnection) paths() []*connectionChannel {
+	cc.connectionsLock.Lock()
+	defer cc.connectionsLock.Unlock()
+	return append([]*connectionChannel(nil), cc.Connections...)
 }
 
-func (bs *MultiConnection) readLoop(ReadBuffer *DataBuffer, conn net.Conn) {
+func (cc *MultiConnection) removePath(p *connectionChannel, err error) {
+	cc.connectionsLock.Lock()
+	found := false
+	for i, x := range cc.Connections {
+		if x == p {
+			cc.Connections = append(cc.Connections[:i], cc.Connections[i+1:]...)
+			found = true
+			break
+		}
+	}
+	left := len(cc.Connections)
+	cc.connectionsLock.Unlock()
+
+	p.Close()
+	if !found {
+		return
+	}
 
-	r := ReadBuffer
+	cc.lock.Lock()
+	closed := cc.closed
+	// nothing is left to come or to send, the peer closed the path
+	finished := atomic.LoadInt32(&cc.eof) == 1 && len(cc.queue) == 0
+	cc.lock.Unlock()
+	if closed {
+		return
+	}
+	if finished {
+		if left == 0 {
+			cc.closePaths()
+		}
+		return
+	}
 
-	for {
-		item := pool.Get().([]byte)[:ByteItemLen]
-		readOffset := r.GetReadOffset()
+	if cc.Redial != nil {
+		go cc.reattach(p.Conn)
+	}
+	if left > 0 {
+		cc.resendFrom(p)
+		return
+	}
+
+	if err != io.EOF {
+		log.Printf("multi connection %s: last path failed: %v", cc.ConnId, err)
+	}
+	if cc.GracePeriod <= 0 {
+		cc.closePaths()
+		return
+	}
+	cc.lock.Lock()
+	if cc.grace == nil && !cc.closed {
+		cc.grace = time.AfterFunc(cc.GracePeriod, cc.graceExpired)
+	}
+	cc.lock.Unlock()
+}
 
-		n, err := r.Read(item)
+func (cc *MultiConnection) readLoop(p *connectionChannel) {
+	r := bufio.NewReader(p.Conn)
+	for {
+		f, err := readFrame(r)
 		if err != nil {
-			log.Println(err)
+			cc.removePath(p, err)
 			return
 		}
+		atomic.StoreInt64(&p.lastRecv, time.Now().UnixNano())
 
-		//NEED lock
-		bs.ReadBufferLock.Lock()
-		writeOffset := bs.ReadBuffer.GetWriteOffset()
-
-		if writeOffset >= readOffset && writeOffset < (readOffset+n) {
-			item = item[writeOffset-readOffset : n]
-			_, err := bs.ReadBuffer.Write(item)
-			if err != nil {
-				bs.Close()
-				bs.ReadBufferLock.Unlock()
+		switch f.typ {
+		case framePing:
+			if err := p.write((&frame{typ: framePong, offset: f.offset}).marshal()); err != nil {
+				cc.removePath(p, err)
+				return
+			}
+		case framePong:
+			p.ponged(f.offset)
+		case frameAck:
+			if lost := cc.acked(f.offset, f.answered(), f.window(), p); lost != nil {
+				cc.send(lost)
+			}
+		default:
+			ack, window := cc.receive(f)
+			if err := p.write(ackFrame(ack, f.offset, window).marshal()); err != nil {
+				cc.removePath(p, err)
 				return
 			}
 		}
-		bs.ReadBufferLock.Unlock()
 	}
 }
 
-func (cc *MultiConnection) Read(b []byte) (n int, err error) {
-	return cc.ReadBuffer.Read(b)
+// receive delivers f and the frames it unblocks, and returns the offset and
+// the window to ack.
+func (cc *MultiConnection) receive(f *frame) (uint64, int) {
+	cc.ReadBufferLock.Lock()
+	defer cc.ReadBufferLock.Unlock()
+
+	switch {
+	case f.end() <= cc.recvNext:
+		// a duplicate
+	case f.offset > cc.recvNext:
+		if f.offset-cc.recvNext < recvWindow {
+			cc.reorder[f.offset] = f
+		}
+	default:
+		cc.deliver(f)
+	}
+
+	cc.advertised = cc.ReadBuffer.Free()
+	return cc.recvNext, cc.advertised
 }
 
-func (cc *MultiConnection) Write(b []byte) (n int, err error) {
+// deliver writes f and the frames following it to the read buffer while
+// they fit, so that a reader falling behind stops the peer rather than the
+// path. Must be called with ReadBufferLock held.
+func (cc *MultiConnection) deliver(f *frame) {
+	for f != nil {
+		if f.typ == frameFin {
+			cc.recvNext = f.end()
+			atomic.StoreInt32(&cc.eof, 1)
+			cc.ReadBuffer.Close()
+			return
+		}
 
-	//TODO: deal with write timeout
-	for _, xx := range cc.Connections {
-		_, err = xx.WriteBuffer.Write(b)
-		if err != nil {
+		data := f.data[cc.recvNext-f.offset:]
+		if len(data) > cc.ReadBuffer.Free() {
+			cc.reorder[f.offset] = f
+			return
+		}
+		cc.recvNext = f.end()
+		// fails once closed here, ack anyway so the peer can finish
+		cc.ReadBuffer.Write(data)
 
-			if len(cc.Connections) > 0 {
-				err = nil
-				continue
-			} else {
-				return
+		f = cc.reorder[cc.recvNext]
+		delete(cc.reorder, cc.recvNext)
+	}
+}
+
+// readDone delivers what waited for room in the read buffer, and tells the
+// peer once the window it was last told opens up again.
+func (cc *MultiConnection) readDone() {
+	cc.ReadBufferLock.Lock()
+	if f := cc.reorder[cc.recvNext]; f != nil {
+		delete(cc.reorder, cc.recvNext)
+		cc.deliver(f)
+	}
+	window := cc.ReadBuffer.Free()
+	update := cc.advertised < readWindow/2 && window >= readWindow/2
+	if update {
+		cc.advertised = window
+	}
+	ack := cc.recvNext
+	cc.ReadBufferLock.Unlock()
+
+	if !update {
+		return
+	}
+	if paths := cc.paths(); len(paths) > 0 {
+		if err := paths[0].write(ackFrame(ack, noFrame, window).marshal()); err != nil {
+			cc.removePath(paths[0], err)
+		}
+	}
+}
+
+// acked drops the frames before offset from the queue, the ack came on path
+// from and answers the frame at answered. It returns the first frame not
+// acked when duplicate acks tell it was lost.
+func (cc *MultiConnection) acked(offset, answered uint64, window int, from *connectionChannel) (lost *sent) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	// the ack was sent as the frame arrived on from, so it times both the
+	// session and the path, unless the frame was sent more than once
+	i := sort.Search(len(cc.queue), func(i int) bool { return cc.queue[i].offset >= answered })
+	if i < len(cc.queue) && cc.queue[i].offset == answered && !cc.queue[i].retransmitted {
+		for _, p := range cc.queue[i].paths {
+			if p == from {
+				rtt := time.Since(cc.queue[i].sentAt)
+				cc.updateRTO(rtt)
+				from.timed(rtt)
+				break
 			}
 		}
+	}
+
+	if offset < cc.sendUna {
+		return
+	}
+	cc.sendEdge = offset + uint64(window)
+	cc.sendCond.Broadcast()
+	if offset == cc.sendUna {
+		if len(cc.queue) == 0 || answered == noFrame {
+			return
+		}
+		// the peer got frames past a hole, resend the first one without
+		// waiting for the timer
+		cc.dupAcks++
+		if cc.dupAcks == dupAckThreshold {
+			lost = cc.queue[0]
+			lost.sentAt = time.Now()
+			lost.retransmitted = true
+			lost.countLost()
+		}
+		return
+	}
+	cc.dupAcks = 0
+
+	n := 0
+	for ; n < len(cc.queue) && cc.queue[n].end() <= offset; n++ {
+		s := cc.queue[n]
+		for _, p := range s.paths {
+			p.acked(frameHeaderLen + len(s.data))
+		}
+		for _, p := range s.paths[s.lost:] {
+			p.outcome(false)
+		}
+	}
+	cc.queue = append(cc.queue[:0], cc.queue[n:]...)
+	cc.sendUna = offset
+
+	if len(cc.queue) == 0 {
+		if cc.rtxTimer != nil {
+			cc.rtxTimer.Stop()
+		}
+		if cc.closing {
+			close(cc.drained)
+		}
+	}
+	cc.sendCond.Broadcast()
+	return nil
+}
+
+// updateRTO follows RFC 6298, must be called with cc.lock held.
+func (cc *MultiConnection) updateRTO(rtt time.Duration) {
+	if cc.srtt == 0 {
+		cc.srtt = rtt
+		cc.rttvar = rtt / 2
+	} else {
+		d := cc.srtt - rtt
+		if d < 0 {
+			d = -d
+		}
+		cc.rttvar = (3*cc.rttvar + d) / 4
+		cc.srtt = (7*cc.srtt + rtt) / 8
+	}
+	cc.resetRTO()
+}
+
+// resetRTO sets the RTO from the RTT, without the backoff, must be called
+// with cc.lock held.
+func (cc *MultiConnection) resetRTO() {
+	if cc.srtt == 0 {
+		cc.rto = initialRTO
+		return
+	}
+
+	cc.rto = cc.srtt + 4*cc.rttvar
+	if cc.rto < minRTO {
+		cc.rto = minRTO
+	}
+	if cc.rto > maxRTO {
+		cc.rto = maxRTO
+	}
+}
+
+// countLost counts s as lost on the paths it was sent on since the last
+// time, must be called with cc.lock held.
+func (s *sent) countLost() {
+	for _, p := range s.paths[s.lost:] {
+		p.outcome(true)
+	}
+	s.lost = len(s.paths)
+}
+
+// queueFrame must be called with cc.lock held.
+func (cc *MultiConnection) queueFrame(f *frame) *sent {
+	s := &sent{frame: f, sentAt: time.Now()}
+	cc.queue = append(cc.queue, s)
+	if len(cc.queue) == 1 {
+		if cc.rtxTimer == nil {
+			cc.rtxTimer = time.AfterFunc(cc.rto, cc.retransmit)
+		} else {
+			cc.rtxTimer.Reset(cc.rto)
+		}
+	}
+	return s
+}
+
+// retransmit sends the frames that were not acked in time again.
+func (cc *MultiConnection) retransmit() {
+	cc.lock.Lock()
+	if cc.closed || len(cc.queue) == 0 {
+		cc.lock.Unlock()
+		return
+	}
+
+	now := time.Now()
+	var frames []*sent
+	for _, s := range cc.queue {
+		if now.Sub(s.sentAt) < cc.rto {
+			continue
+		}
+		s.sentAt = now
+		s.retransmitted = true
+		s.countLost()
+		frames = append(frames, s)
+	}
+	if len(frames) > 0 && frames[0] == cc.queue[0] {
+		// back off until an ack comes in time, once for the oldest frame
+		// rather than for each frame timing out after it
+		cc.rto *= 2
+		if cc.rto > maxRTO {
+			cc.rto = maxRTO
+		}
+	}
+	next := cc.rto
+	for _, s := range cc.queue {
+		if wait := s.sentAt.Add(cc.rto).Sub(now); wait < next {
+			next = wait
+		}
+	}
+	cc.rtxTimer.Reset(next)
+	cc.lock.Unlock()
+
+	for _, s := range frames {
+		cc.send(s)
+	}
+}
+
+// send writes s to the paths the scheduler picks.
+func (cc *MultiConnection) send(s *sent) {
+	paths := cc.paths()
+	if len(paths) == 0 {
+		return
+	}
+	stats := make([]PathStats, len(paths))
+	for i, p := range paths {
+		stats[i] = p.Stats()
+	}
+	scheduler := cc.Scheduler
+	if scheduler == nil {
+		scheduler = Redundant{}
+	}
+	picked := scheduler.Pick(stats)
+
+	b := s.marshal()
+	cc.lock.Lock()
+	if s.end() <= cc.sendUna {
+		// acked while picking
+		cc.lock.Unlock()
+		return
+	}
+	for _, i := range picked {
+		s.paths = append(s.paths, paths[i])
+		paths[i].sent(len(b))
+	}
+	cc.lock.Unlock()
+
+	for _, i := range picked {
+		if err := paths[i].write(b); err != nil {
+			cc.removePath(paths[i], err)
+		}
+	}
+}
 
+// PathStats returns the estimates of each path.
+func (cc *MultiConnection) PathStats() []PathStats {
+	var stats []PathStats
+	for _, p := range cc.paths() {
+		stats = append(stats, p.Stats())
 	}
+	return stats
+}
 
+func (cc *MultiConnection) Read(b []byte) (n int, err error) {
+	n, err = cc.ReadBuffer.Read(b)
+	if n > 0 {
+		cc.readDone()
+	}
 	return
 }
 
-func (cc *MultiConnection) Close() error {
-	cc.ReadBuffer.Close()
+func (cc *MultiConnection) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxFrameData {
+			size = maxFrameData
+		}
+
+		cc.lock.Lock()
+		for !cc.canSend() && !cc.closing && !cc.closed && !cc.writeDeadline.passed() {
+			cc.sendCond.Wait()
+		}
+		if cc.closing || cc.closed {
+			cc.lock.Unlock()
+			return n, errMultiConnClosed
+		}
+		if cc.writeDeadline.passed() {
+			cc.lock.Unlock()
+			return n, errTimeout
+		}
+		if room := cc.sendEdge - cc.sendNext; cc.sendEdge > cc.sendNext && room < uint64(size) {
+			size = int(room)
+		}
+		f := &frame{typ: frameData, offset: cc.sendNext, data: append([]byte(nil), b[:size]...)}
+		cc.sendNext += uint64(size)
+		s := cc.queueFrame(f)
+		cc.lock.Unlock()
+
+		cc.send(s)
+		b = b[size:]
+		n += size
+	}
+	return
+}
+
+// canSend tells whether a frame can be sent, must be called with cc.lock
+// held. With nothing in flight one is sent past the window of the peer, and
+// sent again by the timer until the window opens.
+func (cc *MultiConnection) canSend() bool {
+	if cc.sendNext == cc.sendUna {
+		return true
+	}
+	return cc.sendNext-cc.sendUna < sendWindow && cc.sendNext < cc.sendEdge
+}
 
-	for _, x := range cc.Connections {
-		x.Close()
+// CloseWrite sends a fin after the data written so far, the peer reads EOF
+// once it has everything.
+func (cc *MultiConnection) CloseWrite() error {
+	cc.lock.Lock()
+	if cc.closing || cc.closed {
+		cc.lock.Unlock()
+		return nil
 	}
+	cc.closing = true
+	s := cc.queueFrame(&frame{typ: frameFin, offset: cc.sendNext})
+	cc.sendCond.Broadcast()
+	cc.lock.Unlock()
+
+	cc.send(s)
+	return nil
+}
+
+// Close closes the paths once the peer acked everything written, or after
+// lingerTimeout.
+func (cc *MultiConnection) Close() error {
+	cc.closeRead(false)
+	cc.CloseWrite()
+
+	go func() {
+		select {
+		case <-cc.drained:
+		case <-time.After(lingerTimeout):
+		}
+		cc.closePaths()
+	}()
 	return nil
 }
 
+func (cc *MultiConnection) closePaths() {
+	cc.lock.Lock()
+	if cc.closed {
+		cc.lock.Unlock()
+		return
+	}
+	cc.closed = true
+	if cc.rtxTimer != nil {
+		cc.rtxTimer.Stop()
+	}
+	if cc.grace != nil {
+		cc.grace.Stop()
+	}
+	cc.sendCond.Broadcast()
+	cc.lock.Unlock()
+
+	// what arrived before a fin can still be read
+	cc.closeRead(true)
+
+	for _, p := range cc.paths() {
+		p.Close()
+	}
+	if cc.onClose != nil {
+		cc.onClose()
+	}
+}
+
+func (cc *MultiConnection) closeRead(unlessEOF bool) {
+	cc.ReadBufferLock.Lock()
+	defer cc.ReadBufferLock.Unlock()
+
+	if cc.readClosed || (unlessEOF && atomic.LoadInt32(&cc.eof) == 1) {
+		return
+	}
+	cc.readClosed = true
+	cc.ReadBuffer.CloseWithError(errMultiConnClosed)
+}
+
+// LocalAddr is the one of the first path.
 func (cc *MultiConnection) LocalAddr() net.Addr {
-	return cc.Connections[0].Conn.LocalAddr()
+	return cc.localAddr
 }
 
 func (cc *MultiConnection) RemoteAddr() net.Addr {
-	return cc.Connections[0].Conn.RemoteAddr()
+	return cc.remoteAddr
 }
 
+// SetDeadline applies to the session, not to its paths.
 func (cc *MultiConnection) SetDeadline(t time.Time) error {
-	return nil
+	cc.SetReadDeadline(t)
+	return cc.SetWriteDeadline(t)
 }
 
 func (cc *MultiConnection) SetReadDeadline(t time.Time) error {
-	return nil
+	return cc.ReadBuffer.SetReadDeadline(t)
 }
 
+// SetWriteDeadline bounds the wait for the peer to take more, a Write
+// returns once its data is queued.
 func (cc *MultiConnection) SetWriteDeadline(t time.Time) error {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.writeDeadline.set(t, cc.sendCond)
 	return nil
 }
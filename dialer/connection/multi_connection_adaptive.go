@@ -0,0 +1,174 @@
+package connection
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultProbe = 500 * time.Millisecond
+
+	DefaultHighLoss = 0.05
+	DefaultLowLoss  = 0.01
+	DefaultHold     = 30 * time.Second
+)
+
+// Adaptive sends on the tcp paths while they are clean, and moves to the
+// kcp paths once tcp loses more than HighLoss of its frames and probes, or
+// takes twice the RTT of kcp. It moves back to save the bandwidth kcp
+// wastes once tcp stayed under LowLoss, and within half again the RTT of
+// kcp, for Hold. Within a network it sends like MinRTT, and on every path
+// when the session has paths of a single network.
+//
+// The sessions sharing an Adaptive share the decision, so that a session
+// starts where the ones before left off. The paths left idle are only known
+// from their probes, see MultiConnection.Probe.
+type Adaptive struct {
+	HighLoss float64 // DefaultHighLoss if 0
+	LowLoss  float64 // DefaultLowLoss if 0
+	Hold     time.Duration
+
+	lock       sync.Mutex
+	onKCP      bool
+	cleanSince time.Time // since tcp is clean while on kcp
+}
+
+func (a *Adaptive) Pick(paths []PathStats) []int {
+	var tcp, kcp []int
+	for i, p := range paths {
+		if p.Network == "kcp" {
+			kcp = append(kcp, i)
+		} else {
+			tcp = append(tcp, i)
+		}
+	}
+	if len(tcp) == 0 || len(kcp) == 0 {
+		return MinRTT{}.Pick(paths)
+	}
+
+	group := tcp
+	if a.useKCP(best(paths, tcp), best(paths, kcp)) {
+		group = kcp
+	}
+	stats := make([]PathStats, len(group))
+	for i, j := range group {
+		stats[i] = paths[j]
+	}
+	return []int{group[MinRTT{}.Pick(stats)[0]]}
+}
+
+// best returns the path of some with the least loss.
+func best(paths []PathStats, some []int) PathStats {
+	b := paths[some[0]]
+	for _, i := range some[1:] {
+		if paths[i].Loss < b.Loss {
+			b = paths[i]
+		}
+	}
+	return b
+}
+
+func (a *Adaptive) useKCP(tcp, kcp PathStats) bool {
+	high, low, hold := a.HighLoss, a.LowLoss, a.Hold
+	if high == 0 {
+		high = DefaultHighLoss
+	}
+	if low == 0 {
+		low = DefaultLowLoss
+	}
+	if hold == 0 {
+		hold = DefaultHold
+	}
+	timed := tcp.RTT > 0 && kcp.RTT > 0
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.onKCP {
+		if tcp.Loss > high || timed && tcp.RTT > 2*kcp.RTT {
+			log.Printf("tcp loses %.1f%% at rtt %s, kcp %.1f%% at rtt %s: moving to kcp",
+				100*tcp.Loss, tcp.RTT, 100*kcp.Loss, kcp.RTT)
+			a.onKCP = true
+			a.cleanSince = time.Time{}
+		}
+		return a.onKCP
+	}
+
+	if tcp.Loss >= low || timed && tcp.RTT > kcp.RTT*3/2 {
+		a.cleanSince = time.Time{}
+		return true
+	}
+	if a.cleanSince.IsZero() {
+		a.cleanSince = time.Now()
+	}
+	if time.Since(a.cleanSince) < hold {
+		return true
+	}
+	log.Printf("tcp clean for %s, %.1f%% at rtt %s: moving back to tcp", hold, 100*tcp.Loss, tcp.RTT)
+	a.onKCP = false
+	return false
+}
+
+// probe pings p every cc.Probe. A ping not answered within the RTO of the
+// path counts as lost, so several may be out at once on a path slower than
+// cc.Probe.
+func (cc *MultiConnection) probe(p *connectionChannel) {
+	t := time.NewTicker(cc.Probe)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+
+		p.statsLock.Lock()
+		p.expireProbes()
+		p.probeSeq++
+		if p.probes == nil {
+			p.probes = make(map[uint64]time.Time)
+		}
+		p.probes[p.probeSeq] = time.Now()
+		ping := &frame{typ: framePing, offset: p.probeSeq}
+		p.statsLock.Unlock()
+
+		if err := p.write(ping.marshal()); err != nil {
+			cc.removePath(p, err)
+			return
+		}
+	}
+}
+
+// expireProbes counts the probes out for longer than the RTO of the path,
+// initialRTO until it is timed, as lost. statsLock is held.
+func (cc *connectionChannel) expireProbes() {
+	rto := cc.stats.rto()
+	if rto == 0 {
+		rto = initialRTO
+	}
+	for seq, at := range cc.probes {
+		if time.Since(at) > rto {
+			delete(cc.probes, seq)
+			cc.stats.outcome(true)
+		}
+	}
+}
+
+// ponged times the probe seq, the pongs of keepalives have 0.
+func (cc *connectionChannel) ponged(seq uint64) {
+	cc.statsLock.Lock()
+	defer cc.statsLock.Unlock()
+
+	at, ok := cc.probes[seq]
+	if seq == 0 || !ok {
+		return
+	}
+	delete(cc.probes, seq)
+	rtt := time.Since(at)
+
+	rto := cc.stats.rto()
+	cc.stats.outcome(rto > 0 && rtt > rto)
+	cc.stats.timed(rtt)
+}
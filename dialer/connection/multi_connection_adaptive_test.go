@@ -0,0 +1,114 @@
+package connection
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveScheduler(t *testing.T) {
+	a := &Adaptive{Hold: 100 * time.Millisecond}
+	paths := []PathStats{
+		{Network: "kcp", RTT: 20 * time.Millisecond},
+		{Network: "tcp", RTT: 30 * time.Millisecond},
+		{Network: "tcp", RTT: 10 * time.Millisecond, InFlight: 10 * minPathWindow},
+	}
+	if got := a.Pick(paths); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("picked %v on a clean link", got)
+	}
+
+	paths[1].Loss, paths[2].Loss = 0.1, 0.2
+	if got := a.Pick(paths); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("picked %v with tcp losing", got)
+	}
+
+	// clean again, kcp is kept for Hold
+	paths[1].Loss, paths[2].Loss = 0, 0
+	if got := a.Pick(paths); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("picked %v right after tcp got clean", got)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if got := a.Pick(paths); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("picked %v after Hold", got)
+	}
+
+	// no loss, but tcp stalls
+	paths[1].RTT = 100 * time.Millisecond
+	paths[2].RTT = 100 * time.Millisecond
+	if got := a.Pick(paths); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("picked %v with tcp slow", got)
+	}
+
+	if got := a.Pick(paths[1:]); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("picked %v on tcp paths only", got)
+	}
+}
+
+func TestMultiConnectionProbe(t *testing.T) {
+	id := NewSessionID()
+	a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+	a.Probe = 5 * time.Millisecond
+	defer a.Close()
+	defer b.Close()
+	for _, loss := range []float64{0, 0.3} {
+		ca, cb := lossyPipe(loss, time.Millisecond)
+		a.Add(ca)
+		b.Add(cb)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	stats := a.PathStats()
+	if stats[0].RTT == 0 || stats[1].RTT == 0 {
+		t.Fatalf("probes did not time the paths: %+v", stats)
+	}
+	if stats[0].Loss > 0.1 || stats[1].Loss < 0.15 {
+		t.Fatalf("loss %.2f on the clean path and %.2f on the lossy one", stats[0].Loss, stats[1].Loss)
+	}
+}
+
+func TestMultiConnectionProbeSlowPath(t *testing.T) {
+	id := NewSessionID()
+	a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+	a.Probe = 5 * time.Millisecond
+	defer a.Close()
+	defer b.Close()
+
+	// answered well within the RTO but after several more probes went out
+	ca, cb := lossyPipe(0, 20*time.Millisecond)
+	a.Add(ca)
+	b.Add(cb)
+
+	time.Sleep(500 * time.Millisecond)
+	stats := a.PathStats()
+	if stats[0].RTT < 5*time.Millisecond || stats[0].Loss > 0.1 {
+		t.Fatalf("slow clean path timed %s with loss %.2f", stats[0].RTT, stats[0].Loss)
+	}
+}
+
+func TestMultiConnectionAdaptive(t *testing.T) {
+	const size = 512 * 1024
+	sa, sb := &Adaptive{}, &Adaptive{}
+
+	// the first session finds tcp lossy, the second starts on kcp
+	for i := 0; i < 2; i++ {
+		id := NewSessionID()
+		a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+		a.Scheduler, b.Scheduler = sa, sb
+		a.Probe, b.Probe = 10*time.Millisecond, 10*time.Millisecond
+
+		tcpA, tcpB := lossyPipe(0.2, time.Millisecond)
+		kcpA, kcpB := lossyPipe(0, 2*time.Millisecond)
+		kcpA.kcp, kcpB.kcp = true, true
+		a.Add(tcpA)
+		b.Add(tcpB)
+		a.Add(kcpA)
+		b.Add(kcpB)
+		transfer(t, a, b, size)
+
+		onTCP, onKCP := atomic.LoadInt64(&tcpA.written), atomic.LoadInt64(&kcpA.written)
+		if i == 1 && (onKCP < size || onTCP > size/20) {
+			t.Errorf("sent %d bytes on the lossy tcp path and %d on kcp", onTCP, onKCP)
+		}
+	}
+}
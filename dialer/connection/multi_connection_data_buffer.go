@@ -1,117 +1,165 @@
 package connection
 
 import (
-	"io"
-	"net"
 	"bytes"
 	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
 )
 
 var _ io.ReadWriteCloser = &DataBuffer{}
 
+var errBufferClosed = errors.New("buffer closed")
+
+// releaseCap is the capacity an empty buffer gives back, so that idle
+// sessions hold no memory.
+const releaseCap = 32 * 1024
+
+// DataBuffer is a pipe holding up to window bytes. Write blocks while the
+// window is full and Read while it is empty, until their deadline. Once
+// closed, Write fails and Read returns what is left, then io.EOF or the
+// error it was closed with.
 type DataBuffer struct {
 	net.Conn
-	readItemsCh     chan []byte
 	readDataOffset  int
 	writeDataOffset int
-	readBuffer      *bytes.Buffer
-	bufferItemLen   int
-	closed          chan int
+
+	lock          sync.Mutex
+	cond          *sync.Cond
+	buf           bytes.Buffer
+	window        int
+	err           error // why it was closed
+	readDeadline  deadline
+	writeDeadline deadline
 }
 
+// NewBufferRead returns a buffer of 64 items of bufferItemLen bytes.
 func NewBufferRead(bufferItemLen int, DataReadOffset int) *DataBuffer {
-	bs := new(DataBuffer)
-
-	maxBytes := 1024 * 64
-	BufferItemsPerStream := (maxBytes / bufferItemLen)
-	bs.readItemsCh = make(chan []byte, BufferItemsPerStream)
-	bs.readBuffer = &bytes.Buffer{}
+	bs := NewDataBuffer(64 * bufferItemLen)
 	bs.readDataOffset = DataReadOffset
-	bs.bufferItemLen = bufferItemLen
-	bs.closed = make(chan int)
+	return bs
+}
+
+func NewDataBuffer(window int) *DataBuffer {
+	bs := &DataBuffer{window: window}
+	bs.cond = sync.NewCond(&bs.lock)
 	return bs
 }
 
 func (bs *DataBuffer) GetReadOffset() (n int) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
 	return bs.readDataOffset
 }
 
 func (bs *DataBuffer) GetWriteOffset() (n int) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
 	return bs.writeDataOffset
 }
 
+// Free is what Write takes without blocking. A closed buffer takes anything,
+// and fails.
+func (bs *DataBuffer) Free() int {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	if bs.err != nil {
+		return bs.window
+	}
+	return bs.window - bs.buf.Len()
+}
+
 func (bs *DataBuffer) Write(b []byte) (n int, err error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
 	for len(b) > 0 {
-		item := pool.Get().([]byte)
-		item = item[0:bs.bufferItemLen]
-		nCopy := copy(item, b)
-		item = item[:nCopy]
-		//TODO: set write timeout
-
-		select {
-		case <-bs.closed:
-			err = errors.New("buffer closed")
-			break
-		case bs.readItemsCh <- item:
-			b = b[nCopy:]
-			n += nCopy
+		for bs.err == nil && bs.buf.Len() >= bs.window && !bs.writeDeadline.passed() {
+			bs.cond.Wait()
+		}
+		if bs.err != nil {
+			return n, errBufferClosed
+		}
+		if bs.writeDeadline.passed() {
+			return n, errTimeout
 		}
-	}
 
-	if err != nil && n > 0 {
-		bs.writeDataOffset += n
+		m := bs.window - bs.buf.Len()
+		if m > len(b) {
+			m = len(b)
+		}
+		bs.buf.Write(b[:m])
+		b = b[m:]
+		n += m
+		bs.writeDataOffset += m
+		bs.cond.Broadcast()
 	}
-
 	return
 }
 
+// Read returns what is buffered, up to len(b), waiting for at least a byte.
 func (bs *DataBuffer) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
 
-	for len(b) > 0 {
-		if bs.readBuffer.Len() > 0 {
-			nRead, err2 := bs.readBuffer.Read(b)
-			if err2 != nil {
-				err = err2
-				return
-			}
-			b = b[nRead:]
-			bs.readDataOffset += nRead
-			n += nRead
-		} else {
-			bs.readBuffer.Truncate(0)
-
-			select {
-			case <-bs.closed:
-				err = errors.New("buffer closed")
-				return
-			case item, ok := <-bs.readItemsCh:
-				if !ok {
-					err = errors.New("readItemsCh closed")
-					return
-				}
-
-				nCopy := copy(b, item)
-				b = b[nCopy:]
-				bs.readDataOffset += nCopy
-				n += nCopy
-
-				if len(item) > nCopy {
-					bs.readBuffer.Write(item[nCopy:])
-				}
-				pool.Put(item)
-
-			default:
-				return
-			}
-		}
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	for bs.err == nil && bs.buf.Len() == 0 && !bs.readDeadline.passed() {
+		bs.cond.Wait()
+	}
+	if bs.readDeadline.passed() {
+		return 0, errTimeout
+	}
+	if bs.buf.Len() == 0 {
+		return 0, bs.err
 	}
 
+	n, _ = bs.buf.Read(b)
+	bs.readDataOffset += n
+	if bs.buf.Len() == 0 && bs.buf.Cap() > releaseCap {
+		bs.buf = bytes.Buffer{}
+	}
+	bs.cond.Broadcast()
 	return
 }
 
+// Close makes Read return io.EOF once the buffer is drained.
 func (bs *DataBuffer) Close() error {
-	close(bs.closed)
+	return bs.CloseWithError(io.EOF)
+}
+
+// CloseWithError makes Read return err once the buffer is drained. Only the
+// first close counts.
+func (bs *DataBuffer) CloseWithError(err error) error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	if bs.err == nil {
+		bs.err = err
+		bs.cond.Broadcast()
+	}
 	return nil
 }
 
+func (bs *DataBuffer) SetDeadline(t time.Time) error {
+	bs.SetReadDeadline(t)
+	return bs.SetWriteDeadline(t)
+}
 
+func (bs *DataBuffer) SetReadDeadline(t time.Time) error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	bs.readDeadline.set(t, bs.cond)
+	return nil
+}
+
+func (bs *DataBuffer) SetWriteDeadline(t time.Time) error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	bs.writeDeadline.set(t, bs.cond)
+	return nil
+}
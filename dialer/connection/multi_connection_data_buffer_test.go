@@ -3,6 +3,9 @@ package connection
 import (
 	"testing"
 	"math/rand"
+	"io/ioutil"
+	"errors"
+	"time"
 )
 
 func TestDataBuffer_ReadWrite(t *testing.T) {
@@ -39,3 +42,60 @@ func TestDataBuffer_ReadWrite(t *testing.T) {
 	}
 
 }
+
+func TestDataBufferBlocking(t *testing.T) {
+	bf := NewDataBuffer(4)
+
+	read := make(chan string)
+	go func() {
+		b := make([]byte, 8)
+		n, _ := bf.Read(b)
+		read <- string(b[:n])
+	}()
+	select {
+	case got := <-read:
+		t.Fatalf("read %q from an empty buffer", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	bf.Write([]byte("ab"))
+	if got := <-read; got != "ab" {
+		t.Fatalf("read %q", got)
+	}
+
+	// the window is 4 bytes, the rest waits for a Read
+	written := make(chan int)
+	go func() {
+		n, _ := bf.Write([]byte("123456"))
+		written <- n
+	}()
+	select {
+	case n := <-written:
+		t.Fatalf("wrote %d bytes past the window", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if free := bf.Free(); free != 0 {
+		t.Fatalf("%d bytes free in a full buffer", free)
+	}
+	got := make([]byte, 3)
+	if n, err := bf.Read(got); n != 3 || err != nil || string(got) != "123" {
+		t.Fatalf("read %q, %v", got[:n], err)
+	}
+	if n := <-written; n != 6 {
+		t.Fatalf("wrote %d bytes", n)
+	}
+
+	bf.Close()
+	if _, err := bf.Write([]byte("x")); err == nil {
+		t.Fatal("write to a closed buffer")
+	}
+	if rest, err := ioutil.ReadAll(bf); err != nil || string(rest) != "456" {
+		t.Fatalf("read %q, %v after close", rest, err)
+	}
+
+	errStop := errors.New("stop")
+	bf = NewDataBuffer(4)
+	go bf.CloseWithError(errStop)
+	if _, err := bf.Read(make([]byte, 1)); err != errStop {
+		t.Fatalf("read %v, want %v", err, errStop)
+	}
+}
@@ -0,0 +1,46 @@
+package connection
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// errTimeout is what Read and Write return once their deadline passed, a
+// net.Error like the one of net.Conn.
+var errTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadline wakes the waiters of a cond when it passes, so that they can
+// give up.
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+// set must be called with cond.L held, the zero time clears the deadline.
+func (d *deadline) set(t time.Time, cond *sync.Cond) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.t = t
+	if wait := time.Until(t); !t.IsZero() && wait > 0 {
+		d.timer = time.AfterFunc(wait, func() {
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		})
+	}
+	// the waiters check the new deadline
+	cond.Broadcast()
+}
+
+func (d *deadline) passed() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
@@ -0,0 +1,120 @@
+package connection
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+)
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// wakes tells whether op, blocked, returns a timeout once wake is called.
+func wakes(t *testing.T, op func() error, wake func()) {
+	errc := make(chan error, 1)
+	go func() { errc <- op() }()
+
+	select {
+	case err := <-errc:
+		t.Fatalf("did not block: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	wake()
+	select {
+	case err := <-errc:
+		if !isTimeout(err) {
+			t.Fatalf("got %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still blocked")
+	}
+}
+
+func TestDataBufferDeadline(t *testing.T) {
+	bf := NewDataBuffer(4)
+	read := func() error {
+		_, err := bf.Read(make([]byte, 1))
+		return err
+	}
+	wakes(t, read, func() { bf.SetReadDeadline(time.Now()) })
+	if err := read(); !isTimeout(err) {
+		t.Fatalf("read after the deadline: %v", err)
+	}
+
+	// cleared, and a deadline in the future passing
+	bf.SetReadDeadline(time.Time{})
+	bf.Write([]byte("a"))
+	if err := read(); err != nil {
+		t.Fatal(err)
+	}
+	bf.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	if err := read(); !isTimeout(err) || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("read returned %v after %s", err, time.Since(start))
+	}
+
+	bf.Write([]byte("1234"))
+	wakes(t, func() error {
+		_, err := bf.Write([]byte("5"))
+		return err
+	}, func() { bf.SetDeadline(time.Now()) })
+}
+
+func TestMultiConnectionDeadline(t *testing.T) {
+	id := NewSessionID()
+	a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+	ca, cb := lossyPipe(0, 0)
+	a.Add(ca)
+	b.Add(cb)
+	defer a.Close()
+	defer b.Close()
+
+	// like relay, which wakes the other side of a copy with a deadline
+	wakes(t, func() error {
+		_, err := b.Read(make([]byte, 1))
+		return err
+	}, func() { b.SetDeadline(time.Now()) })
+
+	// nobody reads b, Write waits for room until its deadline
+	a.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	data := make([]byte, readWindow+2*sendWindow)
+	n, err := a.Write(data)
+	if !isTimeout(err) || n >= len(data) {
+		t.Fatalf("wrote %d bytes, %v", n, err)
+	}
+
+	b.SetDeadline(time.Time{})
+	if _, err := b.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read after the deadline is cleared: %v", err)
+	}
+}
+
+func TestLayeredConnDeadline(t *testing.T) {
+	left, right := net.Pipe()
+	defer right.Close()
+
+	c := dialer.MakeConnection(left,
+		[]dialer.CommonConnection{&CipherConn{}, &ShadowsocksRawConn{}},
+		[]interface{}{
+			CipherConnParams{Cipher: "AES-128-CFB", Password: "123456"},
+			ShadowsocksRawConnParams{IsServer: true},
+		},
+	)
+	defer c.Close()
+
+	// nobody reads or writes right, both sides block on the pipe
+	wakes(t, func() error {
+		_, err := c.Write([]byte("hello"))
+		return err
+	}, func() { c.SetDeadline(time.Now()) })
+
+	c.SetDeadline(time.Time{})
+	wakes(t, func() error {
+		_, err := c.Read(make([]byte, 1))
+		return err
+	}, func() { c.SetDeadline(time.Now()) })
+}
@@ -0,0 +1,107 @@
+package connection
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frames follow the header of each path of a MultiConnection:
+//
+//	+------+--------+--------+----------+
+//	| type | offset | length | data     |
+//	+------+--------+--------+----------+
+//	|  1   |   8    |   2    | length   |
+//	+------+--------+--------+----------+
+//
+// offset counts the bytes of the stream, so that the same data sent on
+// several paths, or sent again, is only delivered once and in order. A fin
+// takes one offset after the last byte, like in TCP. An ack carries the
+// offset the receiver expects next, everything before it has arrived. Its
+// data is the offset of the frame it answers (8 bytes), so that the sender
+// can time the path the ack came on, and the bytes the receiver takes past
+// the acked offset (4 bytes). An ack that answers no frame, to tell the
+// window opened, has noFrame there. A ping asks for a pong on a
+// path that was silent or is probed, the pong has the offset of the ping,
+// both carry nothing.
+const (
+	frameData byte = iota + 1
+	frameAck
+	frameFin
+	framePing
+	framePong
+)
+
+const (
+	frameHeaderLen = 1 + 8 + 2
+	maxFrameData   = 16 * 1024
+	ackDataLen     = 8 + 4
+)
+
+const noFrame = ^uint64(0)
+
+type frame struct {
+	typ    byte
+	offset uint64
+	data   []byte
+}
+
+func ackFrame(next, answered uint64, window int) *frame {
+	f := &frame{typ: frameAck, offset: next, data: make([]byte, ackDataLen)}
+	binary.BigEndian.PutUint64(f.data, answered)
+	binary.BigEndian.PutUint32(f.data[8:], uint32(window))
+	return f
+}
+
+// answered is the offset of the frame an ack answers.
+func (f *frame) answered() uint64 {
+	return binary.BigEndian.Uint64(f.data)
+}
+
+// window is what the receiver takes past the offset of an ack.
+func (f *frame) window() int {
+	return int(binary.BigEndian.Uint32(f.data[8:]))
+}
+
+// end is the offset following f.
+func (f *frame) end() uint64 {
+	if f.typ == frameFin {
+		return f.offset + 1
+	}
+	return f.offset + uint64(len(f.data))
+}
+
+// marshal returns f in a single buffer, so that a frame is written to a path
+// in one Write.
+func (f *frame) marshal() []byte {
+	b := make([]byte, frameHeaderLen+len(f.data))
+	b[0] = f.typ
+	binary.BigEndian.PutUint64(b[1:], f.offset)
+	binary.BigEndian.PutUint16(b[9:], uint16(len(f.data)))
+	copy(b[frameHeaderLen:], f.data)
+	return b
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var h [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+
+	f := &frame{typ: h[0], offset: binary.BigEndian.Uint64(h[1:])}
+	n := int(binary.BigEndian.Uint16(h[9:]))
+	switch {
+	case f.typ < frameData || f.typ > framePong:
+		return nil, fmt.Errorf("unknown frame type %d", f.typ)
+	case f.typ == frameAck && n != ackDataLen, f.typ != frameData && f.typ != frameAck && n != 0, n > maxFrameData:
+		return nil, fmt.Errorf("bad length %d for frame type %d", n, f.typ)
+	}
+
+	if n > 0 {
+		f.data = make([]byte, n)
+		if _, err := io.ReadFull(r, f.data); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,192 @@
+package connection
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Each path of a MultiConnection starts with a hello from the client:
+//
+//	+---------+------+------------+-----------+-------+------+
+//	| version | kind | session id | timestamp | nonce | hmac |
+//	+---------+------+------------+-----------+-------+------+
+//	|    1    |  1   |     16     |     8     |   8   |  32  |
+//	+---------+------+------------+-----------+-------+------+
+//
+// kind is helloOpen for the first path of a session and helloJoin for the
+// others. timestamp is in unix seconds. hmac is HMAC-SHA256 with the session
+// key over the bytes before it.
+//
+// The server answers with:
+//
+//	+--------+------+
+//	| status | hmac |
+//	+--------+------+
+//	|   1    |  32  |
+//	+--------+------+
+//
+// where hmac is over the status and the hmac of the hello, so that the reply
+// cannot be taken from another handshake. A hello with a bad hmac, an old
+// timestamp or seen before gets no answer, the conn is closed.
+const (
+	helloVersion = 1
+
+	helloOpen byte = 1
+	helloJoin byte = 2
+
+	helloMACOffset = 1 + 1 + 16 + 8 + 8
+	helloLen       = helloMACOffset + sha256.Size
+	replyLen       = 1 + sha256.Size
+)
+
+const (
+	statusOK      byte = 0
+	statusUnknown byte = 1 // no such session, it expired or was closed
+	statusExists  byte = 2 // open with the id of a session
+)
+
+// maxClockSkew is how far the timestamp of a hello may be off.
+const maxClockSkew = 2 * time.Minute
+
+var (
+	ErrBadHello       = errors.New("bad session hello")
+	ErrSessionUnknown = errors.New("session unknown, expired or closed")
+	ErrSessionExists  = errors.New("session id in use")
+)
+
+type SessionID [16]byte
+
+func NewSessionID() (id SessionID) {
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (id SessionID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SessionKey derives the key that proves a path belongs to a session.
+func SessionKey(password string) []byte {
+	m := hmac.New(sha256.New, []byte("go-ss multi connection"))
+	m.Write([]byte(password))
+	return m.Sum(nil)
+}
+
+func mac(key []byte, parts ...[]byte) []byte {
+	m := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
+
+type hello struct {
+	kind byte
+	id   SessionID
+	time time.Time
+	mac  []byte
+}
+
+func marshalHello(key []byte, kind byte, id SessionID) []byte {
+	b := make([]byte, helloLen)
+	b[0] = helloVersion
+	b[1] = kind
+	copy(b[2:], id[:])
+	binary.BigEndian.PutUint64(b[18:], uint64(time.Now().Unix()))
+	if _, err := io.ReadFull(rand.Reader, b[26:helloMACOffset]); err != nil {
+		panic(err)
+	}
+	copy(b[helloMACOffset:], mac(key, b[:helloMACOffset]))
+	return b
+}
+
+func readHello(r io.Reader, key []byte) (*hello, error) {
+	b := make([]byte, helloLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(b[helloMACOffset:], mac(key, b[:helloMACOffset])) {
+		return nil, ErrBadHello
+	}
+	if b[0] != helloVersion || (b[1] != helloOpen && b[1] != helloJoin) {
+		return nil, fmt.Errorf("unsupported session hello version %d kind %d", b[0], b[1])
+	}
+
+	h := &hello{kind: b[1], mac: b[helloMACOffset:]}
+	copy(h.id[:], b[2:18])
+	h.time = time.Unix(int64(binary.BigEndian.Uint64(b[18:])), 0)
+	if d := time.Since(h.time); d > maxClockSkew || d < -maxClockSkew {
+		return nil, fmt.Errorf("session hello %s off, check the clock", d)
+	}
+	return h, nil
+}
+
+func marshalReply(key []byte, status byte, helloMAC []byte) []byte {
+	return append([]byte{status}, mac(key, []byte{status}, helloMAC)...)
+}
+
+func readReply(r io.Reader, key []byte, helloMAC []byte) error {
+	b := make([]byte, replyLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	if !hmac.Equal(b[1:], mac(key, b[:1], helloMAC)) {
+		return ErrBadHello
+	}
+
+	return statusErr(b[0])
+}
+
+func statusErr(status byte) error {
+	switch status {
+	case statusOK:
+		return nil
+	case statusUnknown:
+		return ErrSessionUnknown
+	case statusExists:
+		return ErrSessionExists
+	}
+	return fmt.Errorf("unknown session status %d", status)
+}
+
+// replayCache remembers the hellos seen within maxClockSkew, older ones are
+// refused for their timestamp.
+type replayCache struct {
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+// add tells whether h was not seen before.
+func (c *replayCache) add(h *hello) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	now := time.Now()
+	if len(c.seen) > 1024 {
+		for k, t := range c.seen {
+			if now.Sub(t) > 2*maxClockSkew {
+				delete(c.seen, k)
+			}
+		}
+	}
+
+	k := string(h.mac)
+	if _, ok := c.seen[k]; ok {
+		return false
+	}
+	c.seen[k] = now
+	return true
+}
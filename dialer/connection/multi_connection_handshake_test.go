@@ -0,0 +1,132 @@
+package connection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenManager(t *testing.T, password string) (*MultiConnectionManager, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	mc := NewMultiConnectionManager(password)
+	if _, err := mc.Listen("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := mc.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	return mc, addr
+}
+
+// dialPath returns the path open, a session without paths is closed.
+func dialPath(t *testing.T, addr string, password string, id SessionID, join bool) (net.Conn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := NewInnerConnection(c, SessionKey(password), id, join).ReadHeader(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestSessionHandshake(t *testing.T) {
+	mc, addr := listenManager(t, "test")
+
+	id := NewSessionID()
+	if _, err := dialPath(t, addr, "test", id, true); err != ErrSessionUnknown {
+		t.Fatalf("join of an unknown session: %v", err)
+	}
+	if _, err := dialPath(t, addr, "wrong", id, false); err != io.EOF {
+		t.Fatalf("wrong key: %v", err)
+	}
+
+	c1, err := dialPath(t, addr, "test", id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	if _, err := dialPath(t, addr, "test", id, false); err != ErrSessionExists {
+		t.Fatalf("open of an open session: %v", err)
+	}
+	c2, err := dialPath(t, addr, "test", id, true)
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer c2.Close()
+
+	mc.connsLock.RLock()
+	s := mc.conns[id]
+	mc.connsLock.RUnlock()
+	if s == nil {
+		t.Fatal("session not kept")
+	}
+	if n := len(s.paths()); n != 2 {
+		t.Fatalf("session has %d paths", n)
+	}
+	s.closePaths()
+	if _, err := dialPath(t, addr, "test", id, true); err != ErrSessionUnknown {
+		t.Fatalf("join of a closed session: %v", err)
+	}
+}
+
+func TestSessionHelloReplay(t *testing.T) {
+	_, addr := listenManager(t, "test")
+	key := SessionKey("test")
+
+	send := func(hello []byte) error {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(hello)
+		return readReply(c, key, hello[helloMACOffset:])
+	}
+
+	hello := marshalHello(key, helloOpen, NewSessionID())
+	if err := send(hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(hello); err != io.EOF {
+		t.Fatalf("replayed hello: %v", err)
+	}
+
+	// an old hello, signed with the key
+	old := marshalHello(key, helloOpen, NewSessionID())
+	binary.BigEndian.PutUint64(old[18:], uint64(time.Now().Add(-10*time.Minute).Unix()))
+	copy(old[helloMACOffset:], mac(key, old[:helloMACOffset]))
+	if err := send(old); err != io.EOF {
+		t.Fatalf("old hello: %v", err)
+	}
+
+	if _, err := readHello(bytes.NewReader(old), key); err == nil {
+		t.Fatal("old hello read")
+	}
+	if _, err := readHello(bytes.NewReader(hello), SessionKey("other")); err != ErrBadHello {
+		t.Fatalf("hello with another key: %v", err)
+	}
+}
+
+func TestDialWrongPassword(t *testing.T) {
+	_, addr := listenManager(t, "test")
+	if _, err := NewMultiConnectionManager("wrong").DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("dialed with the wrong password")
+	}
+}
@@ -1,38 +1,105 @@
 package connection
 
 import (
+	"errors"
 	"net"
-	"encoding/binary"
+	"sync"
 )
 
+// InnerConnection is a path of a MultiConnection, it starts with the session
+// handshake. The dialing side writes the hello before its first Write and
+// reads the reply before its first Read. The accepting side reads the hello
+// with ReadHeader and answers with WriteHeader or Reject.
 type InnerConnection struct {
 	net.Conn
-	connId  int
-	isRead  bool
-	isWrite bool
+	key      []byte
+	connId   SessionID
+	kind     byte
+	isServer bool
+	hello    *hello
+
+	writeOnce sync.Once
+	writeErr  error
+	helloMAC  []byte
+	isRead    bool
+}
+
+func NewInnerConnection(conn net.Conn, key []byte, id SessionID, join bool) *InnerConnection {
+	kind := helloOpen
+	if join {
+		kind = helloJoin
+	}
+	return &InnerConnection{Conn: conn, key: key, connId: id, kind: kind}
 }
 
-func NewInnerConnection(conn net.Conn, id int) *InnerConnection {
-	return &InnerConnection{Conn: conn, connId: id}
+func AcceptInnerConnection(conn net.Conn, key []byte) *InnerConnection {
+	return &InnerConnection{Conn: conn, key: key, isServer: true}
 }
 
-func (cc *InnerConnection) Id() (int) {
+func (cc *InnerConnection) Id() SessionID {
 	return cc.connId
 }
 
+// Join tells whether the path joins a session rather than opening it.
+func (cc *InnerConnection) Join() bool {
+	return cc.kind == helloJoin
+}
+
+// ReadHeader reads the hello on the accepting side, and the reply on the
+// dialing side, writing the hello first if needed.
 func (cc *InnerConnection) ReadHeader() (err error) {
-	if !cc.isRead {
-		err = binary.Read(cc.Conn, binary.BigEndian, cc.connId)
+	if cc.isRead {
+		return nil
+	}
+
+	if cc.isServer {
+		h, err := readHello(cc.Conn, cc.key)
 		if err != nil {
-			return
+			return err
+		}
+		cc.hello, cc.connId, cc.kind, cc.helloMAC = h, h.id, h.kind, h.mac
+	} else {
+		if err := cc.WriteHeader(); err != nil {
+			return err
+		}
+		if err := readReply(cc.Conn, cc.key, cc.helloMAC); err != nil {
+			return err
 		}
-
-		cc.isRead = true
 	}
 
+	cc.isRead = true
 	return nil
 }
 
+// WriteHeader writes the hello on the dialing side, and accepts the path on
+// the accepting side.
+func (cc *InnerConnection) WriteHeader() error {
+	return cc.writeHeader(statusOK)
+}
+
+// Reject refuses the path with status.
+func (cc *InnerConnection) Reject(status byte) error {
+	return cc.writeHeader(status)
+}
+
+func (cc *InnerConnection) writeHeader(status byte) error {
+	cc.writeOnce.Do(func() {
+		var b []byte
+		if cc.isServer {
+			if cc.helloMAC == nil {
+				cc.writeErr = errors.New("reply before the session hello")
+				return
+			}
+			b = marshalReply(cc.key, status, cc.helloMAC)
+		} else {
+			b = marshalHello(cc.key, cc.kind, cc.connId)
+			cc.helloMAC = b[helloMACOffset:]
+		}
+		_, cc.writeErr = cc.Conn.Write(b)
+	})
+	return cc.writeErr
+}
+
 func (cc *InnerConnection) Read(b []byte) (n int, err error) {
 	if !cc.isRead {
 		err = cc.ReadHeader()
@@ -45,13 +112,8 @@ func (cc *InnerConnection) Read(b []byte) (n int, err error) {
 }
 
 func (cc *InnerConnection) Write(b []byte) (n int, err error) {
-	if !cc.isWrite {
-		err = binary.Write(cc.Conn, binary.BigEndian, cc.connId)
-		if err != nil {
-			return
-		}
-
-		cc.isWrite = true
+	if err = cc.WriteHeader(); err != nil {
+		return
 	}
 
 	return cc.Conn.Write(b)
@@ -1,39 +1,85 @@
 package connection
 
 import (
-	"time"
-	"net"
-	"github.com/FTwOoO/kcp-go"
-	"sync"
-	"log"
 	"context"
 	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
 )
 
-func DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+// handshakeTimeout bounds the session handshake of an accepted path.
+const handshakeTimeout = 10 * time.Second
 
-	if network == "kcp" {
-		return kcp.Dial(address)
-	} else {
-		return net.DialTimeout(network, address, timeout)
-	}
-}
+const (
+	DefaultKeepAlive   = 5 * time.Second
+	DefaultGracePeriod = time.Minute
+)
 
 type MultiConnectionManager struct {
-	conns map[int]*MultiConnection
+	// Scheduler, KeepAlive, Probe and GracePeriod are given to the sessions
+	// dialed and accepted. The dialed ones replace the paths they lose.
+	// SessionScheduler, when set, gives each session its own scheduler
+	// instead, for those keeping state about their peer.
+	Scheduler        Scheduler
+	SessionScheduler func() Scheduler
+	KeepAlive        time.Duration
+	Probe            time.Duration
+	GracePeriod      time.Duration
+
+	// KCP tunes the kcp paths, both ends must agree on it
+	KCP *KCPConfig
+
+	key       []byte
+	conns     map[SessionID]*MultiConnection // accepted sessions
 	connsLock sync.RWMutex
+	replay    replayCache
 
 	acceptConns chan *MultiConnection
-	address net.Addr
+	address     net.Addr
 }
 
-func  NewMultiConnectionManager() *MultiConnectionManager {
+// NewMultiConnectionManager returns a manager whose paths prove they belong
+// to a session with a key derived from password.
+func NewMultiConnectionManager(password string) *MultiConnectionManager {
 	mc := &MultiConnectionManager{}
-	mc.conns = make(map[int]*MultiConnection)
+	mc.key = SessionKey(password)
+	mc.conns = make(map[SessionID]*MultiConnection)
 	mc.acceptConns = make(chan *MultiConnection)
+	mc.KeepAlive = DefaultKeepAlive
+	mc.GracePeriod = DefaultGracePeriod
+	mc.KCP = DefaultKCPConfig(password)
 	return mc
 }
 
+func (mc *MultiConnectionManager) newSession(id SessionID) *MultiConnection {
+	conn := NewMultiConnectionById(id)
+	conn.Scheduler = mc.Scheduler
+	if mc.SessionScheduler != nil {
+		conn.Scheduler = mc.SessionScheduler()
+	}
+	conn.KeepAlive = mc.KeepAlive
+	conn.Probe = mc.Probe
+	conn.GracePeriod = mc.GracePeriod
+	return conn
+}
+
+func (mc *MultiConnectionManager) dialPath(network, address string, timeout time.Duration) (net.Conn, error) {
+	if network == "kcp" {
+		return mc.KCP.Dial(network, address, timeout)
+	}
+	return net.DialTimeout(network, address, timeout)
+}
+
+// pathNetwork is the network a path was dialed on, kcp runs over udp.
+func pathNetwork(c net.Conn) string {
+	if c.RemoteAddr().Network() == "udp" {
+		return "kcp"
+	}
+	return "tcp"
+}
+
 func (mc *MultiConnectionManager) DialTimeout(network, address string, timeout time.Duration) (cc net.Conn, err error) {
 
 	ch := make(chan net.Conn)
@@ -43,7 +89,7 @@ func (mc *MultiConnectionManager) DialTimeout(network, address string, timeout t
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		conn1, err := DialTimeout("tcp", address, timeout)
+		conn1, err := mc.dialPath("tcp", address, timeout)
 		if err != nil {
 			return
 		}
@@ -54,8 +100,11 @@ func (mc *MultiConnectionManager) DialTimeout(network, address string, timeout t
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		conn2, err := DialTimeout("kcp", address, timeout)
+		conn2, err := mc.dialPath("kcp", address, timeout)
 		if err != nil {
+			if _, ok := err.(*KCPMismatchError); ok {
+				log.Printf("no kcp path to %s: %v", address, err)
+			}
 			return
 		}
 		ch <- conn2
@@ -66,22 +115,45 @@ func (mc *MultiConnectionManager) DialTimeout(network, address string, timeout t
 		close(ch)
 	}()
 
- 	id := time.Now().Nanosecond()
-	conn  := NewMultiConnectionById(id)
-	if err != nil {
-		return
+	id := NewSessionID()
+	conn := mc.newSession(id)
+	conn.Redial = func(lost net.Conn) (net.Conn, error) {
+		c, err := mc.dialPath(pathNetwork(lost), address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		ic, err := mc.handshake(c, id, true, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return ic, nil
 	}
 
-	mc.connsLock.Lock()
-	mc.conns[id] = conn
-	mc.connsLock.Unlock()
-
-	cc1 := <- ch
-	conn.Add(cc1)
+	// the other paths can only join once the session is open
+	for c := range ch {
+		var ic *InnerConnection
+		if ic, err = mc.handshake(c, id, false, timeout); err != nil {
+			log.Printf("failed to open session on %s: %v", c.RemoteAddr(), err)
+			continue
+		}
+		conn.Add(ic)
+		break
+	}
+	if len(conn.paths()) == 0 {
+		if err == nil {
+			err = errors.New("no path to " + address)
+		}
+		return nil, err
+	}
 
 	go func() {
-		for cc1 := range ch {
-			conn.Add(cc1)
+		for c := range ch {
+			ic, err := mc.handshake(c, id, true, timeout)
+			if err != nil {
+				log.Printf("failed to join session on %s: %v", c.RemoteAddr(), err)
+				continue
+			}
+			conn.Add(ic)
 		}
 	}()
 
@@ -89,6 +161,19 @@ func (mc *MultiConnectionManager) DialTimeout(network, address string, timeout t
 	return
 }
 
+func (mc *MultiConnectionManager) handshake(c net.Conn, id SessionID, join bool, timeout time.Duration) (*InnerConnection, error) {
+	ic := NewInnerConnection(c, mc.key, id, join)
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := ic.ReadHeader(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return ic, nil
+}
+
 func (mc *MultiConnectionManager) Listen(network, address string) (l net.Listener, err error) {
 	mc.address, _ = net.ResolveTCPAddr(network, address)
 
@@ -98,7 +183,7 @@ func (mc *MultiConnectionManager) Listen(network, address string) (l net.Listene
 		return
 	}
 
-	l2, err := kcp.Listen(address)
+	l2, err := mc.KCP.Listen("kcp", address)
 	if err != nil {
 		log.Printf("failed to listen: %v", err)
 		return
@@ -107,7 +192,7 @@ func (mc *MultiConnectionManager) Listen(network, address string) (l net.Listene
 	ctx := context.Background()
 
 	for _, l := range []net.Listener{l1, l2} {
-		go func() {
+		go func(l net.Listener) {
 			for {
 				select {
 				case <-ctx.Done():
@@ -123,42 +208,75 @@ func (mc *MultiConnectionManager) Listen(network, address string) (l net.Listene
 						c1.SetKeepAlive(true)
 					}
 
-					c1 := NewInnerConnection(c, 0)
-					err = c1.ReadHeader()
-					if err != nil {
-						log.Print(err)
-						continue
-					}
-
-					mc.connsLock.RLock()
-					multiConn, ok := mc.conns[c1.Id()]
-					mc.connsLock.RUnlock()
+					go mc.accept(c)
+				}
+			}
+		}(l)
+	}
 
-					if ok {
-						multiConn.Add(c1)
-					} else {
-						multiConn = NewMultiConnectionById(c1.Id())
-						multiConn.Add(c1)
+	return mc, nil
 
-						mc.connsLock.Lock()
-						mc.conns[c1.connId] = multiConn
-						mc.connsLock.Unlock()
+}
 
-						mc.acceptConns <- multiConn
+// accept adds c to the session its hello names. A hello opening a session
+// must have a new id, one joining a session must name an open one.
+func (mc *MultiConnectionManager) accept(c net.Conn) {
+	ic := AcceptInnerConnection(c, mc.key)
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err := ic.ReadHeader(); err != nil {
+		log.Printf("bad session hello from %s: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	if !mc.replay.add(ic.hello) {
+		log.Printf("session hello from %s replayed", c.RemoteAddr())
+		c.Close()
+		return
+	}
 
-					}
-				}
-			}
-		}()
+	id := ic.Id()
+	status := statusOK
+	mc.connsLock.Lock()
+	multiConn, ok := mc.conns[id]
+	switch {
+	case ic.Join() && !ok:
+		status = statusUnknown
+	case !ic.Join() && ok:
+		status = statusExists
+	case !ic.Join():
+		multiConn = mc.newSession(id)
+		multiConn.onClose = func() {
+			mc.connsLock.Lock()
+			delete(mc.conns, id)
+			mc.connsLock.Unlock()
+		}
+		mc.conns[id] = multiConn
 	}
+	mc.connsLock.Unlock()
 
-	return mc, nil
+	if status != statusOK {
+		log.Printf("path from %s for session %s refused: %v", c.RemoteAddr(), id, statusErr(status))
+		ic.Reject(status)
+		c.Close()
+		return
+	}
 
+	// added first, so that the path is there once the client is told
+	multiConn.Add(ic)
+	if err := ic.WriteHeader(); err != nil {
+		log.Printf("failed to accept path from %s: %v", c.RemoteAddr(), err)
+		c.Close() // the session drops it, and closes without paths
+		return
+	}
+	if !ic.Join() {
+		mc.acceptConns <- multiConn
+	}
 }
 
 // Accept waits for and returns the next connection to the listener.
 func (mc *MultiConnectionManager) Accept() (net.Conn, error) {
-	cc, ok := <- mc.acceptConns
+	cc, ok := <-mc.acceptConns
 	if !ok {
 		return nil, errors.New("closed")
 	}
@@ -16,7 +16,7 @@ func TestNewMultiConnectionManager(t *testing.T) {
 
 func EchoClient(t *testing.T, addr string) net.Conn {
 
-	client := NewMultiConnectionManager()
+	client := NewMultiConnectionManager("test")
 	c, err := client.DialTimeout("tcp", addr, 5*time.Second)
 	if err != nil {
 		t.Error(err)
@@ -50,7 +50,7 @@ func EchoClient(t *testing.T, addr string) net.Conn {
 }
 
 func EchoServer(t *testing.T, addr string) *MultiConnectionManager {
-	server := NewMultiConnectionManager()
+	server := NewMultiConnectionManager("test")
 	l, err := server.Listen("tcp", addr)
 	if err != nil {
 		t.Error(err)
@@ -0,0 +1,139 @@
+package connection
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reattachMinDelay = 100 * time.Millisecond
+	reattachMaxDelay = 5 * time.Second
+)
+
+var errPathTimeout = errors.New("path silent for too long")
+
+// keepAlive pings p once it is silent for cc.KeepAlive, and drops it after
+// 3 intervals without a frame. A path whose network went away often gives
+// no error, writes just go nowhere.
+func (cc *MultiConnection) keepAlive(p *connectionChannel) {
+	t := time.NewTicker(cc.KeepAlive)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&p.lastRecv)))
+		if idle >= 3*cc.KeepAlive {
+			cc.removePath(p, errPathTimeout)
+			return
+		}
+		if idle >= cc.KeepAlive {
+			if err := p.write((&frame{typ: framePing}).marshal()); err != nil {
+				cc.removePath(p, err)
+				return
+			}
+		}
+	}
+}
+
+// reattach dials a path in place of lost until one joins the session, the
+// session closes or its grace period is over.
+func (cc *MultiConnection) reattach(lost net.Conn) {
+	deadline := time.Now().Add(cc.GracePeriod)
+	delay := reattachMinDelay
+	for {
+		cc.lock.Lock()
+		closed := cc.closed
+		cc.lock.Unlock()
+		if closed {
+			return
+		}
+
+		c, err := cc.Redial(lost)
+		if err == nil {
+			cc.Add(c)
+			return
+		}
+		if err == ErrSessionUnknown {
+			// the peer let the session go
+			log.Printf("multi connection %s: %v", cc.ConnId, err)
+			cc.closePaths()
+			return
+		}
+		if time.Now().Add(delay).After(deadline) {
+			log.Printf("multi connection %s: failed to replace path to %s: %v", cc.ConnId, lost.RemoteAddr(), err)
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > reattachMaxDelay {
+			delay = reattachMaxDelay
+		}
+	}
+}
+
+// replay sends again what was not acked once a path comes back to the
+// session.
+func (cc *MultiConnection) replay() {
+	cc.lock.Lock()
+	frames := append([]*sent(nil), cc.queue...)
+	now := time.Now()
+	for _, s := range frames {
+		s.sentAt = now
+		s.retransmitted = true
+	}
+	// the backoff was for the paths that went away
+	cc.resetRTO()
+	if len(frames) > 0 {
+		cc.rtxTimer.Reset(cc.rto)
+	}
+	cc.lock.Unlock()
+
+	for _, s := range frames {
+		cc.send(s)
+	}
+}
+
+// resendFrom sends the frames that went only on the lost path p again on
+// the other paths, rather than waiting for the timer.
+func (cc *MultiConnection) resendFrom(p *connectionChannel) {
+	cc.lock.Lock()
+	var frames []*sent
+	now := time.Now()
+	for _, s := range cc.queue {
+		only := len(s.paths) > 0
+		for _, x := range s.paths {
+			if x != p {
+				only = false
+				break
+			}
+		}
+		if only {
+			s.sentAt = now
+			s.retransmitted = true
+			frames = append(frames, s)
+		}
+	}
+	cc.lock.Unlock()
+
+	for _, s := range frames {
+		cc.send(s)
+	}
+}
+
+// graceExpired closes the session if no path came back.
+func (cc *MultiConnection) graceExpired() {
+	if len(cc.paths()) > 0 {
+		return
+	}
+	log.Printf("multi connection %s: no path came back in %s", cc.ConnId, cc.GracePeriod)
+	cc.closePaths()
+}
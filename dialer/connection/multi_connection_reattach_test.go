@@ -0,0 +1,147 @@
+package connection
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitPaths waits for c to have n paths.
+func waitPaths(t *testing.T, c *MultiConnection, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.paths()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("session has %d paths, want %d", len(c.paths()), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func isClosed(c *MultiConnection) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+func TestMultiConnectionKeepAlive(t *testing.T) {
+	id := NewSessionID()
+	a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+	a.KeepAlive, b.KeepAlive = 50*time.Millisecond, 50*time.Millisecond
+	var cut []*lossyConn
+	for i := 0; i < 2; i++ {
+		ca, cb := lossyPipe(0, time.Millisecond)
+		a.Add(ca)
+		b.Add(cb)
+		cut = []*lossyConn{ca, cb}
+	}
+
+	// idle paths are kept by the pings
+	time.Sleep(500 * time.Millisecond)
+	waitPaths(t, a, 2)
+	waitPaths(t, b, 2)
+
+	for _, c := range cut {
+		atomic.StoreInt32(&c.cut, 1)
+	}
+	waitPaths(t, a, 1)
+	waitPaths(t, b, 1)
+
+	transfer(t, a, b, 64*1024)
+}
+
+func TestMultiConnectionGracePeriod(t *testing.T) {
+	id := NewSessionID()
+	a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+	a.GracePeriod, b.GracePeriod = 5*time.Second, 5*time.Second
+	ca, cb := lossyPipe(0, time.Millisecond)
+	a.Add(ca)
+	b.Add(cb)
+
+	// the only path goes away in the middle, what was not acked comes
+	// again on the next one
+	go func() {
+		for b.ReadBuffer.GetWriteOffset() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		ca.Close()
+		cb.Close()
+		time.Sleep(100 * time.Millisecond)
+		if isClosed(a) || isClosed(b) {
+			t.Error("session closed in its grace period")
+		}
+		ca, cb := lossyPipe(0, time.Millisecond)
+		a.Add(ca)
+		b.Add(cb)
+	}()
+	transfer(t, a, b, 512*1024)
+
+	c := NewMultiConnectionById(id)
+	c.GracePeriod = 50 * time.Millisecond
+	cc, _ := lossyPipe(0, 0)
+	c.Add(cc)
+	cc.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !isClosed(c) {
+		if time.Now().After(deadline) {
+			t.Fatal("session kept after its grace period")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMultiConnectionReattach(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	server := NewMultiConnectionManager("test")
+	server.KeepAlive = 50 * time.Millisecond
+	if _, err := server.Listen("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *MultiConnection, 1)
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.(*MultiConnection)
+	}()
+
+	client := NewMultiConnectionManager("test")
+	client.KeepAlive = 50 * time.Millisecond
+	c, err := client.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	var s *MultiConnection
+	select {
+	case s = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session accepted")
+	}
+	if _, err := io.ReadFull(s, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the network changes: the paths die under the session and the client
+	// dials new ones
+	mc := c.(*MultiConnection)
+	go func() {
+		for s.ReadBuffer.GetWriteOffset() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for _, p := range mc.paths() {
+			p.Conn.(*InnerConnection).Conn.Close()
+		}
+	}()
+	transfer(t, mc, s, 512*1024)
+}
@@ -0,0 +1,222 @@
+package connection
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// minPathWindow is what a path may have in flight before its bandwidth and
+// RTT are known.
+const minPathWindow = 64 * 1024
+
+// PathStats are the estimates a Scheduler picks paths with.
+type PathStats struct {
+	Network    string        // tcp or kcp
+	RTT        time.Duration // smoothed RTT, 0 until measured
+	InFlight   int           // bytes sent on the path and not acked
+	Throughput float64       // bytes acked per second while busy, 0 until measured
+	Loss       float64       // share of the frames and probes not answered in time
+}
+
+// Window is what the path may have in flight, twice its bandwidth-delay
+// product.
+func (s PathStats) Window() int {
+	w := int(2 * s.Throughput * s.RTT.Seconds())
+	if w < minPathWindow {
+		w = minPathWindow
+	}
+	return w
+}
+
+// Scheduler picks the paths a frame is sent on. Pick is given the stats of
+// every path, at least one, and returns the indexes of the chosen ones.
+type Scheduler interface {
+	Pick(paths []PathStats) []int
+}
+
+// NewScheduler returns the scheduler called name: redundant, roundrobin,
+// minrtt, weighted or auto.
+func NewScheduler(name string) (Scheduler, error) {
+	switch name {
+	case "", "redundant":
+		return Redundant{}, nil
+	case "roundrobin":
+		return &RoundRobin{}, nil
+	case "minrtt":
+		return MinRTT{}, nil
+	case "weighted":
+		return Weighted{}, nil
+	case "auto":
+		return &Adaptive{}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduler %q", name)
+}
+
+// Redundant sends every frame on every path, the fastest one delivers it.
+// It survives losing a path without waiting for a retransmission, but adds
+// no bandwidth.
+type Redundant struct{}
+
+func (Redundant) Pick(paths []PathStats) []int {
+	picked := make([]int, len(paths))
+	for i := range paths {
+		picked[i] = i
+	}
+	return picked
+}
+
+// RoundRobin stripes the frames over the paths in turn.
+type RoundRobin struct {
+	next uint32
+}
+
+func (s *RoundRobin) Pick(paths []PathStats) []int {
+	n := atomic.AddUint32(&s.next, 1) - 1
+	return []int{int(n % uint32(len(paths)))}
+}
+
+// MinRTT sends on the path with the lowest RTT that has room in its window,
+// so that slower paths only carry what the fastest cannot. Once every window
+// is full it picks the least loaded path.
+type MinRTT struct{}
+
+func (MinRTT) Pick(paths []PathStats) []int {
+	best := -1
+	for i, p := range paths {
+		if p.InFlight >= p.Window() {
+			continue
+		}
+		if best < 0 || p.RTT < paths[best].RTT {
+			best = i
+		}
+	}
+	if best < 0 {
+		best = leastLoaded(paths, func(p PathStats) float64 { return float64(p.Window()) })
+	}
+	return []int{best}
+}
+
+// Weighted spreads the frames so that the bytes in flight on each path are
+// in proportion to its throughput. A path not measured yet is weighted as the
+// best one, so that it gets traffic to be measured with.
+type Weighted struct{}
+
+func (Weighted) Pick(paths []PathStats) []int {
+	max := 0.0
+	for _, p := range paths {
+		if p.Throughput > max {
+			max = p.Throughput
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	return []int{leastLoaded(paths, func(p PathStats) float64 {
+		if p.Throughput == 0 {
+			return max
+		}
+		return p.Throughput
+	})}
+}
+
+// leastLoaded returns the path with the fewest bytes in flight for its
+// capacity.
+func leastLoaded(paths []PathStats, capacity func(PathStats) float64) int {
+	best, bestLoad := 0, 0.0
+	for i, p := range paths {
+		load := float64(p.InFlight) / capacity(p)
+		if i == 0 || load < bestLoad {
+			best, bestLoad = i, load
+		}
+	}
+	return best
+}
+
+// lossGain is the weight of each outcome in the loss of a path, so that it
+// follows about the last 32.
+const lossGain = 1.0 / 32
+
+// pathStats follows the RTT and the throughput of a path, from the acks that
+// come back on it, and its loss, from the frames sent again after it.
+type pathStats struct {
+	srtt      time.Duration
+	rttvar    time.Duration
+	inFlight  int
+	delivered int       // bytes acked since rateStart
+	rateStart time.Time // zero while the path is idle
+	rate      float64
+	loss      float64
+}
+
+func (s *pathStats) sent(n int) {
+	if s.inFlight == 0 {
+		// measure while busy, idle time says nothing of the path
+		s.rateStart, s.delivered = time.Now(), 0
+	}
+	s.inFlight += n
+}
+
+func (s *pathStats) timed(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt, s.rttvar = rtt, rtt/2
+		return
+	}
+	d := s.srtt - rtt
+	if d < 0 {
+		d = -d
+	}
+	s.rttvar = (3*s.rttvar + d) / 4
+	s.srtt = (7*s.srtt + rtt) / 8
+}
+
+// acked counts n bytes sent on the path as delivered.
+func (s *pathStats) acked(n int) {
+	s.inFlight -= n
+	if s.inFlight < 0 {
+		s.inFlight = 0
+	}
+
+	if s.rateStart.IsZero() {
+		return
+	}
+	s.delivered += n
+	interval := s.srtt
+	if interval < 50*time.Millisecond {
+		interval = 50 * time.Millisecond
+	}
+	if elapsed := time.Since(s.rateStart); elapsed >= interval {
+		sample := float64(s.delivered) / elapsed.Seconds()
+		if s.rate == 0 {
+			s.rate = sample
+		} else {
+			s.rate = (3*s.rate + sample) / 4
+		}
+		s.rateStart, s.delivered = time.Now(), 0
+	}
+	if s.inFlight == 0 {
+		s.rateStart = time.Time{}
+	}
+}
+
+// outcome counts a frame or a probe sent on the path, lost if it was not
+// answered in time.
+func (s *pathStats) outcome(lost bool) {
+	x := 0.0
+	if lost {
+		x = 1
+	}
+	s.loss += lossGain * (x - s.loss)
+}
+
+// rto is how long the path takes to answer at most, 0 until measured.
+func (s *pathStats) rto() time.Duration {
+	if s.srtt == 0 {
+		return 0
+	}
+	rto := s.srtt + 4*s.rttvar
+	if rto < minRTO {
+		rto = minRTO
+	}
+	return rto
+}
@@ -0,0 +1,111 @@
+package connection
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerPick(t *testing.T) {
+	paths := []PathStats{
+		{RTT: 50 * time.Millisecond, InFlight: 10},
+		{RTT: 10 * time.Millisecond, InFlight: minPathWindow},
+		{RTT: 20 * time.Millisecond, InFlight: 1000},
+	}
+
+	if got := (Redundant{}).Pick(paths); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Errorf("redundant picked %v", got)
+	}
+
+	rr := &RoundRobin{}
+	for i := 0; i < 6; i++ {
+		if got := rr.Pick(paths); !reflect.DeepEqual(got, []int{i % 3}) {
+			t.Errorf("round robin picked %v, want %d", got, i%3)
+		}
+	}
+
+	// the fastest path is full
+	if got := (MinRTT{}).Pick(paths); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("min rtt picked %v", got)
+	}
+	full := []PathStats{
+		{RTT: 10 * time.Millisecond, InFlight: 3 * minPathWindow},
+		{RTT: 50 * time.Millisecond, InFlight: 2 * minPathWindow},
+	}
+	if got := (MinRTT{}).Pick(full); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("min rtt picked %v with every window full", got)
+	}
+}
+
+func TestWeightedScheduler(t *testing.T) {
+	paths := []PathStats{
+		{RTT: 10 * time.Millisecond, Throughput: 2e6},
+		{RTT: 10 * time.Millisecond, Throughput: 1e6},
+		{RTT: 10 * time.Millisecond}, // not measured yet
+	}
+	counts := make([]int, len(paths))
+	for i := 0; i < 500; i++ {
+		p := (Weighted{}).Pick(paths)[0]
+		paths[p].InFlight += 1000
+		counts[p]++
+	}
+
+	if counts[0] < 190 || counts[0] > 210 || counts[1] < 90 || counts[1] > 110 || counts[2] < 190 || counts[2] > 210 {
+		t.Errorf("weighted picked %v, want about 200, 100, 200", counts)
+	}
+}
+
+func TestMultiConnectionSchedulers(t *testing.T) {
+	const size = 512 * 1024
+	for _, name := range []string{"redundant", "roundrobin", "minrtt", "weighted"} {
+		t.Run(name, func(t *testing.T) {
+			scheduler, err := NewScheduler(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := NewSessionID()
+			a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+			a.Scheduler, b.Scheduler = scheduler, scheduler
+			var conns []*lossyConn
+			for _, p := range []pathConfig{{maxDelay: time.Millisecond}, {maxDelay: 5 * time.Millisecond}} {
+				ca, cb := lossyPipe(p.loss, p.maxDelay)
+				a.Add(ca)
+				b.Add(cb)
+				conns = append(conns, ca)
+			}
+			transfer(t, a, b, size)
+
+			var total int64
+			var written []int64
+			for _, c := range conns {
+				n := atomic.LoadInt64(&c.written)
+				written = append(written, n)
+				total += n
+			}
+			switch name {
+			case "redundant":
+				if total < 2*size {
+					t.Errorf("sent %d bytes, want every byte on both paths", total)
+				}
+			default:
+				// the data once, the acks of what b sent, a little sent again
+				if total > size*3/2 {
+					t.Errorf("sent %d bytes for %d", total, size)
+				}
+			}
+			if name == "roundrobin" || name == "weighted" {
+				for i, n := range written {
+					if n < size/10 {
+						t.Errorf("path %d carried %d bytes of %d", i, n, total)
+					}
+				}
+			}
+		})
+	}
+
+	if _, err := NewScheduler("fastest"); err == nil {
+		t.Error("unknown scheduler accepted")
+	}
+}
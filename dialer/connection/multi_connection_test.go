@@ -0,0 +1,314 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	rand2 "math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	// set once, sessions of finished tests may still be lingering
+	minRTO = 10 * time.Millisecond
+}
+
+// lossyConn passes each Write whole, so that frames stay intact, but drops
+// it with probability loss and delivers it after up to maxDelay, so that it
+// overtakes others.
+type lossyConn struct {
+	in       chan []byte
+	peer     *lossyConn
+	loss     float64
+	maxDelay time.Duration
+
+	rd      bytes.Buffer
+	closed  chan struct{}
+	closing sync.Once
+	written int64 // bytes passed to Write, dropped or not
+	cut     int32 // drop everything, like a network gone away
+	kcp     bool  // looks like a kcp path, its remote address is udp
+}
+
+func lossyPipe(loss float64, maxDelay time.Duration) (*lossyConn, *lossyConn) {
+	a := &lossyConn{in: make(chan []byte, 4096), loss: loss, maxDelay: maxDelay, closed: make(chan struct{})}
+	b := &lossyConn{in: make(chan []byte, 4096), loss: loss, maxDelay: maxDelay, closed: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("closed")
+	default:
+	}
+
+	atomic.AddInt64(&c.written, int64(len(b)))
+	msg := append([]byte(nil), b...)
+	if atomic.LoadInt32(&c.cut) == 1 || rand2.Float64() < c.loss {
+		return len(b), nil
+	}
+
+	go func() {
+		if c.maxDelay > 0 {
+			time.Sleep(time.Duration(rand2.Int63n(int64(c.maxDelay))))
+		}
+		select {
+		case c.peer.in <- msg:
+		case <-c.peer.closed:
+		}
+	}()
+	return len(b), nil
+}
+
+func (c *lossyConn) Read(b []byte) (int, error) {
+	if c.rd.Len() == 0 {
+		select {
+		case msg := <-c.in:
+			c.rd.Write(msg)
+		case <-c.closed:
+			return 0, io.EOF
+		}
+	}
+	return c.rd.Read(b)
+}
+
+func (c *lossyConn) Close() error {
+	c.closing.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *lossyConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *lossyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *lossyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *lossyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *lossyConn) RemoteAddr() net.Addr {
+	if c.kcp {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+type pathConfig struct {
+	loss     float64
+	maxDelay time.Duration
+}
+
+// transfer writes random data in random pieces from a to b and from b to a
+// at the same time, and checks that both arrive byte for byte.
+func transfer(t *testing.T, a, b *MultiConnection, size int) {
+	defer a.Close()
+	defer b.Close()
+
+	send := func(c *MultiConnection, data []byte, errc chan<- error) {
+		for len(data) > 0 {
+			n := 1 + rand2.Intn(3*maxFrameData)
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := c.Write(data[:n]); err != nil {
+				errc <- err
+				return
+			}
+			data = data[n:]
+		}
+		errc <- c.CloseWrite()
+	}
+
+	ab, ba := make([]byte, size), make([]byte, size)
+	rand.Read(ab)
+	rand.Read(ba)
+
+	errc := make(chan error, 2)
+	go send(a, ab, errc)
+	go send(b, ba, errc)
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	results := make(chan result, 2)
+	for _, c := range []*MultiConnection{a, b} {
+		go func(c *MultiConnection) {
+			got, err := ioutil.ReadAll(c)
+			results <- result{got, err}
+		}(c)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("write timed out")
+		}
+	}
+
+	want := [][]byte{ba, ab} // a reads what b wrote
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if !bytes.Equal(r.b, want[0]) && !bytes.Equal(r.b, want[1]) {
+				t.Fatalf("got %d bytes, not what was written", len(r.b))
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("read timed out")
+		}
+	}
+}
+
+func TestMultiConnectionLossyPaths(t *testing.T) {
+	for name, paths := range map[string][]pathConfig{
+		"clean":             {{}},
+		"reordering":        {{maxDelay: 5 * time.Millisecond}},
+		"lossy":             {{loss: 0.2, maxDelay: time.Millisecond}},
+		"lossy, reordering": {{loss: 0.3}, {maxDelay: 5 * time.Millisecond}},
+		"two lossy":         {{loss: 0.5, maxDelay: 2 * time.Millisecond}, {loss: 0.5, maxDelay: 2 * time.Millisecond}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			id := NewSessionID()
+			a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+			for _, p := range paths {
+				ca, cb := lossyPipe(p.loss, p.maxDelay)
+				a.Add(ca)
+				b.Add(cb)
+			}
+			transfer(t, a, b, 512*1024)
+		})
+	}
+}
+
+func TestFrame(t *testing.T) {
+	for _, f := range []*frame{
+		{typ: frameData, offset: 1 << 40, data: []byte("hello")},
+		ackFrame(7, 3, 1024),
+		{typ: frameFin, offset: 12},
+		{typ: framePing},
+		{typ: framePong},
+	} {
+		got, err := readFrame(bytes.NewReader(f.marshal()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.typ != f.typ || got.offset != f.offset || !bytes.Equal(got.data, f.data) {
+			t.Errorf("got %+v, want %+v", got, f)
+		}
+	}
+
+	for _, b := range [][]byte{
+		{9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},        // unknown type
+		{frameAck, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0}, // ack without its offset
+		{frameFin, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0}, // fin with data
+		{framePing, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0},
+		{frameData, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff},
+		{frameData, 0, 0},
+	} {
+		if _, err := readFrame(bytes.NewReader(b)); err == nil {
+			t.Errorf("%v: no error", b)
+		}
+	}
+}
+
+func TestMultiConnectionOverTCPAndKCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	server := NewMultiConnectionManager("test")
+	if _, err := server.Listen("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *MultiConnection, 1)
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.(*MultiConnection)
+	}()
+
+	c, err := NewMultiConnectionManager("test").DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := []byte("hello")
+	if _, err := c.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+
+	var s *MultiConnection
+	select {
+	case s = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session accepted")
+	}
+	got := make([]byte, len(hello))
+	if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, hello) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	transfer(t, c.(*MultiConnection), s, 256*1024)
+}
+
+func TestMultiConnectionFlowControl(t *testing.T) {
+	id := NewSessionID()
+	a, b := NewMultiConnectionById(id), NewMultiConnectionById(id)
+	a.KeepAlive, b.KeepAlive = 50*time.Millisecond, 50*time.Millisecond
+	ca, cb := lossyPipe(0, time.Millisecond)
+	a.Add(ca)
+	b.Add(cb)
+	defer a.Close()
+	defer b.Close()
+
+	data := make([]byte, 4*readWindow)
+	rand.Read(data)
+	var written int64
+	errc := make(chan error, 1)
+	go func() {
+		for p := data; len(p) > 0; p = p[maxFrameData:] {
+			if _, err := a.Write(p[:maxFrameData]); err != nil {
+				errc <- err
+				return
+			}
+			atomic.AddInt64(&written, maxFrameData)
+		}
+		errc <- a.CloseWrite()
+	}()
+
+	// nobody reads b, a stops once b holds a window and a has one in flight,
+	// the path stays
+	time.Sleep(500 * time.Millisecond)
+	if n := atomic.LoadInt64(&written); n > readWindow+sendWindow+maxFrameData {
+		t.Fatalf("wrote %d bytes to a peer not reading", n)
+	}
+	if len(a.paths()) != 1 || len(b.paths()) != 1 {
+		t.Fatal("path dropped while the reader was behind")
+	}
+
+	got, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, not what was written", len(got))
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,665 @@
+package connection
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/socks"
+)
+
+// A MuxConn carries streams over one conn, in frames of:
+//
+//	+------+-----------+--------+--------+
+//	| type | stream id | length | data   |
+//	+------+-----------+--------+--------+
+//	|  1   |     4     |   2    | length |
+//	+------+-----------+--------+--------+
+//
+// The client opens a stream with muxOpen, its data is the socks.Addr of the
+// target. Either end ends it with muxClose, the other end reads EOF and
+// forgets it, frames for a stream it does not know are dropped. Each end
+// takes muxStreamWindow bytes of a stream past what it read, and tells the
+// other with a muxWindow of 4 bytes how many more it takes once it read
+// half. Pings are answered with pongs on stream 0, both carry nothing.
+const (
+	muxOpen byte = iota + 1
+	muxData
+	muxClose
+	muxWindow
+	muxPing
+	muxPong
+)
+
+const (
+	muxHeaderLen    = 1 + 4 + 2
+	maxMuxData      = 16 * 1024
+	muxStreamWindow = 256 * 1024
+)
+
+const (
+	DefaultMuxMaxStreams  = 128
+	DefaultMuxConns       = 4
+	DefaultMuxKeepAlive   = 30 * time.Second
+	DefaultMuxIdleTimeout = 5 * time.Minute
+)
+
+// MuxTarget is what a client sends as its target to start a MuxConn, in
+// place of the target of a connection.
+var MuxTarget = socks.ParseAddr("mux.invalid:0")
+
+var (
+	ErrMuxFull      = errors.New("mux connection has as many streams as it takes")
+	errMuxClosed    = errors.New("mux connection closed")
+	errMuxTimeout   = errors.New("mux connection silent for too long")
+	errMuxIdle      = errors.New("mux connection idle")
+	errStreamClosed = errors.New("stream closed")
+	errMuxRaw       = errors.New("a mux connection is read and written through its streams")
+)
+
+// MuxConfig limits the MuxConns of a client or a server.
+type MuxConfig struct {
+	MaxStreams  int           // open on a conn at once, more are refused
+	Conns       int           // the client opens at most, on the first with room
+	KeepAlive   time.Duration // ping a silent conn, drop it after 3 intervals, off if 0
+	IdleTimeout time.Duration // the client closes a conn without streams after, off if 0
+}
+
+func DefaultMuxConfig() *MuxConfig {
+	return &MuxConfig{
+		MaxStreams:  DefaultMuxMaxStreams,
+		Conns:       DefaultMuxConns,
+		KeepAlive:   DefaultMuxKeepAlive,
+		IdleTimeout: DefaultMuxIdleTimeout,
+	}
+}
+
+// IsMuxTarget tells whether the client sent MuxTarget.
+func IsMuxTarget(a socks.Addr) bool {
+	return a.String() == MuxTarget.String()
+}
+
+type MuxConnParams struct {
+	IsServer bool
+	Config   *MuxConfig // DefaultMuxConfig if nil
+}
+
+var _ dialer.CommonConnection = &MuxConn{}
+
+// MuxConn is a CommonConnection carrying many streams over its parent, the
+// client opens them with Open and the server takes them with Accept. Read
+// and Write of the MuxConn itself fail, Close closes every stream.
+type MuxConn struct {
+	lastRecv int64 // unix nanoseconds, first for atomic alignment
+
+	Conn   net.Conn
+	params MuxConnParams
+	config *MuxConfig
+
+	writeLock sync.Mutex // a frame is written in one piece
+
+	lock      sync.Mutex
+	streams   map[uint32]*MuxStream
+	nextID    uint32
+	idleSince time.Time // zero while streams are open
+	err       error     // why it was closed
+	accepted  chan *MuxStream
+	done      chan struct{}
+}
+
+func (m *MuxConn) Init(parent net.Conn, args interface{}) error {
+	v, ok := args.(MuxConnParams)
+	if !ok {
+		return fmt.Errorf("args is not MuxConnParams:%s", args)
+	}
+	m.Conn = parent
+	m.params = v
+	m.config = v.Config
+	if m.config == nil {
+		m.config = DefaultMuxConfig()
+	}
+	m.streams = make(map[uint32]*MuxStream)
+	m.idleSince = time.Now()
+	m.accepted = make(chan *MuxStream, m.config.MaxStreams)
+	m.done = make(chan struct{})
+	atomic.StoreInt64(&m.lastRecv, time.Now().UnixNano())
+
+	go m.readLoop()
+	if m.config.KeepAlive > 0 || m.config.IdleTimeout > 0 && !m.params.IsServer {
+		go m.keepAlive()
+	}
+	return nil
+}
+
+// Open starts a stream to target.
+func (m *MuxConn) Open(target socks.Addr) (*MuxStream, error) {
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return nil, m.err
+	}
+	if len(m.streams) >= m.config.MaxStreams {
+		m.lock.Unlock()
+		return nil, ErrMuxFull
+	}
+	m.nextID++
+	s := m.newStream(m.nextID, target)
+	m.lock.Unlock()
+
+	if err := m.writeFrame(muxOpen, s.id, target); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for the next stream the client opens.
+func (m *MuxConn) Accept() (*MuxStream, error) {
+	select {
+	case s := <-m.accepted:
+		return s, nil
+	case <-m.done:
+		return nil, m.closeErr()
+	}
+}
+
+// Streams is the number of streams open.
+func (m *MuxConn) Streams() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.streams)
+}
+
+// Closed tells whether the conn is closed, its streams are gone.
+func (m *MuxConn) Closed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// newStream must be called with m.lock held.
+func (m *MuxConn) newStream(id uint32, target socks.Addr) *MuxStream {
+	s := &MuxStream{
+		id:         id,
+		session:    m,
+		target:     target,
+		readBuffer: NewDataBuffer(muxStreamWindow),
+		credit:     muxStreamWindow,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	m.streams[id] = s
+	m.idleSince = time.Time{}
+	return s
+}
+
+func (m *MuxConn) removeStream(id uint32) {
+	m.lock.Lock()
+	delete(m.streams, id)
+	if len(m.streams) == 0 {
+		m.idleSince = time.Now()
+	}
+	m.lock.Unlock()
+}
+
+func (m *MuxConn) stream(id uint32) *MuxStream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.streams[id]
+}
+
+func (m *MuxConn) writeFrame(typ byte, id uint32, data []byte) error {
+	b := make([]byte, muxHeaderLen+len(data))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(data)))
+	copy(b[muxHeaderLen:], data)
+
+	m.writeLock.Lock()
+	_, err := m.Conn.Write(b)
+	m.writeLock.Unlock()
+	if err != nil {
+		m.closeWithError(err)
+	}
+	return err
+}
+
+func (m *MuxConn) readLoop() {
+	r := bufio.NewReader(m.Conn)
+	header := make([]byte, muxHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			m.closeWithError(err)
+			return
+		}
+		typ, id := header[0], binary.BigEndian.Uint32(header[1:])
+		data := make([]byte, binary.BigEndian.Uint16(header[5:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			m.closeWithError(err)
+			return
+		}
+		atomic.StoreInt64(&m.lastRecv, time.Now().UnixNano())
+
+		if err := m.handle(typ, id, data); err != nil {
+			log.Printf("mux connection from %s: %v", m.RemoteAddr(), err)
+			m.closeWithError(err)
+			return
+		}
+	}
+}
+
+// handle does not write itself, so that it never waits for the peer to
+// read while the peer waits for it.
+func (m *MuxConn) handle(typ byte, id uint32, data []byte) error {
+	switch typ {
+	case muxOpen:
+		if !m.params.IsServer {
+			return errors.New("stream opened by the server")
+		}
+		target := socks.SplitAddr(data)
+		if target == nil {
+			return errors.New("stream opened without a target")
+		}
+		m.lock.Lock()
+		if _, ok := m.streams[id]; ok {
+			m.lock.Unlock()
+			return fmt.Errorf("stream %d opened twice", id)
+		}
+		var s *MuxStream
+		if len(m.streams) < m.config.MaxStreams {
+			s = m.newStream(id, target)
+			s.forwardReady = make(chan socks.Addr, 1)
+			s.forwardReady <- target
+		}
+		m.lock.Unlock()
+
+		if s != nil {
+			select {
+			case m.accepted <- s:
+				return nil
+			default:
+				// streams closed before they were accepted take the room
+				m.removeStream(id)
+			}
+		}
+		log.Printf("mux connection from %s: stream to %s refused, %d open", m.RemoteAddr(), target, m.config.MaxStreams)
+		go m.writeFrame(muxClose, id, nil)
+
+	case muxData:
+		if s := m.stream(id); s != nil {
+			return s.received(data)
+		}
+
+	case muxClose:
+		if s := m.stream(id); s != nil {
+			s.peerClose()
+		}
+
+	case muxWindow:
+		if len(data) != 4 {
+			return errors.New("bad window update")
+		}
+		if s := m.stream(id); s != nil {
+			s.grant(int(binary.BigEndian.Uint32(data)))
+		}
+
+	case muxPing:
+		go m.writeFrame(muxPong, 0, nil)
+
+	case muxPong:
+
+	default:
+		return fmt.Errorf("unknown frame type %d", typ)
+	}
+	return nil
+}
+
+// keepAlive pings the peer once it is silent for KeepAlive, and drops the
+// conn after 3 intervals without a frame. The client also closes the conn
+// once it had no stream for IdleTimeout, the server leaves that to it so
+// that a stream is not opened on a conn going away.
+func (m *MuxConn) keepAlive() {
+	interval := m.config.KeepAlive
+	if idle := m.config.IdleTimeout; interval <= 0 || !m.params.IsServer && idle > 0 && idle < interval {
+		interval = idle
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-t.C:
+		}
+
+		if idle := m.config.IdleTimeout; idle > 0 && !m.params.IsServer {
+			m.lock.Lock()
+			reap := !m.idleSince.IsZero() && time.Since(m.idleSince) >= idle
+			m.lock.Unlock()
+			if reap {
+				m.closeWithError(errMuxIdle)
+				return
+			}
+		}
+
+		if m.config.KeepAlive <= 0 {
+			continue
+		}
+		silent := time.Since(time.Unix(0, atomic.LoadInt64(&m.lastRecv)))
+		if silent >= 3*m.config.KeepAlive {
+			log.Printf("mux connection to %s: %v", m.RemoteAddr(), errMuxTimeout)
+			m.closeWithError(errMuxTimeout)
+			return
+		}
+		if silent >= m.config.KeepAlive {
+			m.writeFrame(muxPing, 0, nil)
+		}
+	}
+}
+
+func (m *MuxConn) closeErr() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err
+}
+
+// closeWithError closes the conn and its streams, err is what Open returns
+// from then on.
+func (m *MuxConn) closeWithError(err error) {
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*MuxStream)
+	close(m.done)
+	m.lock.Unlock()
+
+	m.Conn.Close()
+	for _, s := range streams {
+		s.abort(err)
+	}
+}
+
+func (m *MuxConn) Read(b []byte) (n int, err error) {
+	return 0, errMuxRaw
+}
+
+func (m *MuxConn) Write(b []byte) (n int, err error) {
+	return 0, errMuxRaw
+}
+
+func (m *MuxConn) Close() error {
+	m.closeWithError(errMuxClosed)
+	return nil
+}
+
+func (m *MuxConn) LocalAddr() net.Addr {
+	return m.Conn.LocalAddr()
+}
+
+func (m *MuxConn) RemoteAddr() net.Addr {
+	return m.Conn.RemoteAddr()
+}
+
+// The deadlines are the ones of the streams.
+func (m *MuxConn) SetDeadline(t time.Time) error      { return nil }
+func (m *MuxConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *MuxConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var _ dialer.ForwardConnection = &MuxStream{}
+
+// MuxStream is a connection to a target carried by a MuxConn.
+type MuxStream struct {
+	id           uint32
+	session      *MuxConn
+	target       socks.Addr
+	forwardReady chan socks.Addr // server only
+
+	readBuffer *DataBuffer
+	unacked    int32 // bytes read since the last window update
+
+	lock          sync.Mutex
+	cond          *sync.Cond
+	credit        int   // bytes the peer takes
+	err           error // why writes fail
+	writeDeadline deadline
+	closing       sync.Once
+}
+
+// Init does nothing, a stream comes from MuxConn.Open or Accept.
+func (s *MuxStream) Init(parent net.Conn, args interface{}) error {
+	return nil
+}
+
+func (s *MuxStream) ForwardReady() <-chan socks.Addr {
+	return s.forwardReady
+}
+
+// Target is where the stream goes to.
+func (s *MuxStream) Target() socks.Addr {
+	return s.target
+}
+
+func (s *MuxStream) Read(b []byte) (n int, err error) {
+	n, err = s.readBuffer.Read(b)
+	if n > 0 {
+		if unacked := atomic.AddInt32(&s.unacked, int32(n)); unacked >= muxStreamWindow/2 {
+			atomic.AddInt32(&s.unacked, -unacked)
+			w := make([]byte, 4)
+			binary.BigEndian.PutUint32(w, uint32(unacked))
+			s.session.writeFrame(muxWindow, s.id, w)
+		}
+	}
+	return
+}
+
+func (s *MuxStream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		s.lock.Lock()
+		for s.err == nil && s.credit == 0 && !s.writeDeadline.passed() {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			err = s.err
+		} else if s.writeDeadline.passed() {
+			err = errTimeout
+		}
+		if err != nil {
+			s.lock.Unlock()
+			return
+		}
+		m := s.credit
+		if m > len(b) {
+			m = len(b)
+		}
+		if m > maxMuxData {
+			m = maxMuxData
+		}
+		s.credit -= m
+		s.lock.Unlock()
+
+		if err = s.session.writeFrame(muxData, s.id, b[:m]); err != nil {
+			return
+		}
+		b = b[m:]
+		n += m
+	}
+	return
+}
+
+// received takes data the peer sent, more than it was allowed is an error
+// of the peer.
+func (s *MuxStream) received(data []byte) error {
+	if len(data) > s.readBuffer.Free() {
+		return fmt.Errorf("stream %d overran its window", s.id)
+	}
+	s.readBuffer.Write(data)
+	return nil
+}
+
+func (s *MuxStream) grant(n int) {
+	s.lock.Lock()
+	s.credit += n
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// peerClose ends the stream on a muxClose, what arrived before is read
+// first.
+func (s *MuxStream) peerClose() {
+	s.closing.Do(func() {
+		s.session.removeStream(s.id)
+		s.setErr(errStreamClosed)
+		s.readBuffer.Close()
+	})
+}
+
+// abort ends the stream with its MuxConn.
+func (s *MuxStream) abort(err error) {
+	s.closing.Do(func() {
+		s.setErr(err)
+		s.readBuffer.CloseWithError(err)
+	})
+}
+
+func (s *MuxStream) setErr(err error) {
+	s.lock.Lock()
+	s.err = err
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// Close tells the peer the stream is over, unless it did first.
+func (s *MuxStream) Close() error {
+	s.closing.Do(func() {
+		s.session.removeStream(s.id)
+		s.setErr(errStreamClosed)
+		s.readBuffer.CloseWithError(errStreamClosed)
+		s.session.writeFrame(muxClose, s.id, nil)
+	})
+	return nil
+}
+
+func (s *MuxStream) LocalAddr() net.Addr {
+	return s.session.LocalAddr()
+}
+
+func (s *MuxStream) RemoteAddr() net.Addr {
+	return s.session.RemoteAddr()
+}
+
+func (s *MuxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *MuxStream) SetReadDeadline(t time.Time) error {
+	return s.readBuffer.SetReadDeadline(t)
+}
+
+func (s *MuxStream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writeDeadline.set(t, s.cond)
+	return nil
+}
+
+// MuxPool opens streams on the MuxConns Dial returns, on the one with the
+// fewest streams, and dials another while there are fewer than Config.Conns
+// and every one is in use.
+type MuxPool struct {
+	Config *MuxConfig // DefaultMuxConfig if nil
+	Dial   func(timeout time.Duration) (*MuxConn, error)
+
+	lock    sync.Mutex
+	conns   []*MuxConn
+	dialing int
+	closed  bool
+}
+
+func (p *MuxPool) Open(target socks.Addr, timeout time.Duration) (*MuxStream, error) {
+	config := p.Config
+	if config == nil {
+		config = DefaultMuxConfig()
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrPoolClosed
+	}
+	var best *MuxConn
+	live := p.conns[:0]
+	for _, m := range p.conns {
+		if m.Closed() {
+			continue
+		}
+		live = append(live, m)
+		if n := m.Streams(); n < config.MaxStreams && (best == nil || n < best.Streams()) {
+			best = m
+		}
+	}
+	p.conns = live
+	dial := len(p.conns)+p.dialing < config.Conns && (best == nil || best.Streams() > 0)
+	if dial {
+		p.dialing++
+	}
+	p.lock.Unlock()
+
+	if dial {
+		m, err := p.Dial(timeout)
+		p.lock.Lock()
+		p.dialing--
+		p.lock.Unlock()
+		if err != nil {
+			if best == nil {
+				return nil, err
+			}
+			log.Printf("failed to add a mux connection: %v", err)
+		} else {
+			p.lock.Lock()
+			closed := p.closed
+			if !closed {
+				p.conns = append(p.conns, m)
+			}
+			p.lock.Unlock()
+			if closed {
+				m.Close()
+				return nil, ErrPoolClosed
+			}
+			best = m
+		}
+	}
+	if best == nil {
+		return nil, ErrMuxFull
+	}
+	return best.Open(target)
+}
+
+// Close closes the conns of the pool and their streams, Open fails from
+// then on.
+func (p *MuxPool) Close() error {
+	p.lock.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.closed = true
+	p.lock.Unlock()
+
+	for _, m := range conns {
+		m.Close()
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/socks"
+)
+
+func muxPair(client, server *MuxConfig) (*MuxConn, *MuxConn) {
+	a, b := net.Pipe()
+	return dialer.MakeConnection(a, []dialer.CommonConnection{&MuxConn{}}, []interface{}{MuxConnParams{Config: client}}).(*MuxConn),
+		dialer.MakeConnection(b, []dialer.CommonConnection{&MuxConn{}}, []interface{}{MuxConnParams{IsServer: true, Config: server}}).(*MuxConn)
+}
+
+// echo echoes the streams of m, after their target.
+func echo(m *MuxConn) {
+	for {
+		s, err := m.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer s.Close()
+			s.Write([]byte((<-s.ForwardReady()).String()))
+			io.Copy(s, s)
+		}()
+	}
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, server := muxPair(nil, nil)
+	defer client.Close()
+	go echo(server)
+
+	// more than a window each, read back while written
+	const size = 3 * muxStreamWindow
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			target := socks.ParseAddr(net.JoinHostPort("example.com", string(rune('0'+port))))
+			s, err := client.Open(target)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer s.Close()
+
+			data := make([]byte, size)
+			rand.Read(data)
+			go s.Write(data)
+
+			got := make([]byte, len(target.String())+size)
+			if _, err := io.ReadFull(s, got); err != nil {
+				t.Error(err)
+				return
+			}
+			if string(got[:len(target.String())]) != target.String() || !bytes.Equal(got[len(target.String()):], data) {
+				t.Errorf("stream to %s echoed something else", target)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := client.Streams(); n != 0 {
+		t.Errorf("%d streams left open", n)
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	client, server := muxPair(nil, nil)
+	defer client.Close()
+
+	s, err := client.Open(socks.ParseAddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hello"))
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// what was sent before the close is read, then EOF
+	got, err := ioutil.ReadAll(ss)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if _, err := ss.Write([]byte("x")); err == nil {
+		t.Fatal("wrote to a closed stream")
+	}
+
+	// the streams go with the conn
+	s, _ = client.Open(socks.ParseAddr("example.com:80"))
+	server.Close()
+	if _, err := s.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a stream of a closed conn")
+	}
+	if _, err := client.Open(socks.ParseAddr("example.com:80")); err == nil {
+		t.Fatal("opened a stream on a closed conn")
+	}
+}
+
+func TestMuxLimits(t *testing.T) {
+	config := DefaultMuxConfig()
+	config.MaxStreams = 1
+	client, server := muxPair(nil, config)
+	defer client.Close()
+	go echo(server)
+
+	target := socks.ParseAddr("example.com:80")
+	s1, _ := client.Open(target)
+	defer s1.Close()
+	b := make([]byte, len(target.String()))
+	if _, err := io.ReadFull(s1, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// refused by the server
+	s2, _ := client.Open(target)
+	if _, err := s2.Read(b); err != io.EOF {
+		t.Fatalf("refused stream read %v", err)
+	}
+
+	client2, _ := muxPair(config, nil)
+	defer client2.Close()
+	client2.Open(target)
+	if _, err := client2.Open(target); err != ErrMuxFull {
+		t.Fatalf("opened a stream past MaxStreams: %v", err)
+	}
+}
+
+func TestMuxIdleAndKeepAlive(t *testing.T) {
+	config := &MuxConfig{MaxStreams: 8, Conns: 1, IdleTimeout: 50 * time.Millisecond}
+	client, server := muxPair(config, nil)
+	defer server.Close()
+
+	s, _ := client.Open(socks.ParseAddr("example.com:80"))
+	time.Sleep(150 * time.Millisecond)
+	if client.Closed() {
+		t.Fatal("closed with a stream open")
+	}
+	s.Close()
+	time.Sleep(150 * time.Millisecond)
+	if !client.Closed() {
+		t.Fatal("idle conn not closed")
+	}
+
+	// a peer that reads but never answers
+	a, b := net.Pipe()
+	go io.Copy(ioutil.Discard, b)
+	defer b.Close()
+	m := dialer.MakeConnection(a, []dialer.CommonConnection{&MuxConn{}},
+		[]interface{}{MuxConnParams{Config: &MuxConfig{MaxStreams: 8, KeepAlive: 20 * time.Millisecond}}}).(*MuxConn)
+	time.Sleep(200 * time.Millisecond)
+	if !m.Closed() {
+		t.Fatal("silent conn not dropped")
+	}
+}
+
+func TestMuxPool(t *testing.T) {
+	var lock sync.Mutex
+	var servers []*MuxConn
+	pool := &MuxPool{
+		Config: &MuxConfig{MaxStreams: 2, Conns: 2},
+		Dial: func(timeout time.Duration) (*MuxConn, error) {
+			client, server := muxPair(&MuxConfig{MaxStreams: 2}, nil)
+			go echo(server)
+			lock.Lock()
+			servers = append(servers, server)
+			lock.Unlock()
+			return client, nil
+		},
+	}
+	defer pool.Close()
+
+	target := socks.ParseAddr("example.com:80")
+	var streams []*MuxStream
+	for i := 0; i < 4; i++ {
+		s, err := pool.Open(target, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+	if _, err := pool.Open(target, time.Second); err != ErrMuxFull {
+		t.Fatalf("opened a stream past the limits: %v", err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("dialed %d conns", len(servers))
+	}
+
+	// a closed conn is dialed again
+	streams[0].Close()
+	servers[0].Close()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := pool.Open(target, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 {
+		t.Fatalf("dialed %d conns", len(servers))
+	}
+}
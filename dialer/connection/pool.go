@@ -0,0 +1,280 @@
+package connection
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPoolSize    = 2
+	DefaultPoolMaxIdle = 4 * time.Second // under the 5s a server waits for the target
+	DefaultPoolRefill  = time.Second
+	DefaultPoolActive  = 2 * time.Minute
+
+	poolDialTimeout = 10 * time.Second
+	maxPoolBackoff  = time.Minute
+)
+
+var (
+	ErrPoolClosed = errors.New("connection pool closed")
+	errPoolSpoke  = errors.New("server sent data on a pooled connection")
+	errPoolTooOld = errors.New("pooled connection too old")
+)
+
+// PoolConfig sizes a Pool. The ages and delays are drawn at random so that
+// the pooled conns do not come and go in step.
+type PoolConfig struct {
+	Size    int           // conns kept dialed
+	MaxIdle time.Duration // a conn not taken is closed between MaxIdle/2 and MaxIdle, keep it under what the server waits
+	Refill  time.Duration // a conn taken or closed is dialed again within Refill
+	Active  time.Duration // the pool is refilled until it was not used for Active
+}
+
+func DefaultPoolConfig() *PoolConfig {
+	return &PoolConfig{
+		Size:    DefaultPoolSize,
+		MaxIdle: DefaultPoolMaxIdle,
+		Refill:  DefaultPoolRefill,
+		Active:  DefaultPoolActive,
+	}
+}
+
+// Pool keeps up to Config.Size conns Dial returns ready for Get, the oldest
+// is handed out first. The conns are left as dialed, nothing is written on
+// them until they are handed out. A conn the server closes or writes on
+// while pooled is dropped, and one is read with a deadline in the past
+// before it is handed out to tell it is still open.
+//
+// The pool fills on the first Get, refills while it is used and drains once
+// it was not for Config.Active. Failed dials are retried after a delay
+// doubling up to a minute.
+type Pool struct {
+	Config *PoolConfig // DefaultPoolConfig if nil
+	Dial   func(timeout time.Duration) (net.Conn, error)
+
+	lock    sync.Mutex
+	idle    []*pooledConn
+	used    time.Time
+	started bool
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// pooledConn is read by watch while pooled, a Read returning means the
+// conn is gone.
+type pooledConn struct {
+	net.Conn
+	expire *time.Timer
+	read   chan error
+}
+
+func (p *Pool) config() *PoolConfig {
+	if p.Config == nil {
+		return DefaultPoolConfig()
+	}
+	return p.Config
+}
+
+// Get hands out a pooled conn, or dials one if none is ready.
+func (p *Pool) Get(timeout time.Duration) (net.Conn, error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrPoolClosed
+	}
+	p.used = time.Now()
+	if !p.started {
+		p.started = true
+		p.wake = make(chan struct{}, 1)
+		p.done = make(chan struct{})
+		go p.fill()
+	}
+
+	for len(p.idle) > 0 {
+		c := p.idle[0]
+		p.idle = p.idle[1:]
+		p.lock.Unlock()
+		p.refill()
+
+		if c.take() {
+			return c.Conn, nil
+		}
+		p.lock.Lock()
+	}
+	p.lock.Unlock()
+	p.refill()
+
+	return p.Dial(timeout)
+}
+
+// Close closes the pooled conns, the ones handed out are left alone.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	if !p.closed && p.started {
+		close(p.done)
+	}
+	p.closed = true
+	p.lock.Unlock()
+
+	for _, c := range idle {
+		c.expire.Stop()
+		c.Close()
+	}
+	return nil
+}
+
+// Idle returns how many conns are pooled.
+func (p *Pool) Idle() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.idle)
+}
+
+func (p *Pool) refill() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// needed tells whether the pool is short of a conn and still in use.
+func (p *Pool) needed() bool {
+	config := p.config()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.closed && len(p.idle) < config.Size && time.Since(p.used) < config.Active
+}
+
+func (p *Pool) fill() {
+	var backoff time.Duration
+	for {
+		select {
+		case <-p.wake:
+		case <-p.done:
+			return
+		}
+
+		for p.needed() {
+			if !p.sleep(jitter(p.config().Refill) + backoff) {
+				return
+			}
+			if !p.needed() {
+				break
+			}
+
+			c, err := p.Dial(poolDialTimeout)
+			if err != nil {
+				backoff = 2*backoff + time.Second
+				if backoff > maxPoolBackoff {
+					backoff = maxPoolBackoff
+				}
+				log.Printf("failed to dial a pooled connection, next in %s: %v", backoff, err)
+				continue
+			}
+			backoff = 0
+			p.add(c)
+		}
+	}
+}
+
+func (p *Pool) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *Pool) add(conn net.Conn) {
+	config := p.config()
+	c := &pooledConn{Conn: conn, read: make(chan error, 1)}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+	c.expire = time.AfterFunc(config.MaxIdle/2+jitter(config.MaxIdle/2), func() {
+		p.drop(c, errPoolTooOld)
+	})
+	p.lock.Unlock()
+
+	go p.watch(c)
+}
+
+// watch reads c until it is taken or gone.
+func (p *Pool) watch(c *pooledConn) {
+	var b [1]byte
+	n, err := c.Conn.Read(b[:])
+	if n > 0 {
+		err = errPoolSpoke
+	}
+	c.read <- err
+	if err != nil && !timedOut(err) {
+		p.drop(c, err)
+	}
+}
+
+// drop closes c if it is still pooled, and refills.
+func (p *Pool) drop(c *pooledConn, err error) {
+	p.lock.Lock()
+	found := false
+	for i, o := range p.idle {
+		if o == c {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			found = true
+			break
+		}
+	}
+	p.lock.Unlock()
+	if !found {
+		return
+	}
+
+	c.expire.Stop()
+	c.Close()
+	if err != errPoolTooOld {
+		log.Printf("pooled connection to %s dropped: %v", c.RemoteAddr(), err)
+	}
+	p.refill()
+}
+
+// take stops watching c, it is still open if the Read of watch only stops
+// at the deadline.
+func (c *pooledConn) take() bool {
+	c.expire.Stop()
+	c.SetReadDeadline(time.Unix(1, 0))
+	err := <-c.read
+	if !timedOut(err) {
+		c.Close()
+		return false
+	}
+	c.SetReadDeadline(time.Time{})
+	return true
+}
+
+func timedOut(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// jitter returns a random duration up to d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
@@ -0,0 +1,190 @@
+package connection
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// poolServer accepts conns and keeps them, for the test to look at.
+type poolServer struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func newPoolServer(t *testing.T) *poolServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &poolServer{Listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns = append(s.conns, c)
+			s.lock.Unlock()
+		}
+	}()
+	return s
+}
+
+func (s *poolServer) accepted() []net.Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]net.Conn(nil), s.conns...)
+}
+
+func (s *poolServer) pool(config *PoolConfig) *Pool {
+	return &Pool{
+		Config: config,
+		Dial: func(timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", s.Addr().String(), timeout)
+		},
+	}
+}
+
+func waitIdle(p *Pool, n int) bool {
+	for i := 0; i < 100; i++ {
+		if p.Idle() == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPool(t *testing.T) {
+	s := newPoolServer(t)
+	defer s.Close()
+	p := s.pool(&PoolConfig{Size: 2, MaxIdle: time.Minute, Refill: 10 * time.Millisecond, Active: time.Minute})
+	defer p.Close()
+
+	// the first is dialed, then the pool fills
+	c, err := p.Get(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if !waitIdle(p, 2) {
+		t.Fatalf("%d conns pooled", p.Idle())
+	}
+
+	// nothing is sent on a pooled conn
+	for _, sc := range s.accepted() {
+		sc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		if n, _ := sc.Read(make([]byte, 1)); n > 0 {
+			t.Fatal("pooled conn written")
+		}
+	}
+
+	// a pooled conn is handed out open, and replaced
+	c, err = p.Get(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if !waitIdle(p, 2) {
+		t.Fatalf("%d conns pooled after one was taken", p.Idle())
+	}
+	if n := len(s.accepted()); n != 4 {
+		t.Fatalf("%d conns dialed", n)
+	}
+
+	// the ones the server closes are dropped and replaced
+	closed := s.accepted()
+	for _, sc := range closed {
+		sc.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !waitIdle(p, 2) {
+		t.Fatalf("%d conns pooled after the server closed them", p.Idle())
+	}
+	c, _ = p.Get(time.Second)
+	defer c.Close()
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sc := range s.accepted()[len(closed):] {
+		sc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if n, _ := sc.Read(make([]byte, 1)); n == 1 {
+			return
+		}
+	}
+	t.Fatal("handed out a conn the server closed")
+}
+
+func TestPoolAging(t *testing.T) {
+	s := newPoolServer(t)
+	defer s.Close()
+	p := s.pool(&PoolConfig{Size: 4, MaxIdle: 100 * time.Millisecond, Active: 300 * time.Millisecond})
+	defer p.Close()
+
+	c, _ := p.Get(time.Second)
+	c.Close()
+	if !waitIdle(p, 4) {
+		t.Fatalf("%d conns pooled", p.Idle())
+	}
+
+	// each is closed between 50 and 100ms after it was pooled
+	var lock sync.Mutex
+	var ages []time.Duration
+	var wg sync.WaitGroup
+	for _, sc := range s.accepted()[1:] {
+		wg.Add(1)
+		go func(sc net.Conn) {
+			defer wg.Done()
+			start := time.Now()
+			sc.SetReadDeadline(start.Add(time.Second))
+			sc.Read(make([]byte, 1))
+			lock.Lock()
+			ages = append(ages, time.Since(start))
+			lock.Unlock()
+		}(sc)
+	}
+	wg.Wait()
+	same := true
+	for _, age := range ages {
+		if age > 150*time.Millisecond {
+			t.Fatalf("pooled conn kept %s", age)
+		}
+		same = same && (age-ages[0])/time.Millisecond == 0
+	}
+	if same {
+		t.Fatalf("pooled conns aged in step: %v", ages)
+	}
+
+	// replaced while used, drained once not
+	if n := len(s.accepted()); n <= 5 {
+		t.Fatalf("%d conns dialed, none replaced", n)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := p.Idle(); n != 0 {
+		t.Fatalf("%d conns pooled when unused", n)
+	}
+}
+
+func TestPoolJitter(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 10; i++ {
+		d := jitter(time.Second)
+		if d < 0 || d >= time.Second {
+			t.Fatalf("jitter %s out of range", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("jitter not random")
+	}
+	if jitter(0) != 0 {
+		t.Fatal("jitter of 0")
+	}
+}
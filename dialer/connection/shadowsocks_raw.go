@@ -56,9 +56,14 @@ func (cc *ShadowsocksRawConn) Read(b []byte) (n int, err error) {
 			return
 		}
 
-		cc.forwardReady <- tgt
 		cc.params.Target = tgt
 		cc.isServerTargetRead = true
+		cc.forwardReady <- tgt
+
+		// Read(nil) only reads the target, whoever got it reads the rest
+		if len(b) == 0 {
+			return 0, nil
+		}
 	}
 
 	return cc.Conn.Read(b)
@@ -93,7 +98,7 @@ func (cc *ShadowsocksRawConn) RemoteAddr() net.Addr {
 }
 
 func (cc *ShadowsocksRawConn) SetDeadline(t time.Time) error {
-	return cc.Conn.SetReadDeadline(t)
+	return cc.Conn.SetDeadline(t)
 }
 
 func (cc *ShadowsocksRawConn) SetReadDeadline(t time.Time) error {
@@ -0,0 +1,353 @@
+// Package detour connects to targets directly and falls back to the proxy
+// when the direct connection looks blocked.
+package detour
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+)
+
+const (
+	DefaultDirectDialTimeout = 3 * time.Second
+	DefaultResponseTimeout   = 5 * time.Second
+	DefaultMaxReplayBuffer   = 64 * 1024
+)
+
+// Detour dials targets directly first. A direct connection is watched until
+// the target sends its first bytes; a reset, a timeout or no response within
+// ResponseTimeout makes it retry through Proxy. Data already written is only
+// replayed on the proxy connection if sending it twice is harmless, that is a
+// single write of a TLS handshake or a safe HTTP method. Otherwise the error
+// goes to the caller.
+type Detour struct {
+	Proxy  dialer.DialFunc
+	Direct dialer.DialFunc
+	Store  *Store
+
+	DirectDialTimeout time.Duration
+	ResponseTimeout   time.Duration
+	MaxReplayBuffer   int
+}
+
+func GenDial(proxyDial dialer.DialFunc, directDial dialer.DialFunc) dialer.DialFunc {
+	d := &Detour{Proxy: proxyDial, Direct: directDial, Store: NewStore("")}
+	return d.Dial
+}
+
+func (d *Detour) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if blocked, known := d.Store.Lookup(host); known && blocked {
+		return d.Proxy(network, addr, timeout)
+	}
+
+	directTimeout := d.DirectDialTimeout
+	if directTimeout == 0 {
+		directTimeout = DefaultDirectDialTimeout
+	}
+	if timeout > 0 && timeout < directTimeout {
+		directTimeout = timeout
+	}
+
+	c, err := d.Direct(network, addr, directTimeout)
+	if err != nil {
+		log.Printf("detour: direct connection to %s failed (%v), trying proxy", addr, err)
+		pc, perr := d.Proxy(network, addr, timeout)
+		if perr != nil {
+			return nil, perr
+		}
+		d.Store.MarkBlocked(host)
+		return pc, nil
+	}
+
+	return &conn{
+		d:          d,
+		network:    network,
+		addr:       addr,
+		host:       host,
+		timeout:    timeout,
+		cur:        c,
+		replayable: true,
+	}, nil
+}
+
+func (d *Detour) responseTimeout() time.Duration {
+	if d.ResponseTimeout == 0 {
+		return DefaultResponseTimeout
+	}
+	return d.ResponseTimeout
+}
+
+func (d *Detour) maxReplayBuffer() int {
+	if d.MaxReplayBuffer == 0 {
+		return DefaultMaxReplayBuffer
+	}
+	return d.MaxReplayBuffer
+}
+
+const (
+	stateProbing = iota
+	stateDirect
+	stateProxied
+)
+
+type conn struct {
+	d       *Detour
+	network string
+	addr    string
+	host    string
+	timeout time.Duration
+
+	lock       sync.Mutex
+	cur        net.Conn
+	state      int
+	sent       []byte
+	wrote      bool
+	replayable bool
+	armed      bool
+	closed     bool
+}
+
+func (c *conn) current() (net.Conn, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cur, c.state
+}
+
+func (c *conn) Read(b []byte) (n int, err error) {
+	for {
+		cur, state := c.current()
+		n, err = cur.Read(b)
+		if state != stateProbing {
+			return
+		}
+
+		if n > 0 {
+			c.settle(cur, true)
+			return
+		}
+		if err == nil {
+			return
+		}
+
+		c.lock.Lock()
+		if c.state != stateProbing || c.cur != cur || c.closed {
+			c.lock.Unlock()
+			return
+		}
+
+		if !c.looksBlocked(err) {
+			c.lock.Unlock()
+			return
+		}
+
+		if !c.replayable {
+			log.Printf("detour: %s looks blocked (%v) but the request can't be replayed", c.addr, err)
+			c.lock.Unlock()
+			if isTimeout(err) {
+				// the target may just be slow, keep waiting without the probe deadline
+				c.settle(cur, false)
+				continue
+			}
+			return
+		}
+
+		log.Printf("detour: %s looks blocked (%v), retrying through proxy", c.addr, err)
+		c.lock.Unlock()
+		if perr := c.switchToProxy(cur); perr == errMoved {
+			continue
+		} else if perr != nil {
+			log.Printf("detour: proxy connection to %s failed: %v", c.addr, perr)
+			return
+		}
+	}
+}
+
+func (c *conn) Write(b []byte) (n int, err error) {
+	c.lock.Lock()
+	cur, state := c.cur, c.state
+	if state != stateProbing {
+		c.lock.Unlock()
+		return cur.Write(b)
+	}
+
+	// only the first write is replayed, what follows it may depend on an
+	// answer, like a POST pipelined after a GET
+	if !c.wrote && c.replayable && dialer.IsReplayable(b) && len(b) <= c.d.maxReplayBuffer() {
+		c.sent = append([]byte(nil), b...)
+	} else {
+		c.replayable = false
+		c.sent = nil
+	}
+	c.wrote = true
+
+	if !c.armed {
+		cur.SetReadDeadline(time.Now().Add(c.d.responseTimeout()))
+		c.armed = true
+	}
+	c.lock.Unlock()
+
+	// not under the lock, a write to a stalled target must not keep Close
+	// and the deadlines from the conn
+	n, err = cur.Write(b)
+	if err == nil {
+		return
+	}
+
+	c.lock.Lock()
+	retry := c.cur == cur && c.state == stateProbing && !c.closed && c.replayable && c.looksBlocked(err)
+	c.lock.Unlock()
+	if retry {
+		log.Printf("detour: write to %s failed (%v), retrying through proxy", c.addr, err)
+		if perr := c.switchToProxy(cur); perr == nil {
+			return len(b), nil
+		}
+	}
+	return
+}
+
+// settle ends probing on cur. ok tells whether the target answered.
+func (c *conn) settle(cur net.Conn, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != stateProbing || c.cur != cur {
+		return
+	}
+
+	c.state = stateDirect
+	c.sent = nil
+	if c.armed {
+		c.cur.SetReadDeadline(time.Time{})
+	}
+	if ok {
+		c.d.Store.MarkDirect(c.host)
+	}
+}
+
+// errMoved is returned by switchToProxy when the conn was closed or moved
+// off cur while the proxy was dialed.
+var errMoved = errors.New("detour: connection moved on")
+
+// switchToProxy replaces cur with a proxy connection the first write is
+// replayed on. The proxy is dialed without c.lock held.
+func (c *conn) switchToProxy(cur net.Conn) error {
+	c.lock.Lock()
+	if c.cur != cur || c.state != stateProbing || c.closed {
+		c.lock.Unlock()
+		return errMoved
+	}
+	sent := c.sent
+	c.lock.Unlock()
+
+	pc, err := c.d.Proxy(c.network, c.addr, c.timeout)
+	if err != nil {
+		return err
+	}
+
+	if len(sent) > 0 {
+		if _, err := pc.Write(sent); err != nil {
+			pc.Close()
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	if c.cur != cur || c.state != stateProbing || c.closed {
+		c.lock.Unlock()
+		pc.Close()
+		return errMoved
+	}
+	c.cur = pc
+	c.state = stateProxied
+	c.sent = nil
+	c.lock.Unlock()
+
+	cur.Close()
+	c.d.Store.MarkBlocked(c.host)
+	return nil
+}
+
+// looksBlocked must be called with c.lock held.
+func (c *conn) looksBlocked(err error) bool {
+	if isTimeout(err) || isReset(err) {
+		return true
+	}
+	// closed right after the request without a single byte of response
+	return err == io.EOF && len(c.sent) > 0
+}
+
+func (c *conn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	return c.cur.Close()
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	cur, _ := c.current()
+	return cur.LocalAddr()
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	cur, _ := c.current()
+	return cur.RemoteAddr()
+}
+
+// Deadlines set by the caller end probing, they must not be mistaken for a
+// blocked target.
+func (c *conn) SetDeadline(t time.Time) error {
+	c.stopProbing()
+	cur, _ := c.current()
+	return cur.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.stopProbing()
+	cur, _ := c.current()
+	return cur.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	cur, _ := c.current()
+	return cur.SetWriteDeadline(t)
+}
+
+func (c *conn) stopProbing() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == stateProbing {
+		c.state = stateDirect
+		c.sent = nil
+	}
+}
+
+func isTimeout(err error) bool {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
+	}
+	return false
+}
+
+func isReset(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNRESET
+}
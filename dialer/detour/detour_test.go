@@ -0,0 +1,394 @@
+package detour
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resetServer accepts connections, reads the request and resets the connection.
+func resetServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				c.Read(make([]byte, 1024))
+				c.(*net.TCPConn).SetLinger(0)
+				c.Close()
+			}(c)
+		}
+	}()
+	return l
+}
+
+// echoServer echoes back everything with a prefix, counting requests.
+func echoServer(t *testing.T, prefix string) (net.Listener, chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				b := make([]byte, 1024)
+				n, err := c.Read(b)
+				if err != nil {
+					return
+				}
+				received <- b[:n]
+				c.Write(append([]byte(prefix), b[:n]...))
+			}(c)
+		}
+	}()
+	return l, received
+}
+
+// fixedDial ignores the requested address and always connects to target.
+func fixedDial(target string) func(network, address string, timeout time.Duration) (net.Conn, error) {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("tcp", target, timeout)
+	}
+}
+
+func TestDetourOnReset(t *testing.T) {
+	direct := resetServer(t)
+	defer direct.Close()
+	proxy, received := echoServer(t, "proxy:")
+	defer proxy.Close()
+
+	d := &Detour{
+		Proxy:  fixedDial(proxy.Addr().String()),
+		Direct: fixedDial(direct.Addr().String()),
+		Store:  NewStore(""),
+	}
+
+	c, err := d.Dial("tcp", "blocked.example:80", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := []byte("GET / HTTP/1.1\r\nHost: blocked.example\r\n\r\n")
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, append([]byte("proxy:"), req...)) {
+		t.Fatalf("unexpected response %q", b)
+	}
+	if got := <-received; !bytes.Equal(got, req) {
+		t.Fatalf("proxy got %q", got)
+	}
+
+	if blocked, known := d.Store.Lookup("blocked.example"); !known || !blocked {
+		t.Fatalf("blocked.example should be remembered as blocked")
+	}
+}
+
+func TestDetourOnSilence(t *testing.T) {
+	direct, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+	go func() {
+		for {
+			c, err := direct.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	proxy, _ := echoServer(t, "proxy:")
+	defer proxy.Close()
+
+	d := &Detour{
+		Proxy:           fixedDial(proxy.Addr().String()),
+		Direct:          fixedDial(direct.Addr().String()),
+		Store:           NewStore(""),
+		ResponseTimeout: 200 * time.Millisecond,
+	}
+
+	c, err := d.Dial("tcp", "silent.example:443", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	hello := []byte{0x16, 0x03, 0x01, 0x00, 0x01, 0x01}
+	c.Write(hello)
+
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, append([]byte("proxy:"), hello...)) {
+		t.Fatalf("unexpected response %q", b)
+	}
+}
+
+func TestNoReplayForUnsafeRequest(t *testing.T) {
+	direct := resetServer(t)
+	defer direct.Close()
+	proxy, received := echoServer(t, "proxy:")
+	defer proxy.Close()
+
+	d := &Detour{
+		Proxy:  fixedDial(proxy.Addr().String()),
+		Direct: fixedDial(direct.Addr().String()),
+		Store:  NewStore(""),
+	}
+
+	c, err := d.Dial("tcp", "post.example:80", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte("POST /pay HTTP/1.1\r\nHost: post.example\r\n\r\n"))
+	if _, err := ioutil.ReadAll(c); err == nil {
+		t.Fatal("expected the reset to reach the caller")
+	}
+
+	select {
+	case b := <-received:
+		t.Fatalf("non-idempotent request replayed through proxy: %q", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, known := d.Store.Lookup("post.example"); known {
+		t.Fatal("unverified failure should not be remembered")
+	}
+}
+
+func TestNoReplayAfterSecondWrite(t *testing.T) {
+	direct := resetServer(t)
+	defer direct.Close()
+	proxy, received := echoServer(t, "proxy:")
+	defer proxy.Close()
+
+	d := &Detour{
+		Proxy:  fixedDial(proxy.Addr().String()),
+		Direct: fixedDial(direct.Addr().String()),
+		Store:  NewStore(""),
+	}
+
+	c, err := d.Dial("tcp", "pipelined.example:80", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: pipelined.example\r\n\r\n"))
+	c.Write([]byte("POST /pay HTTP/1.1\r\nHost: pipelined.example\r\n\r\n"))
+	if _, err := ioutil.ReadAll(c); err == nil {
+		t.Fatal("expected the reset to reach the caller")
+	}
+
+	select {
+	case b := <-received:
+		t.Fatalf("pipelined request replayed through proxy: %q", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStalledWriteDoesNotBlockConn(t *testing.T) {
+	for _, name := range []string{"SetDeadline", "Close"} {
+		local, remote := net.Pipe() // nothing reads remote, a write stalls
+		defer remote.Close()
+		d := &Detour{
+			Proxy: func(network, address string, timeout time.Duration) (net.Conn, error) {
+				t.Fatal("proxy should not be used")
+				return nil, nil
+			},
+			Direct: func(network, address string, timeout time.Duration) (net.Conn, error) { return local, nil },
+			Store:  NewStore(""),
+		}
+
+		c, err := d.Dial("tcp", "stalled.example:80", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrote := make(chan error, 1)
+		go func() {
+			_, err := c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+			wrote <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			if name == "Close" {
+				c.Close()
+			} else {
+				c.SetDeadline(time.Now())
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s blocked behind a stalled write", name)
+		}
+		select {
+		case err := <-wrote:
+			if err == nil {
+				t.Fatalf("stalled write succeeded after %s", name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stalled write not ended by %s", name)
+		}
+		c.Close()
+	}
+}
+
+func TestCloseWhileDialingProxy(t *testing.T) {
+	direct := resetServer(t)
+	defer direct.Close()
+
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	local, remote := net.Pipe()
+	defer remote.Close()
+	d := &Detour{
+		Proxy: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			close(dialing)
+			<-release
+			return local, nil
+		},
+		Direct: fixedDial(direct.Addr().String()),
+		Store:  NewStore(""),
+	}
+
+	c, err := d.Dial("tcp", "slowproxy.example:80", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+	go io.Copy(ioutil.Discard, remote) // takes the replay, if any
+
+	select {
+	case <-dialing:
+	case <-time.After(time.Second):
+		t.Fatal("proxy not dialed after the reset")
+	}
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked behind the proxy dial")
+	}
+
+	close(release)
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatal("read from a closed conn")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not ended by Close")
+	}
+	if _, err := local.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("proxy conn dialed for a closed conn left open: %v", err)
+	}
+}
+
+func TestDirectRemembered(t *testing.T) {
+	direct, _ := echoServer(t, "direct:")
+	defer direct.Close()
+
+	d := &Detour{
+		Proxy: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			t.Fatal("proxy should not be used")
+			return nil, nil
+		},
+		Direct: fixedDial(direct.Addr().String()),
+		Store:  NewStore(""),
+	}
+
+	c, err := d.Dial("tcp", "open.example:80", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte("hello"))
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "direct:hello" {
+		t.Fatalf("unexpected response %q", b)
+	}
+
+	if blocked, known := d.Store.Lookup("open.example"); !known || blocked {
+		t.Fatal("open.example should be remembered as direct")
+	}
+}
+
+func TestStoreSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "detour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "detour.json")
+	s := NewStore(path)
+	s.MarkBlocked("a.example")
+	s.MarkDirect("b.example")
+	s.BlockedTTL = -time.Second
+	s.MarkBlocked("expired.example")
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := NewStore(path)
+	if err := s2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, known := s2.Lookup("a.example"); !known || !blocked {
+		t.Fatal("a.example should be blocked")
+	}
+	if blocked, known := s2.Lookup("b.example"); !known || blocked {
+		t.Fatal("b.example should be direct")
+	}
+	if _, known := s2.Lookup("expired.example"); known {
+		t.Fatal("expired entries should not be loaded")
+	}
+}
@@ -0,0 +1,138 @@
+package detour
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer/cachefile"
+)
+
+const (
+	DefaultBlockedTTL = 24 * time.Hour
+	DefaultDirectTTL  = 2 * time.Hour
+)
+
+type entry struct {
+	Blocked bool      `json:"blocked"`
+	Expire  time.Time `json:"expire"`
+}
+
+// Store remembers which hosts were reachable directly and which needed the
+// proxy. Results expire so that an unblocked site is tried directly again.
+// When Path is set the store can be persisted with Save and Load.
+type Store struct {
+	Path       string
+	BlockedTTL time.Duration
+	DirectTTL  time.Duration
+
+	hosts map[string]entry
+	dirty bool
+	lock  sync.Mutex
+}
+
+func NewStore(path string) *Store {
+	return &Store{
+		Path:       path,
+		BlockedTTL: DefaultBlockedTTL,
+		DirectTTL:  DefaultDirectTTL,
+		hosts:      make(map[string]entry),
+	}
+}
+
+// Lookup returns whether host is known to be blocked. known is false if there
+// is no result for host or it has expired.
+func (s *Store) Lookup(host string) (blocked bool, known bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.hosts[host]
+	if !ok {
+		return false, false
+	}
+	if time.Now().After(e.Expire) {
+		delete(s.hosts, host)
+		s.dirty = true
+		return false, false
+	}
+	return e.Blocked, true
+}
+
+func (s *Store) MarkBlocked(host string) {
+	s.set(host, true, s.BlockedTTL)
+}
+
+func (s *Store) MarkDirect(host string) {
+	s.set(host, false, s.DirectTTL)
+}
+
+func (s *Store) set(host string, blocked bool, ttl time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, ok := s.hosts[host]; ok && e.Blocked != blocked {
+		log.Printf("detour: %s is now blocked=%v", host, blocked)
+	}
+	s.hosts[host] = entry{Blocked: blocked, Expire: time.Now().Add(ttl)}
+	s.dirty = true
+}
+
+// Load reads results saved by Save, dropping the expired ones. A missing file
+// is not an error.
+func (s *Store) Load() error {
+	if s.Path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	hosts := make(map[string]entry)
+	if err := json.Unmarshal(b, &hosts); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for host, e := range hosts {
+		if now.Before(e.Expire) {
+			s.hosts[host] = e
+		}
+	}
+	return nil
+}
+
+// Save writes the results to Path if anything changed since the last save.
+func (s *Store) Save() error {
+	if s.Path == "" {
+		return nil
+	}
+
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(s.hosts, "", "  ")
+	s.dirty = false
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return cachefile.Write(s.Path, b)
+}
+
+// AutoSave calls Save every interval until done is closed, then saves a last time.
+func (s *Store) AutoSave(interval time.Duration, done <-chan struct{}) {
+	cachefile.AutoSave(s.Path, s.Save, interval, done)
+}
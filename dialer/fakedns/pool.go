@@ -0,0 +1,235 @@
+// Package fakedns answers DNS queries with addresses from a reserved range
+// and maps them back to the queried domain names, so that transparently
+// proxied connections can be sent to the server by name.
+package fakedns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer/cachefile"
+)
+
+// DefaultRange is reserved for benchmarking (RFC 2544) and never routed on
+// the internet.
+const DefaultRange = "198.18.0.0/15"
+
+type entry struct {
+	Domain string `json:"domain"`
+	IP     uint32 `json:"ip"`
+}
+
+// Pool hands out an IPv4 address per domain. When all addresses are taken
+// the least recently used one is given to the new domain. If Path is set the
+// mapping survives restarts with Save and Load, so that clients holding on to
+// cached answers still reach the right domain.
+type Pool struct {
+	Path string
+
+	network *net.IPNet
+	first   uint32
+	size    uint32
+	next    uint32
+
+	lock     sync.Mutex
+	lru      *list.List // of *entry, most recent first
+	byDomain map[string]*list.Element
+	byIP     map[uint32]*list.Element
+	dirty    bool
+}
+
+func NewPool(cidr string, path string) (*Pool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if n.IP.To4() == nil {
+		return nil, fmt.Errorf("fake ip range %s is not IPv4", cidr)
+	}
+
+	ones, bits := n.Mask.Size()
+	if bits-ones < 2 || bits-ones > 24 {
+		return nil, fmt.Errorf("fake ip range %s must be between /8 and /30", cidr)
+	}
+
+	return &Pool{
+		Path:     path,
+		network:  n,
+		first:    binary.BigEndian.Uint32(n.IP.To4()) + 1, // skip the network address
+		size:     1<<uint(bits-ones) - 2,                  // and the broadcast address
+		lru:      list.New(),
+		byDomain: make(map[string]*list.Element),
+		byIP:     make(map[uint32]*list.Element),
+	}, nil
+}
+
+func (p *Pool) Contains(ip net.IP) bool {
+	return p.network.Contains(ip)
+}
+
+// IP returns the address for domain, allocating one if needed.
+func (p *Pool) IP(domain string) net.IP {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if e, ok := p.byDomain[domain]; ok {
+		p.lru.MoveToFront(e)
+		return toIP(e.Value.(*entry).IP)
+	}
+
+	var ip uint32
+	if p.next < p.size {
+		ip = p.first + p.next
+		p.next++
+	} else {
+		// recycle the least recently used address
+		e := p.lru.Back()
+		old := e.Value.(*entry)
+		p.lru.Remove(e)
+		delete(p.byDomain, old.Domain)
+		delete(p.byIP, old.IP)
+		ip = old.IP
+	}
+
+	p.add(&entry{Domain: domain, IP: ip})
+	return toIP(ip)
+}
+
+// add must be called with p.lock held.
+func (p *Pool) add(e *entry) {
+	el := p.lru.PushFront(e)
+	p.byDomain[e.Domain] = el
+	p.byIP[e.IP] = el
+	p.dirty = true
+}
+
+// Domain returns the domain ip was handed out for.
+func (p *Pool) Domain(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.Contains(ip4) {
+		return "", false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	e, ok := p.byIP[binary.BigEndian.Uint32(ip4)]
+	if !ok {
+		return "", false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*entry).Domain, true
+}
+
+// ResolveAddr maps addr back to domain:port if its host is a fake IP.
+func (p *Pool) ResolveAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+
+	if domain, ok := p.Domain(ip); ok {
+		return net.JoinHostPort(domain, port)
+	}
+	if p.Contains(ip) {
+		log.Printf("fakedns: no domain for %s, it may have been recycled", ip)
+	}
+	return addr
+}
+
+func toIP(v uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// Load restores the mapping saved by Save. Entries outside the range of the
+// pool are dropped. A missing file is not an error.
+func (p *Pool) Load() error {
+	if p.Path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var entries []*entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// saved most recent first
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.IP < p.first || e.IP >= p.first+p.size {
+			continue
+		}
+		if old, ok := p.byIP[e.IP]; ok {
+			p.lru.Remove(old)
+			delete(p.byDomain, old.Value.(*entry).Domain)
+		}
+		if old, ok := p.byDomain[e.Domain]; ok {
+			p.lru.Remove(old)
+			delete(p.byIP, old.Value.(*entry).IP)
+		}
+		p.add(e)
+		if e.IP-p.first >= p.next {
+			p.next = e.IP - p.first + 1
+		}
+	}
+	p.dirty = false
+	return nil
+}
+
+// Save writes the mapping to Path if it changed since the last save.
+func (p *Pool) Save() error {
+	if p.Path == "" {
+		return nil
+	}
+
+	p.lock.Lock()
+	if !p.dirty {
+		p.lock.Unlock()
+		return nil
+	}
+	entries := make([]*entry, 0, p.lru.Len())
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		entries = append(entries, e.Value.(*entry))
+	}
+	b, err := json.Marshal(entries)
+	p.dirty = false
+	p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return cachefile.Write(p.Path, b)
+}
+
+// AutoSave keeps the mapping saved while the pool runs, see cachefile.AutoSave.
+func (p *Pool) AutoSave(interval time.Duration, done <-chan struct{}) {
+	cachefile.AutoSave(p.Path, p.Save, interval, done)
+}
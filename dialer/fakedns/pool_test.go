@@ -0,0 +1,118 @@
+package fakedns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPoolIP(t *testing.T) {
+	p, err := NewPool("198.18.0.0/30", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := p.IP("a.example.com.")
+	if !a.Equal(net.IPv4(198, 18, 0, 1)) {
+		t.Fatalf("got %s", a)
+	}
+	if ip := p.IP("A.example.com"); !ip.Equal(a) {
+		t.Fatalf("same domain got %s and %s", a, ip)
+	}
+	b := p.IP("b.example.com")
+	if !b.Equal(net.IPv4(198, 18, 0, 2)) {
+		t.Fatalf("got %s", b)
+	}
+
+	if d, ok := p.Domain(a); !ok || d != "a.example.com" {
+		t.Fatalf("got %q, %v", d, ok)
+	}
+
+	// the pool is full, b is the least recently used
+	c := p.IP("c.example.com")
+	if !c.Equal(b) {
+		t.Fatalf("expected %s to be recycled, got %s", b, c)
+	}
+	if d, _ := p.Domain(b); d != "c.example.com" {
+		t.Fatalf("got %q", d)
+	}
+	if _, ok := p.Domain(net.IPv4(198, 18, 0, 3)); ok {
+		t.Fatal("broadcast address handed out")
+	}
+}
+
+func TestPoolResolveAddr(t *testing.T) {
+	p, err := NewPool(DefaultRange, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := p.IP("example.com")
+
+	for addr, want := range map[string]string{
+		net.JoinHostPort(ip.String(), "443"): "example.com:443",
+		"198.18.9.9:80":                      "198.18.9.9:80",
+		"1.2.3.4:80":                         "1.2.3.4:80",
+		"[::1]:80":                           "[::1]:80",
+	} {
+		if got := p.ResolveAddr(addr); got != want {
+			t.Errorf("%s: got %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestPoolSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakedns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fakedns.json")
+
+	p, _ := NewPool("198.18.0.0/29", path)
+	a := p.IP("a.example.com")
+	b := p.IP("b.example.com")
+	p.IP("a.example.com") // b is now the least recently used
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, _ := NewPool("198.18.0.0/29", path)
+	if err := q.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := q.Domain(a); d != "a.example.com" {
+		t.Fatalf("got %q", d)
+	}
+	if ip := q.IP("b.example.com"); !ip.Equal(b) {
+		t.Fatalf("got %s, want %s", ip, b)
+	}
+	c := q.IP("c.example.com")
+	if !c.Equal(net.IPv4(198, 18, 0, 3)) {
+		t.Fatalf("new domain got %s", c)
+	}
+	if err := q.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a smaller range drops what does not fit
+	r, _ := NewPool("198.18.0.0/30", path)
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Domain(a); !ok {
+		t.Fatal("a lost")
+	}
+	if _, ok := r.Domain(c); ok {
+		t.Fatalf("%s kept outside the range", c)
+	}
+}
+
+func TestNewPoolInvalid(t *testing.T) {
+	for _, cidr := range []string{"fd00::/64", "10.0.0.0/31", "10.0.0.0/7", "x"} {
+		if _, err := NewPool(cidr, ""); err == nil {
+			t.Errorf("%s: no error", cidr)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package fakedns
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const DefaultTTL = 60
+
+// Server answers A queries with addresses from Pool. AAAA queries get an
+// empty answer so that clients fall back to IPv4. Other queries are relayed
+// to Upstream, or refused if it is empty.
+type Server struct {
+	Pool     *Pool
+	Upstream string // e.g. "8.8.8.8:53"
+	TTL      uint32
+}
+
+// ListenAndServe serves DNS over UDP on addr until ctx is done.
+func (s *Server) ListenAndServe(addr string, ctx context.Context) (listenAddr string, err error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Printf("failed to listen: %v", err)
+		return
+	}
+
+	listenAddr = pc.LocalAddr().String()
+	log.Printf("FAKE DNS: %s", listenAddr)
+
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, raddr, err := pc.ReadFrom(b)
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				log.Printf("fakedns: failed to read: %v", err)
+				continue
+			}
+
+			req := append([]byte(nil), b[:n]...)
+			go func() {
+				resp, err := s.Handle(req)
+				if err != nil {
+					log.Printf("fakedns: bad query from %s: %v", raddr, err)
+					return
+				}
+				pc.WriteTo(resp, raddr)
+			}()
+		}
+	}()
+
+	return
+}
+
+// Handle returns the response to the DNS message req.
+func (s *Server) Handle(req []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Class == dnsmessage.ClassINET && q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA && s.Upstream != "" {
+		return s.relay(req)
+	}
+
+	rh := dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	}
+
+	var answer *dnsmessage.AResource
+	switch {
+	case q.Class != dnsmessage.ClassINET || h.OpCode != 0:
+		rh.RCode = dnsmessage.RCodeNotImplemented
+	case q.Type == dnsmessage.TypeA:
+		var a dnsmessage.AResource
+		copy(a.A[:], s.Pool.IP(q.Name.String()))
+		answer = &a
+	case q.Type == dnsmessage.TypeAAAA:
+	default:
+		rh.RCode = dnsmessage.RCodeRefused
+	}
+
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+
+	b := dnsmessage.NewBuilder(nil, rh)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if answer != nil {
+		if err := b.StartAnswers(); err != nil {
+			return nil, err
+		}
+		err := b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: ttl}, *answer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func (s *Server) relay(req []byte) ([]byte, error) {
+	c, err := net.DialTimeout("udp", s.Upstream, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 4096)
+	n, err := c.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
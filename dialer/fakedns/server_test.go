@@ -0,0 +1,119 @@
+package fakedns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func query(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET})
+	req, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestServerHandle(t *testing.T) {
+	p, _ := NewPool(DefaultRange, "")
+	s := &Server{Pool: p}
+
+	resp, err := s.Handle(query(t, "example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 42 || !m.Response || m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 {
+		t.Fatalf("bad response %+v", m)
+	}
+	a := m.Answers[0].Body.(*dnsmessage.AResource).A
+	if d, _ := p.Domain(net.IP(a[:])); d != "example.com" {
+		t.Fatalf("%v maps to %q", a, d)
+	}
+	if m.Answers[0].Header.TTL != DefaultTTL {
+		t.Fatalf("ttl %d", m.Answers[0].Header.TTL)
+	}
+
+	resp, _ = s.Handle(query(t, "example.com.", dnsmessage.TypeAAAA))
+	m.Unpack(resp)
+	if m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 0 {
+		t.Fatalf("AAAA: %+v", m)
+	}
+
+	resp, _ = s.Handle(query(t, "example.com.", dnsmessage.TypeMX))
+	m.Unpack(resp)
+	if m.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("MX without upstream: %v", m.RCode)
+	}
+}
+
+func TestServerUpstream(t *testing.T) {
+	// an upstream answering everything with NXDOMAIN
+	up, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := up.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var m dnsmessage.Message
+			m.Unpack(b[:n])
+			m.Response = true
+			m.RCode = dnsmessage.RCodeNameError
+			resp, _ := m.Pack()
+			up.WriteTo(resp, addr)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, _ := NewPool(DefaultRange, "")
+	s := &Server{Pool: p, Upstream: up.LocalAddr().String()}
+	addr, err := s.ListenAndServe("127.0.0.1:0", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for typ, rcode := range map[dnsmessage.Type]dnsmessage.RCode{
+		dnsmessage.TypeA:  dnsmessage.RCodeSuccess,
+		dnsmessage.TypeMX: dnsmessage.RCodeNameError,
+	} {
+		if _, err := c.Write(query(t, "example.com.", typ)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 512)
+		n, err := c.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if m.RCode != rcode {
+			t.Errorf("%v: got %v, want %v", typ, m.RCode, rcode)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Package geoiptest writes small MaxMind DB files for tests.
+package geoiptest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+)
+
+type node struct {
+	child   [2]*node
+	country string
+	leaf    bool
+	id      uint
+}
+
+// Build returns an IPv6 database mapping each CIDR of networks to a country
+// code, stored as {"country": {"iso_code": code}} like GeoLite2-Country.
+// The networks must not overlap. recordSize is 24, 28 or 32.
+func Build(networks map[string]string, recordSize uint) ([]byte, error) {
+	root := &node{}
+
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		bits := n.IP.To16()
+		ones, _ := n.Mask.Size()
+		if ip4 := n.IP.To4(); ip4 != nil {
+			bits = append(make([]byte, 12), ip4...)
+			ones += 96
+		}
+
+		cur := root
+		for i := 0; i < ones; i++ {
+			if cur.leaf {
+				return nil, fmt.Errorf("%s overlaps another network", cidr)
+			}
+			bit := (bits[i/8] >> (7 - uint(i%8))) & 1
+			if cur.child[bit] == nil {
+				cur.child[bit] = &node{}
+			}
+			cur = cur.child[bit]
+		}
+		if cur.child[0] != nil || cur.child[1] != nil {
+			return nil, fmt.Errorf("%s overlaps another network", cidr)
+		}
+		cur.leaf = true
+		cur.country = networks[cidr]
+	}
+
+	// number the inner nodes breadth first, the root is 0
+	var inner []*node
+	queue := []*node{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.leaf {
+			continue
+		}
+		n.id = uint(len(inner))
+		inner = append(inner, n)
+		for _, c := range n.child {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := uint(len(inner))
+
+	var data bytes.Buffer
+	offsets := make(map[string]uint)
+	for _, cidr := range cidrs {
+		c := networks[cidr]
+		if _, ok := offsets[c]; ok {
+			continue
+		}
+		offsets[c] = uint(data.Len())
+		data.Write(encodeMap(
+			"country", encodeMap("iso_code", encodeString(c)),
+		))
+	}
+
+	record := func(n *node) uint {
+		switch {
+		case n == nil:
+			return nodeCount
+		case n.leaf:
+			return nodeCount + 16 + offsets[n.country]
+		}
+		return n.id
+	}
+
+	var out bytes.Buffer
+	for _, n := range inner {
+		l, r := record(n.child[0]), record(n.child[1])
+		switch recordSize {
+		case 24:
+			out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 28:
+			out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l),
+				byte((l>>24)<<4 | (r>>24)&0x0F),
+				byte(r >> 16), byte(r >> 8), byte(r)})
+		case 32:
+			out.Write([]byte{byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l),
+				byte(r >> 24), byte(r >> 16), byte(r >> 8), byte(r)})
+		default:
+			return nil, fmt.Errorf("unsupported record size %d", recordSize)
+		}
+	}
+
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	out.Write(encodeMap(
+		"binary_format_major_version", encodeUint(5, 2),
+		"binary_format_minor_version", encodeUint(5, 0),
+		"build_epoch", encodeUint(9, 1500000000),
+		"database_type", encodeString("Test-Country"),
+		"ip_version", encodeUint(5, 6),
+		"node_count", encodeUint(6, uint64(nodeCount)),
+		"record_size", encodeUint(5, uint64(recordSize)),
+	))
+	return out.Bytes(), nil
+}
+
+// Write builds a database with Build and saves it to path.
+func Write(path string, networks map[string]string, recordSize uint) error {
+	b, err := Build(networks, recordSize)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func control(typ uint, size int) []byte {
+	var b []byte
+	if typ > 7 {
+		b = []byte{byte(size), byte(typ - 7)}
+	} else {
+		b = []byte{byte(typ<<5) | byte(size)}
+	}
+	if size >= 29 {
+		panic("geoiptest: value too long")
+	}
+	return b
+}
+
+func encodeString(s string) []byte {
+	return append(control(2, len(s)), s...)
+}
+
+func encodeUint(typ uint, v uint64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append(control(typ, len(b)), b...)
+}
+
+// encodeMap takes keys followed by their encoded values.
+func encodeMap(kv ...interface{}) []byte {
+	b := control(7, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		b = append(b, encodeString(kv[i].(string))...)
+		b = append(b, kv[i+1].([]byte)...)
+	}
+	return b
+}
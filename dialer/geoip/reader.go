@@ -0,0 +1,344 @@
+// Package geoip reads MaxMind DB (.mmdb) files such as GeoLite2-Country.
+//
+// See https://maxmind.github.io/MaxMind-DB/ for the file format.
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const dataSectionSeparator = 16
+
+var ErrInvalidDatabase = errors.New("invalid MaxMind DB file")
+
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+type Reader struct {
+	Metadata Metadata
+
+	tree      []byte
+	data      []byte
+	ipv4Start uint
+}
+
+func Open(path string) (*Reader, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(b)
+}
+
+func FromBytes(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, ErrInvalidDatabase
+	}
+
+	metaStart := i + len(metadataMarker)
+	v, _, err := decoder{b[metaStart:]}.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidDatabase
+	}
+
+	r := &Reader{}
+	r.Metadata.NodeCount = uint(toUint(m["node_count"]))
+	r.Metadata.RecordSize = uint(toUint(m["record_size"]))
+	r.Metadata.IPVersion = uint(toUint(m["ip_version"]))
+	r.Metadata.BuildEpoch = toUint(m["build_epoch"])
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.Metadata.RecordSize)
+	}
+
+	treeSize := r.Metadata.RecordSize * 2 / 8 * r.Metadata.NodeCount
+	if treeSize+dataSectionSeparator > uint(i) {
+		return nil, ErrInvalidDatabase
+	}
+	r.tree = b[:treeSize]
+	r.data = b[treeSize+dataSectionSeparator : i]
+
+	if r.Metadata.IPVersion == 6 {
+		// IPv4 addresses live in ::/96
+		node := uint(0)
+		for n := 0; n < 96 && node < r.Metadata.NodeCount; n++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint16:
+		return uint64(n)
+	case uint32:
+		return uint64(n)
+	case uint64:
+		return n
+	}
+	return 0
+}
+
+func (r *Reader) record(node uint, bit uint) uint {
+	switch r.Metadata.RecordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := r.tree[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		off := node * 7
+		b := r.tree[off : off+7]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		b := r.tree[off : off+4]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+// Lookup returns the record for ip, or nil if the database has none.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	var node uint
+	bits := ip.To4()
+
+	if bits != nil {
+		node = r.ipv4Start
+	} else if r.Metadata.IPVersion == 6 {
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return nil, fmt.Errorf("can't look up %s in an IPv%d database", ip, r.Metadata.IPVersion)
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < len(bits)*8 && node < nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+
+	if node == nodeCount {
+		return nil, nil
+	}
+	if node < nodeCount {
+		return nil, ErrInvalidDatabase
+	}
+
+	off := node - nodeCount - dataSectionSeparator
+	if off >= uint(len(r.data)) {
+		return nil, ErrInvalidDatabase
+	}
+	v, _, err := decoder{r.data}.decode(off)
+	return v, err
+}
+
+// Country returns the ISO 3166-1 code of the country of ip, or "" if unknown.
+func (r *Reader) Country(ip net.IP) (string, error) {
+	v, err := r.Lookup(ip)
+	if err != nil || v == nil {
+		return "", err
+	}
+
+	m, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := m[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decoder decodes the data section, offsets are relative to its start.
+type decoder struct {
+	buf []byte
+}
+
+func (d decoder) decode(off uint) (v interface{}, next uint, err error) {
+	typ, size, off, err := d.control(off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		ptr, next, err := d.pointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+
+	if typ != typeMap && typ != typeArray && typ != typeBool && off+size > uint(len(d.buf)) {
+		return nil, 0, ErrInvalidDatabase
+	}
+
+	switch typ {
+	case typeString:
+		return string(d.buf[off : off+size]), off + size, nil
+	case typeBytes:
+		return append([]byte(nil), d.buf[off:off+size]...), off + size, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return math.Float64frombits(d.uint(off, size)), off + size, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return math.Float32frombits(uint32(d.uint(off, size))), off + size, nil
+	case typeUint16:
+		return uint16(d.uint(off, size)), off + size, nil
+	case typeUint32:
+		return uint32(d.uint(off, size)), off + size, nil
+	case typeInt32:
+		return int32(d.uint(off, size)), off + size, nil
+	case typeUint64:
+		return d.uint(off, size), off + size, nil
+	case typeUint128:
+		return append([]byte(nil), d.buf[off:off+size]...), off + size, nil
+	case typeBool:
+		return size != 0, off, nil
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, off, err = d.decode(off); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, ErrInvalidDatabase
+			}
+			if v, off, err = d.decode(off); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, off, err = d.decode(off); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+func (d decoder) control(off uint) (typ uint, size uint, next uint, err error) {
+	if off >= uint(len(d.buf)) {
+		return 0, 0, 0, ErrInvalidDatabase
+	}
+	ctrl := d.buf[off]
+	off++
+
+	typ = uint(ctrl >> 5)
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			return 0, 0, 0, ErrInvalidDatabase
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+
+	size = uint(ctrl & 0x1f)
+	if typ == typePointer {
+		return typ, size, off, nil
+	}
+
+	switch {
+	case size < 29:
+	case off+uint(size-28) > uint(len(d.buf)):
+		return 0, 0, 0, ErrInvalidDatabase
+	case size == 29:
+		size = 29 + uint(d.buf[off])
+		off++
+	case size == 30:
+		size = 285 + uint(d.uint(off, 2))
+		off += 2
+	default:
+		size = 65821 + uint(d.uint(off, 3))
+		off += 3
+	}
+	return typ, size, off, nil
+}
+
+// pointer decodes a pointer whose control byte had the low bits ctrl.
+func (d decoder) pointer(ctrl uint, off uint) (ptr uint, next uint, err error) {
+	n := (ctrl>>3)&0x3 + 1
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, ErrInvalidDatabase
+	}
+
+	v := uint(d.uint(off, n))
+	switch n {
+	case 1:
+		ptr = (ctrl&0x7)<<8 | v
+	case 2:
+		ptr = ((ctrl&0x7)<<16 | v) + 2048
+	case 3:
+		ptr = ((ctrl&0x7)<<24 | v) + 526336
+	default:
+		ptr = v
+	}
+	return ptr, off + n, nil
+}
+
+func (d decoder) uint(off uint, size uint) uint64 {
+	var v uint64
+	for _, b := range d.buf[off : off+size] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
@@ -0,0 +1,66 @@
+package geoip
+
+import (
+	"net"
+	"testing"
+
+	"github.com/FTwOoO/go-ss/dialer/geoip/geoiptest"
+)
+
+var testNetworks = map[string]string{
+	"1.0.1.0/24":     "CN",
+	"8.8.8.0/24":     "US",
+	"114.114.0.0/16": "CN",
+	"2001:da8::/32":  "CN",
+	"2001:4860::/32": "US",
+}
+
+func TestReaderCountry(t *testing.T) {
+	for _, size := range []uint{24, 28, 32} {
+		b, err := geoiptest.Build(testNetworks, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := FromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Metadata.RecordSize != size || r.Metadata.IPVersion != 6 || r.Metadata.DatabaseType != "Test-Country" {
+			t.Fatalf("unexpected metadata %+v", r.Metadata)
+		}
+
+		for ip, country := range map[string]string{
+			"1.0.1.1":         "CN",
+			"1.0.2.1":         "",
+			"8.8.8.8":         "US",
+			"114.114.114.114": "CN",
+			"2001:da8::1":     "CN",
+			"2001:4860::8888": "US",
+			"2400::1":         "",
+		} {
+			c, err := r.Country(net.ParseIP(ip))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c != country {
+				t.Errorf("record size %d: %s is in %q, want %q", size, ip, c, country)
+			}
+		}
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	b, err := geoiptest.Build(testNetworks, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FromBytes(b[len(b)/2:]); err == nil {
+		t.Fatal("expected an error for a truncated database")
+	}
+}
@@ -0,0 +1,16 @@
+package outbound
+
+import "syscall"
+
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.BindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
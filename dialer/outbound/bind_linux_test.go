@@ -0,0 +1,45 @@
+package outbound
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterface(t *testing.T) {
+	l, from := acceptor(t)
+	defer l.Close()
+
+	d := &Dialer{Source: Source{Interface: "lo"}}
+	c, err := d.ForClient(nil)("tcp", l.Addr().String(), "", time.Second)
+	if err != nil {
+		if errno, ok := unwrapErrno(err); ok && errno == syscall.EPERM {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	c.Close()
+	<-from
+
+	d.Interface = "no-such-interface0"
+	if _, err := d.ForClient(nil)("tcp", l.Addr().String(), "", time.Second); err == nil {
+		t.Fatal("bound to a missing interface")
+	}
+}
+
+func unwrapErrno(err error) (syscall.Errno, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case syscall.Errno:
+			return e, true
+		case *net.OpError:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package outbound
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errBindNotSupported = errors.New("binding to an interface is only supported on linux")
+
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errBindNotSupported
+	}
+}
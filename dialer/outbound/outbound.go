@@ -0,0 +1,284 @@
+// Package outbound connects a server to the targets its clients ask for: from
+// chosen source addresses or an interface, per client, preferring an address
+// family, and through an upstream proxy for the targets its rules pick.
+package outbound
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/dialer/rule"
+)
+
+type Family int
+
+const (
+	AnyFamily  Family = iota // addresses in the order the resolver returns them
+	PreferIPv4               // IPv4 addresses first
+	PreferIPv6               // IPv6 addresses first
+	IPv4Only
+	IPv6Only
+)
+
+var familyNames = map[string]Family{
+	"any":         AnyFamily,
+	"prefer-ipv4": PreferIPv4,
+	"prefer-ipv6": PreferIPv6,
+	"ipv4":        IPv4Only,
+	"ipv6":        IPv6Only,
+}
+
+func ParseFamily(s string) (Family, error) {
+	if s == "" {
+		return AnyFamily, nil
+	}
+	f, ok := familyNames[strings.ToLower(s)]
+	if !ok {
+		return AnyFamily, fmt.Errorf("unknown address family %q", s)
+	}
+	return f, nil
+}
+
+func (f Family) String() string {
+	for name, v := range familyNames {
+		if v == f {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Source is where connections leave the server from.
+type Source struct {
+	IPs       []net.IP // the first one of the family of the target is used
+	Interface string   // network device to bind to, linux only
+}
+
+// ip returns the source address for a connection to target, nil for any.
+func (s *Source) ip(target net.IP) (net.IP, error) {
+	if len(s.IPs) == 0 {
+		return nil, nil
+	}
+	is4 := target.To4() != nil
+	for _, ip := range s.IPs {
+		if (ip.To4() != nil) == is4 {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no source address for %s", target)
+}
+
+func (s *Source) has4and6() (has4 bool, has6 bool) {
+	if len(s.IPs) == 0 {
+		return true, true
+	}
+	for _, ip := range s.IPs {
+		if ip.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+	return
+}
+
+// User gives the clients connecting from Clients their own Source. The server
+// has no accounts, so a user is known by the address it connects from.
+type User struct {
+	Clients *net.IPNet
+	Source
+}
+
+var ErrFamily = errors.New("address family not allowed")
+
+// Dialer implements dialer.Outbound. Its zero value dials like net.Dial.
+//
+// Targets Rules matches as rule.Proxy go through Upstream, or all targets if
+// Rules is nil. Upstream is given the address the server resolved and checked,
+// not the domain. Targets matched as rule.Block are refused.
+type Dialer struct {
+	Source
+	Family   Family
+	Users    []User // the first one with the client wins, Source if none
+	Rules    rule.Matcher
+	Upstream dialer.DialFunc
+}
+
+var _ dialer.Outbound = &Dialer{}
+
+// LookupIP resolves host to the addresses the clients may be connected to,
+// in the order of Family.
+func (d *Dialer) LookupIP(host string) ([]net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if ips = d.order(ips); len(ips) == 0 {
+		return nil, fmt.Errorf("no %s address for %s", d.Family, host)
+	}
+	return ips, nil
+}
+
+// order drops the addresses no source can reach and sorts the others.
+func (d *Dialer) order(ips []net.IP) []net.IP {
+	has4, has6 := d.Source.has4and6()
+	for _, u := range d.Users {
+		u4, u6 := u.has4and6()
+		has4, has6 = has4 || u4, has6 || u6
+	}
+
+	var ip4, ip6, all []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if !has4 || d.Family == IPv6Only {
+				continue
+			}
+			ip4 = append(ip4, ip)
+		} else {
+			if !has6 || d.Family == IPv4Only {
+				continue
+			}
+			ip6 = append(ip6, ip)
+		}
+		all = append(all, ip)
+	}
+
+	switch d.Family {
+	case PreferIPv4:
+		return append(ip4, ip6...)
+	case PreferIPv6:
+		return append(ip6, ip4...)
+	}
+	return all
+}
+
+// ForClient picks the Source of the user client is, and routes by Rules.
+func (d *Dialer) ForClient(client net.Addr) dialer.HostDialFunc {
+	src := d.source(client)
+	direct := func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		return d.dialFrom(src, network, addr, timeout)
+	}
+
+	if d.Upstream == nil {
+		return func(network, addr, host string, timeout time.Duration) (net.Conn, error) {
+			return direct(network, addr, timeout)
+		}
+	}
+	if d.Rules == nil {
+		return func(network, addr, host string, timeout time.Duration) (net.Conn, error) {
+			return d.Upstream(network, addr, timeout)
+		}
+	}
+
+	r := &rule.Router{Rules: d.Rules, Proxy: d.Upstream, Direct: direct, Fallback: direct}
+	return r.DialHost
+}
+
+func (d *Dialer) source(client net.Addr) *Source {
+	if a, ok := client.(*net.TCPAddr); ok {
+		for i := range d.Users {
+			if d.Users[i].Clients.Contains(a.IP) {
+				return &d.Users[i].Source
+			}
+		}
+	}
+	return &d.Source
+}
+
+func (d *Dialer) dialFrom(src *Source, network, addr string, timeout time.Duration) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("outbound: %s is not an IP address", host)
+	}
+
+	is4 := ip.To4() != nil
+	if (is4 && d.Family == IPv6Only) || (!is4 && d.Family == IPv4Only) {
+		return nil, ErrFamily
+	}
+	if is4 {
+		network = "tcp4"
+	} else {
+		network = "tcp6"
+	}
+
+	nd := &net.Dialer{Timeout: timeout}
+	localIP, err := src.ip(ip)
+	if err != nil {
+		return nil, err
+	}
+	if localIP != nil {
+		nd.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	if src.Interface != "" {
+		nd.Control = bindToDevice(src.Interface)
+	}
+	return nd.Dial(network, addr)
+}
+
+// ParseIPs parses a comma separated list of addresses.
+func ParseIPs(list string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// ParseUsers parses a comma separated list of <clients>=<source>, where
+// clients is a CIDR or an address and source is addresses joined by '+' or
+// the name of an interface, e.g. "10.8.0.0/16=203.0.113.5+2001:db8::5".
+func ParseUsers(list string) ([]User, error) {
+	var users []User
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("missing source in %q", s)
+		}
+		clients, source := strings.TrimSpace(s[:eq]), strings.TrimSpace(s[eq+1:])
+
+		var u User
+		if !strings.Contains(clients, "/") {
+			if strings.Contains(clients, ":") {
+				clients += "/128"
+			} else {
+				clients += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(clients)
+		if err != nil {
+			return nil, err
+		}
+		u.Clients = n
+
+		if source == "" {
+			return nil, fmt.Errorf("missing source in %q", s)
+		}
+		if net.ParseIP(strings.Split(source, "+")[0]) == nil {
+			u.Interface = source
+		} else if u.IPs, err = ParseIPs(strings.Replace(source, "+", ",", -1)); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
@@ -0,0 +1,183 @@
+package outbound
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer/rule"
+)
+
+// acceptor reports the remote address of each connection it accepts.
+func acceptor(t *testing.T) (net.Listener, <-chan net.Addr) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := make(chan net.Addr, 8)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			from <- c.RemoteAddr()
+			c.Close()
+		}
+	}()
+	return l, from
+}
+
+func dialFrom(t *testing.T, d *Dialer, client net.Addr, addr string, from <-chan net.Addr) net.IP {
+	c, err := d.ForClient(client)("tcp", addr, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	return (<-from).(*net.TCPAddr).IP
+}
+
+func TestSource(t *testing.T) {
+	l, from := acceptor(t)
+	defer l.Close()
+
+	users, err := ParseUsers("192.0.2.0/24=127.0.0.3, 198.51.100.7=127.0.0.4+::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Dialer{Source: Source{IPs: []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.2")}}, Users: users}
+
+	for client, want := range map[string]string{
+		"203.0.113.1":  "127.0.0.2",
+		"192.0.2.9":    "127.0.0.3",
+		"198.51.100.7": "127.0.0.4",
+	} {
+		got := dialFrom(t, d, &net.TCPAddr{IP: net.ParseIP(client), Port: 1234}, l.Addr().String(), from)
+		if !got.Equal(net.ParseIP(want)) {
+			t.Errorf("client %s: connected from %s, want %s", client, got, want)
+		}
+	}
+
+	d = &Dialer{Source: Source{IPs: []net.IP{net.ParseIP("::1")}}}
+	if _, err := d.ForClient(nil)("tcp", l.Addr().String(), "", time.Second); err == nil {
+		t.Fatal("IPv4 target dialed without an IPv4 source")
+	}
+}
+
+func TestFamily(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::2"), net.ParseIP("192.0.2.2")}
+	for family, want := range map[string][]string{
+		"":            {"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"},
+		"prefer-ipv4": {"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"},
+		"prefer-ipv6": {"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"},
+		"ipv4":        {"192.0.2.1", "192.0.2.2"},
+		"ipv6":        {"2001:db8::1", "2001:db8::2"},
+	} {
+		f, err := ParseFamily(family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &Dialer{Family: f}
+		if got := ipStrings(d.order(ips)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", family, got, want)
+		}
+	}
+
+	// no IPv6 source, whatever the preference
+	d := &Dialer{Family: PreferIPv6, Source: Source{IPs: []net.IP{net.ParseIP("192.0.2.100")}}}
+	if got := ipStrings(d.order(ips)); !reflect.DeepEqual(got, []string{"192.0.2.1", "192.0.2.2"}) {
+		t.Errorf("got %v", got)
+	}
+
+	d = &Dialer{Family: IPv6Only}
+	if _, err := d.ForClient(nil)("tcp", "127.0.0.1:80", "", time.Second); err != ErrFamily {
+		t.Fatalf("got %v", err)
+	}
+
+	if _, err := ParseFamily("ipv5"); err == nil {
+		t.Fatal("ipv5 parsed")
+	}
+}
+
+func ipStrings(ips []net.IP) []string {
+	var s []string
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+type hostRule string
+
+func (h hostRule) Match(t *rule.Target) rule.Action {
+	switch t.Host {
+	case string(h):
+		return rule.Proxy
+	case "blocked.example.com":
+		return rule.Block
+	}
+	return rule.Unknown
+}
+
+func TestUpstream(t *testing.T) {
+	l, from := acceptor(t)
+	defer l.Close()
+
+	errUpstream := errors.New("upstream")
+	var upstream []string
+	d := &Dialer{
+		Rules: hostRule("via.example.com"),
+		Upstream: func(network, addr string, timeout time.Duration) (net.Conn, error) {
+			upstream = append(upstream, addr)
+			return nil, errUpstream
+		},
+	}
+
+	dial := d.ForClient(nil)
+	if _, err := dial("tcp", l.Addr().String(), "via.example.com", time.Second); err != errUpstream {
+		t.Fatalf("got %v", err)
+	}
+	if len(upstream) != 1 || upstream[0] != l.Addr().String() {
+		t.Fatalf("upstream got %v", upstream)
+	}
+
+	c, err := dial("tcp", l.Addr().String(), "direct.example.com", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	<-from
+
+	if _, err := dial("tcp", l.Addr().String(), "blocked.example.com", time.Second); err != rule.ErrBlocked {
+		t.Fatalf("got %v", err)
+	}
+
+	d.Rules = nil
+	if _, err := d.ForClient(nil)("tcp", l.Addr().String(), "direct.example.com", time.Second); err != errUpstream {
+		t.Fatalf("without rules: got %v", err)
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	users, err := ParseUsers("10.8.0.0/16=eth1, 2001:db8::7=2001:db8:1::1+203.0.113.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("got %v", users)
+	}
+	if users[0].Clients.String() != "10.8.0.0/16" || users[0].Interface != "eth1" || users[0].IPs != nil {
+		t.Errorf("got %+v", users[0])
+	}
+	if users[1].Clients.String() != "2001:db8::7/128" || len(users[1].IPs) != 2 || users[1].Interface != "" {
+		t.Errorf("got %+v", users[1])
+	}
+
+	for _, s := range []string{"10.0.0.0/8", "10.0.0.0/33=1.2.3.4", "10.0.0.1=1.2.3.4+x", "10.0.0.1="} {
+		if _, err := ParseUsers(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/socks"
+)
+
+var _ dialer.ClientProtocol = &SocksProxy{}
+var _ dialer.ClientProtocol = &HTTPProxy{}
+var _ dialer.ClientProtocol = &EnvironmentProxy{}
+
+// SocksProxy connects through a SOCKS5 proxy.
+type SocksProxy struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func (p *SocksProxy) ClientWrapDial(transportDial dialer.DialFunc) dialer.DialFunc {
+	return func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		tgt := socks.ParseAddr(addr)
+		if tgt == nil {
+			return nil, fmt.Errorf("invalid address %s", addr)
+		}
+
+		c, err := transportDial("tcp", p.Addr, timeout)
+		if err != nil {
+			log.Printf("failed to connect to socks proxy %v: %v", p.Addr, err)
+			return nil, err
+		}
+
+		if timeout > 0 {
+			c.SetDeadline(time.Now().Add(timeout))
+		}
+		if err := socks.ClientHandshake(c, tgt, p.Username, p.Password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("socks proxy %s: %v", p.Addr, err)
+		}
+		c.SetDeadline(time.Time{})
+		return c, nil
+	}
+}
+
+// HTTPProxy connects through an HTTP proxy with the CONNECT method.
+type HTTPProxy struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func (p *HTTPProxy) ClientWrapDial(transportDial dialer.DialFunc) dialer.DialFunc {
+	return func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		c, err := transportDial("tcp", p.Addr, timeout)
+		if err != nil {
+			log.Printf("failed to connect to http proxy %v: %v", p.Addr, err)
+			return nil, err
+		}
+
+		if timeout > 0 {
+			c.SetDeadline(time.Now().Add(timeout))
+		}
+		br, err := p.connect(c, addr)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("http proxy %s: %v", p.Addr, err)
+		}
+		c.SetDeadline(time.Time{})
+
+		if br.Buffered() > 0 {
+			// the target spoke first and its bytes came with the response
+			b, _ := br.Peek(br.Buffered())
+			return &prefixedConn{Conn: c, r: io.MultiReader(bytes.NewReader(b), c)}, nil
+		}
+		return c, nil
+	}
+}
+
+func (p *HTTPProxy) connect(c net.Conn, addr string) (*bufio.Reader, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if p.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	return br, nil
+}
+
+// prefixedConn reads from r, which ends with the conn itself.
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ParseProxyURL parses socks5://[user:pass@]host:port (or socks5h://, the
+// domain is always sent to the proxy) and http://[user:pass@]host:port.
+func ParseProxyURL(s string) (dialer.ClientProtocol, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %s: no port", s)
+	}
+
+	password, _ := u.User.Password()
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &SocksProxy{Addr: u.Host, Username: u.User.Username(), Password: password}, nil
+	case "http":
+		return &HTTPProxy{Addr: u.Host, Username: u.User.Username(), Password: password}, nil
+	}
+	return nil, fmt.Errorf("proxy %s: unsupported scheme %q", s, u.Scheme)
+}
+
+// EnvironmentProxy connects through the proxy set in ALL_PROXY, HTTPS_PROXY
+// or HTTP_PROXY (the first one set, upper or lower case), except to the
+// addresses NO_PROXY matches.
+type EnvironmentProxy struct {
+	Proxy   dialer.ClientProtocol
+	NoProxy []string // "*", domains with their subdomains, IPs or CIDRs, each maybe with ":port"
+}
+
+// ProxyFromEnvironment returns nil if no proxy is set.
+func ProxyFromEnvironment() (*EnvironmentProxy, error) {
+	var s string
+	for _, name := range []string{"ALL_PROXY", "HTTPS_PROXY", "HTTP_PROXY"} {
+		if s = getenv(name); s != "" {
+			break
+		}
+	}
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+
+	proxy, err := ParseProxyURL(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &EnvironmentProxy{Proxy: proxy}
+	for _, h := range strings.Split(getenv("NO_PROXY"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			p.NoProxy = append(p.NoProxy, h)
+		}
+	}
+	return p, nil
+}
+
+func getenv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+func (p *EnvironmentProxy) ClientWrapDial(transportDial dialer.DialFunc) dialer.DialFunc {
+	proxyDial := p.Proxy.ClientWrapDial(transportDial)
+	return func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		if p.bypass(addr) {
+			return transportDial(network, addr, timeout)
+		}
+		return proxyDial(network, addr, timeout)
+	}
+}
+
+func (p *EnvironmentProxy) bypass(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, np := range p.NoProxy {
+		if np == "*" {
+			return true
+		}
+
+		h, pt := np, ""
+		if hh, pp, err := net.SplitHostPort(np); err == nil {
+			h, pt = hh, pp
+		}
+		if pt != "" && pt != port {
+			continue
+		}
+
+		if _, n, err := net.ParseCIDR(h); err == nil {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if npIP := net.ParseIP(h); npIP != nil {
+			if ip != nil && npIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		h = strings.TrimPrefix(strings.TrimPrefix(h, "*"), ".")
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/FTwOoO/go-ss/socks"
+)
+
+// socksAuthServer is a SOCKS5 server that only accepts user:pass.
+func socksAuthServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 512)
+				if _, err := io.ReadFull(c, b[:2]); err != nil {
+					return
+				}
+				io.ReadFull(c, b[:b[1]])
+				c.Write([]byte{5, socks.MethodUserPass})
+
+				io.ReadFull(c, b[:2])
+				user := make([]byte, b[1])
+				io.ReadFull(c, user)
+				io.ReadFull(c, b[:1])
+				pass := make([]byte, b[0])
+				io.ReadFull(c, pass)
+				if string(user) != "user" || string(pass) != "pass" {
+					c.Write([]byte{1, 1})
+					return
+				}
+				c.Write([]byte{1, 0})
+
+				io.ReadFull(c, b[:3])
+				tgt, err := socks.ReadAddr(c)
+				if err != nil {
+					return
+				}
+				rc, err := net.Dial("tcp", tgt.String())
+				if err != nil {
+					c.Write([]byte{5, byte(socks.ErrConnectionRefused), 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer rc.Close()
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				relay(c, rc)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestSocksProxyAuth(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	proxy := socksAuthServer(t)
+	defer proxy.Close()
+
+	p, err := ParseProxyURL("socks5://user:pass@" + proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainRoundTrip(t, p.ClientWrapDial(net.DialTimeout), target.Addr().String())
+
+	wrong := &SocksProxy{Addr: proxy.Addr().String(), Username: "user", Password: "wrong"}
+	if _, err := wrong.ClientWrapDial(net.DialTimeout)("tcp", target.Addr().String(), time.Second); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+
+	// a target that refuses
+	closed := freeAddr(t)
+	if _, err := p.ClientWrapDial(net.DialTimeout)("tcp", closed, time.Second); err == nil {
+		t.Fatal("expected the error from the proxy")
+	}
+}
+
+func TestParseProxyURL(t *testing.T) {
+	for s, want := range map[string]interface{}{
+		"socks5://127.0.0.1:1080":        &SocksProxy{Addr: "127.0.0.1:1080"},
+		"socks5h://u:p@proxy:1080":       &SocksProxy{Addr: "proxy:1080", Username: "u", Password: "p"},
+		"http://u:p%40ss@[::1]:3128":     &HTTPProxy{Addr: "[::1]:3128", Username: "u", Password: "p@ss"},
+		"http://proxy.example.com:8080/": &HTTPProxy{Addr: "proxy.example.com:8080"},
+	} {
+		p, err := ParseProxyURL(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		switch w := want.(type) {
+		case *SocksProxy:
+			if got, ok := p.(*SocksProxy); !ok || *got != *w {
+				t.Errorf("%s: got %+v", s, p)
+			}
+		case *HTTPProxy:
+			if got, ok := p.(*HTTPProxy); !ok || *got != *w {
+				t.Errorf("%s: got %+v", s, p)
+			}
+		}
+	}
+
+	for _, s := range []string{"https://proxy:443", "socks5://proxy", "ftp://proxy:21"} {
+		if _, err := ParseProxyURL(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+func setenv(t *testing.T, env map[string]string) func() {
+	old := make(map[string]string)
+	for _, name := range []string{"ALL_PROXY", "HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY", "all_proxy", "https_proxy", "http_proxy", "no_proxy"} {
+		old[name] = os.Getenv(name)
+		os.Setenv(name, env[name])
+	}
+	return func() {
+		for name, v := range old {
+			os.Setenv(name, v)
+		}
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	defer setenv(t, nil)()
+	if p, err := ProxyFromEnvironment(); p != nil || err != nil {
+		t.Fatalf("got %v, %v with no proxy set", p, err)
+	}
+
+	setenv(t, map[string]string{
+		"https_proxy": "proxy.corp:3128",
+		"HTTP_PROXY":  "http://other:3128",
+		"no_proxy":    "localhost, .corp.example.com,10.0.0.0/8, 192.168.1.1, vps.example.net:8388",
+	})
+	p, err := ProxyFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hp, ok := p.Proxy.(*HTTPProxy); !ok || hp.Addr != "proxy.corp:3128" {
+		t.Fatalf("got %+v", p.Proxy)
+	}
+
+	for addr, want := range map[string]bool{
+		"localhost:8388":              true,
+		"corp.example.com:443":        true,
+		"a.corp.example.com:443":      true,
+		"example.com:443":             false,
+		"10.1.2.3:8388":               true,
+		"192.168.1.1:8388":            true,
+		"192.168.1.2:8388":            false,
+		"vps.example.net:8388":        true,
+		"vps.example.net:443":         false,
+		"notcorp.example.com.evil:80": false,
+	} {
+		if got := p.bypass(addr); got != want {
+			t.Errorf("%s: bypass %v, want %v", addr, got, want)
+		}
+	}
+
+	setenv(t, map[string]string{"ALL_PROXY": "socks5://127.0.0.1:1080", "HTTPS_PROXY": "http://proxy:3128", "NO_PROXY": "*"})
+	p, err = ProxyFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Proxy.(*SocksProxy); !ok || !p.bypass("example.com:80") {
+		t.Fatalf("got %+v", p)
+	}
+}
+
+func TestEnvironmentProxyDial(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	proxy := socksAuthServer(t)
+	defer proxy.Close()
+
+	var dialed []string
+	transport := func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return net.DialTimeout(network, addr, timeout)
+	}
+
+	p := &EnvironmentProxy{Proxy: &SocksProxy{Addr: proxy.Addr().String(), Username: "user", Password: "pass"}}
+	chainRoundTrip(t, p.ClientWrapDial(transport), target.Addr().String())
+	if len(dialed) != 1 || dialed[0] != proxy.Addr().String() {
+		t.Fatalf("dialed %v", dialed)
+	}
+
+	dialed = nil
+	p.NoProxy = []string{"127.0.0.1"}
+	chainRoundTrip(t, p.ClientWrapDial(transport), target.Addr().String())
+	if len(dialed) != 1 || dialed[0] != target.Addr().String() {
+		t.Fatalf("dialed %v", dialed)
+	}
+}
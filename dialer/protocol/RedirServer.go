@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/dialer/fakedns"
+)
+
+// RedirConfig accepts connections redirected by the firewall (iptables
+// REDIRECT, or TPROXY with TProxy set) and proxies them to their original
+// destination. Destinations in the FakeDNS pool are sent by domain name.
+type RedirConfig struct {
+	Addr    string
+	Dial    dialer.DialFunc
+	TProxy  bool
+	FakeDNS *fakedns.Pool
+}
+
+func (s *RedirConfig) Serve(ctx context.Context) (listenAddr string, err error) {
+	l, err := listenRedir(s.Addr, s.TProxy)
+	if err != nil {
+		log.Printf("failed to listen: %v", err)
+		return
+	}
+
+	listenAddr = l.Addr().String()
+	log.Printf("REDIR PROXY: %s", listenAddr)
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				log.Printf("failed to accept: %s", err)
+				continue
+			}
+
+			go s.handleConnection(c)
+		}
+	}()
+
+	return
+}
+
+func (s *RedirConfig) handleConnection(c net.Conn) {
+	defer c.Close()
+	c.(*net.TCPConn).SetKeepAlive(true)
+
+	var tgt net.Addr
+	var err error
+	if s.TProxy {
+		tgt = c.LocalAddr()
+	} else {
+		tgt, err = originalDst(c.(*net.TCPConn))
+		if err != nil {
+			log.Printf("failed to get original destination: %v", err)
+			return
+		}
+	}
+
+	addr := tgt.String()
+	if s.FakeDNS != nil {
+		addr = s.FakeDNS.ResolveAddr(addr)
+	}
+
+	rc, err := s.Dial("tcp", addr, 3*time.Second)
+	if err != nil {
+		log.Printf("failed to connect to server %v: %v", addr, err)
+		return
+	}
+	defer rc.Close()
+
+	_, _, err = relay(rc, c)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return // ignore i/o timeout
+		}
+		log.Printf("relay error: %v", err)
+	}
+}
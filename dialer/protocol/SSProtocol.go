@@ -1,11 +1,16 @@
 package protocol
 
 import (
+	"errors"
 	"github.com/FTwOoO/go-ss/dialer"
 	"github.com/FTwOoO/go-ss/dialer/connection"
+	"github.com/FTwOoO/go-ss/dialer/resolve"
+	"github.com/FTwOoO/go-ss/dialer/rule"
 	"github.com/FTwOoO/go-ss/socks"
+	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"context"
@@ -14,12 +19,39 @@ import (
 var _ dialer.ProxyProtocol = &SSProxyPrococol{}
 
 type SSProxyPrococol struct {
-	Cipher     string
-	Password   string
-	ListenAddr string
-	ServerAddr string //client only
+	Cipher      string
+	Password    string
+	ListenAddr  string
+	ServerAddr  string            //client only
+	Resolver    *resolve.Resolver //client only, hosts and local resolution before the target is sent
+	ACL         *rule.ACL         //server only, refuses clients and outbound targets
+	Outbound    rule.Matcher      //server only, refuses targets it matches as rule.Block, &rule.Outbound{} if nil
+	DialTimeout time.Duration     //server only, to connect to a target, DefaultDialTimeout if 0
+
+	// client: carry the connections as streams over a few server
+	// connections, server: take such streams too, off if nil
+	Mux *connection.MuxConfig
+
+	// client: keep connections to ServerAddr dialed ahead, the salt and
+	// target are only sent once one is used, off if nil or with Mux
+	Pool *connection.PoolConfig
+	// server: how long a connection may take to send its target, a client
+	// Pool keeps its connections for less, DefaultTargetTimeout if 0
+	TargetTimeout time.Duration
+
+	lock  sync.Mutex
+	pools []io.Closer // made by ClientWrapDial, see Close
 }
 
+const (
+	DefaultTargetTimeout = 5 * time.Second
+	DefaultDialTimeout   = 10 * time.Second
+)
+
+// defaultOutbound keeps clients out of loopback, private and link-local
+// networks unless the server is configured otherwise.
+var defaultOutbound = &rule.Outbound{}
+
 func (s *SSProxyPrococol) serverWrapConn(conn net.Conn) dialer.ForwardConnection {
 
 	return dialer.MakeConnection(conn,
@@ -38,8 +70,18 @@ func (s *SSProxyPrococol) ServerListen(
 	listenFunc func(net, laddr string) (net.Listener, error),
 	handler func(dialer.ForwardConnection),
 	ctx context.Context,
+	opts ...dialer.ServerOption,
 ) (err error) {
 
+	var o dialer.ServerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	outbound := o.Outbound
+	if outbound == nil {
+		outbound = directOutbound{}
+	}
+
 	l, err := listenFunc("tcp", addr)
 	if err != nil {
 		log.Printf("failed to listen on %s: %v", addr, err)
@@ -63,9 +105,17 @@ func (s *SSProxyPrococol) ServerListen(
 					c1.SetKeepAlive(true)
 				}
 
+				if !s.allowClient(c.RemoteAddr()) {
+					log.Printf("client %s refused by acl", c.RemoteAddr())
+					c.Close()
+					continue
+				}
+
 				c2 := s.serverWrapConn(c)
 				if handler == nil {
-					handler = forwardConnection
+					handler = func(c dialer.ForwardConnection) {
+						s.forwardConnection(c, outbound)
+					}
 				}
 				go handler(c2)
 			}
@@ -76,10 +126,49 @@ func (s *SSProxyPrococol) ServerListen(
 }
 
 func (s *SSProxyPrococol) ClientWrapDial(transportDial dialer.DialFunc) dialer.DialFunc {
+	var pool *connection.MuxPool
+	if s.Mux != nil {
+		pool = &connection.MuxPool{Config: s.Mux, Dial: s.muxDial(transportDial)}
+	}
+	serverDial := func(timeout time.Duration) (net.Conn, error) {
+		return transportDial("tcp", s.ServerAddr, timeout)
+	}
+	if pool == nil && s.Pool != nil {
+		p := &connection.Pool{Config: s.Pool, Dial: serverDial}
+		serverDial = p.Get
+		s.keep(p)
+	}
+	if pool != nil {
+		s.keep(pool)
+	}
 
 	return func(network, addr string, timeout time.Duration) (conn net.Conn, err error) {
 
-		rc, err := transportDial("tcp", s.ServerAddr, timeout)
+		if s.Resolver != nil {
+			a, err := s.Resolver.ResolveAddr(addr)
+			if err != nil {
+				log.Printf("failed to resolve %s: %v", addr, err)
+				return nil, err
+			}
+			addr = a
+		}
+
+		tgt := socks.ParseAddr(addr)
+		if tgt == nil {
+			log.Printf("Invalid address: %s", addr)
+			return nil, errors.New("invalid address " + addr)
+		}
+
+		if pool != nil {
+			stream, err := pool.Open(tgt, timeout)
+			if err != nil {
+				log.Printf("failed to open a stream to %s: %v", addr, err)
+				return nil, err
+			}
+			return stream, nil
+		}
+
+		rc, err := serverDial(timeout)
 		if err != nil {
 			log.Printf("failed to connect to server %v: %v", s.ServerAddr, err)
 			return
@@ -88,13 +177,6 @@ func (s *SSProxyPrococol) ClientWrapDial(transportDial dialer.DialFunc) dialer.D
 			rc2.SetKeepAlive(true)
 		}
 
-		tgt := socks.ParseAddr(addr)
-
-		if tgt == nil {
-			log.Printf("Invalid address: %s %v", addr, err)
-			return
-		}
-
 		conn = dialer.MakeConnection(rc,
 			[]dialer.CommonConnection{
 				&connection.CipherConn{},
@@ -108,20 +190,181 @@ func (s *SSProxyPrococol) ClientWrapDial(transportDial dialer.DialFunc) dialer.D
 	}
 }
 
-func forwardConnection(c dialer.ForwardConnection) {
+// Close closes the connections the dial funcs of ClientWrapDial keep to the
+// server, and with Mux the streams on them. Those dial funcs fail from then
+// on, the connections they returned without Mux are left alone.
+func (s *SSProxyPrococol) Close() error {
+	s.lock.Lock()
+	pools := s.pools
+	s.pools = nil
+	s.lock.Unlock()
+
+	for _, p := range pools {
+		p.Close()
+	}
+	return nil
+}
+
+func (s *SSProxyPrococol) keep(pool io.Closer) {
+	s.lock.Lock()
+	s.pools = append(s.pools, pool)
+	s.lock.Unlock()
+}
+
+// muxDial connects to the server for a MuxConn, with MuxTarget as target.
+func (s *SSProxyPrococol) muxDial(transportDial dialer.DialFunc) func(time.Duration) (*connection.MuxConn, error) {
+	return func(timeout time.Duration) (*connection.MuxConn, error) {
+		rc, err := transportDial("tcp", s.ServerAddr, timeout)
+		if err != nil {
+			log.Printf("failed to connect to server %v: %v", s.ServerAddr, err)
+			return nil, err
+		}
+		if rc2, ok := rc.(*net.TCPConn); ok {
+			rc2.SetKeepAlive(true)
+		}
+
+		return dialer.MakeConnection(rc,
+			[]dialer.CommonConnection{
+				&connection.CipherConn{},
+				&connection.ShadowsocksRawConn{},
+				&connection.MuxConn{},
+			},
+			[]interface{}{
+				connection.CipherConnParams{Cipher: s.Cipher, Password: s.Password},
+				connection.ShadowsocksRawConnParams{Target: connection.MuxTarget},
+				connection.MuxConnParams{Config: s.Mux},
+			}).(*connection.MuxConn), nil
+	}
+}
+
+// serveMux forwards the streams of the MuxConn a client started on c.
+func (s *SSProxyPrococol) serveMux(c net.Conn, outbound dialer.Outbound) {
+	m := dialer.MakeConnection(c,
+		[]dialer.CommonConnection{&connection.MuxConn{}},
+		[]interface{}{connection.MuxConnParams{IsServer: true, Config: s.Mux}},
+	).(*connection.MuxConn)
+	defer m.Close()
+
+	for {
+		stream, err := m.Accept()
+		if err != nil {
+			return
+		}
+		s.forwardConnection(stream, outbound)
+	}
+}
+
+func (s *SSProxyPrococol) allowClient(addr net.Addr) bool {
+	if s.ACL == nil {
+		return true
+	}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return s.ACL.AllowClient(a.IP)
+	}
+	return true
+}
+
+func (s *SSProxyPrococol) blockOutbound(t *rule.Target) bool {
+	if s.ACL != nil && s.ACL.BlockOutbound(t) {
+		return true
+	}
+	outbound := s.Outbound
+	if outbound == nil {
+		outbound = defaultOutbound
+	}
+	return outbound.Match(t) == rule.Block
+}
+
+// dialOutbound connects to t. A domain is resolved here and each address
+// checked before it is dialed, so that a domain resolving to a private
+// address, maybe only on the second lookup, cannot get through.
+func (s *SSProxyPrococol) dialOutbound(t *rule.Target, client net.Addr, outbound dialer.Outbound) (net.Conn, error) {
+	dial := outbound.ForClient(client)
+	if t.IP != nil {
+		return dial("tcp", t.String(), "", s.dialTimeout())
+	}
+
+	ips, err := outbound.LookupIP(t.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = errOutboundBlocked
+	for _, ip := range ips {
+		a := &rule.Target{Host: ip.String(), Port: t.Port, IP: ip}
+		if s.blockOutbound(a) {
+			log.Printf("outbound %s (%s) from client %s blocked", t, ip, client)
+			continue
+		}
+
+		var rc net.Conn
+		rc, err = dial("tcp", a.String(), t.Host, s.dialTimeout())
+		if err == nil {
+			return rc, nil
+		}
+	}
+	return nil, err
+}
+
+var errOutboundBlocked = errors.New("all addresses of the target are blocked")
+
+// directOutbound is the Outbound of a server given none.
+type directOutbound struct{}
+
+func (directOutbound) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+func (directOutbound) ForClient(client net.Addr) dialer.HostDialFunc {
+	return func(network, addr, host string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, addr, timeout)
+	}
+}
+
+func (s *SSProxyPrococol) dialTimeout() time.Duration {
+	if s.DialTimeout > 0 {
+		return s.DialTimeout
+	}
+	return DefaultDialTimeout
+}
+
+func (s *SSProxyPrococol) targetTimeout() time.Duration {
+	if s.TargetTimeout > 0 {
+		return s.TargetTimeout
+	}
+	return DefaultTargetTimeout
+}
+
+func (s *SSProxyPrococol) forwardConnection(c dialer.ForwardConnection, outbound dialer.Outbound) {
 
 	go func() {
 		select {
 		case tgt := <-c.(dialer.ForwardConnection).ForwardReady():
 			defer c.Close()
 
-			rc, err := net.Dial("tcp", tgt.String())
+			if connection.IsMuxTarget(tgt) {
+				if s.Mux == nil {
+					log.Printf("mux from client %s refused, not enabled", c.RemoteAddr())
+					return
+				}
+				s.serveMux(c, outbound)
+				return
+			}
+
+			t, err := rule.ParseTarget(tgt.String())
+			if err != nil || s.blockOutbound(t) {
+				log.Printf("outbound %s from client %s blocked", tgt.String(), c.RemoteAddr())
+				return
+			}
+
+			rc, err := s.dialOutbound(t, c.RemoteAddr(), outbound)
 			if err != nil {
 				log.Printf("failed to connect to target: %v", err)
 				return
 			}
 
 			defer rc.Close()
+
 			log.Printf("🏄‍ %s <-tunnel-> %s <-forward-> %s", c.RemoteAddr(), c.LocalAddr(), tgt.String())
 			_, _, err = relay(rc, c)
 			if err != nil {
@@ -131,7 +374,7 @@ func forwardConnection(c dialer.ForwardConnection) {
 				log.Printf("relay error: %v", err)
 			}
 
-		case <-time.After(5 * time.Second):
+		case <-time.After(s.targetTimeout()):
 			log.Printf("timeout for connection(%s) <-> %s", c.RemoteAddr(), c.LocalAddr())
 			c.Close()
 		}
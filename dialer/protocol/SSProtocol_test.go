@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/dialer/connection"
+	"github.com/FTwOoO/go-ss/dialer/outbound"
+	"github.com/FTwOoO/go-ss/dialer/rule"
+)
+
+func TestDialOutboundChecksResolvedAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	tgt, _ := rule.ParseTarget(net.JoinHostPort("localhost", port))
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+	s := &SSProxyPrococol{}
+	if s.blockOutbound(tgt) {
+		t.Fatal("domain blocked before resolution")
+	}
+	if c, err := s.dialOutbound(tgt, client, directOutbound{}); err == nil {
+		c.Close()
+		t.Fatal("localhost reached with the default policy")
+	}
+
+	s.Outbound = &rule.Outbound{AllowPrivate: true}
+	c, err := s.dialOutbound(tgt, client, directOutbound{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestServerListenWithOutbound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// tells each client the address it connected from
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			c.Write([]byte(host))
+			c.Close()
+		}
+	}()
+
+	addr := freeAddr(t)
+	s := &SSProxyPrococol{Cipher: "AEAD_CHACHA20_POLY1305", Password: "test", Outbound: &rule.Outbound{AllowPrivate: true}}
+	o := &outbound.Dialer{Source: outbound.Source{IPs: []net.IP{net.ParseIP("127.0.0.2")}}}
+	if err := s.ServerListen(addr, net.Listen, nil, ctx, dialer.WithOutbound(o)); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &SSProxyPrococol{Cipher: s.Cipher, Password: s.Password, ServerAddr: addr}
+	c, err := client.ClientWrapDial(net.DialTimeout)("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(c)
+	if err != nil && len(b) == 0 {
+		t.Fatal(err)
+	}
+	if string(b) != "127.0.0.2" {
+		t.Fatalf("server connected from %q", b)
+	}
+}
+
+func TestServerListenThroughSocksUpstream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := echoServer(t)
+	defer l.Close()
+
+	var proxied int32
+	socksAddr, err := SocksServer("127.0.0.1:0", func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(&proxied, 1)
+		return net.DialTimeout(network, addr, timeout)
+	}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := freeAddr(t)
+	s := &SSProxyPrococol{Cipher: "AEAD_CHACHA20_POLY1305", Password: "test", Outbound: &rule.Outbound{AllowPrivate: true}}
+	o := &outbound.Dialer{Upstream: (&SocksProxy{Addr: socksAddr}).ClientWrapDial(net.DialTimeout)}
+	if err := s.ServerListen(addr, net.Listen, nil, ctx, dialer.WithOutbound(o)); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &SSProxyPrococol{Cipher: s.Cipher, Password: s.Password, ServerAddr: addr}
+	c, err := client.ClientWrapDial(net.DialTimeout)("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("echoed %q, %v", b, err)
+	}
+	if n := atomic.LoadInt32(&proxied); n != 1 {
+		t.Fatalf("%d connections through the upstream", n)
+	}
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	n int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.n, 1)
+	}
+	return c, err
+}
+
+func TestServerListenMux(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := echoServer(t)
+	defer l.Close()
+
+	addr := freeAddr(t)
+	s := &SSProxyPrococol{Cipher: "AEAD_CHACHA20_POLY1305", Password: "test", Outbound: &rule.Outbound{AllowPrivate: true}, Mux: connection.DefaultMuxConfig()}
+	counter := &countingListener{}
+	listen := func(network, laddr string) (net.Listener, error) {
+		var err error
+		counter.Listener, err = net.Listen(network, laddr)
+		return counter, err
+	}
+	if err := s.ServerListen(addr, listen, nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &SSProxyPrococol{Cipher: s.Cipher, Password: s.Password, ServerAddr: addr, Mux: &connection.MuxConfig{MaxStreams: 8, Conns: 1}}
+	dial := client.ClientWrapDial(net.DialTimeout)
+	for i := 0; i < 3; i++ {
+		c, err := dial("tcp", l.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Fatalf("echoed %q, %v", b, err)
+		}
+	}
+	if n := atomic.LoadInt32(&counter.n); n != 1 {
+		t.Fatalf("%d connections to the server for 3 streams", n)
+	}
+	client.Close()
+	if _, err := dial("tcp", l.Addr().String(), time.Second); err != connection.ErrPoolClosed {
+		t.Fatalf("dialed after close: %v", err)
+	}
+
+	// a server without mux refuses it
+	plain := &SSProxyPrococol{Cipher: s.Cipher, Password: s.Password}
+	addr2 := freeAddr(t)
+	if err := plain.ServerListen(addr2, net.Listen, nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+	client.ServerAddr = addr2
+	c, err := client.ClientWrapDial(net.DialTimeout)("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hello"))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("stream through a refused mux")
+	}
+}
+
+func TestServerListenPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := echoServer(t)
+	defer l.Close()
+
+	addr := freeAddr(t)
+	s := &SSProxyPrococol{Cipher: "AEAD_CHACHA20_POLY1305", Password: "test", Outbound: &rule.Outbound{AllowPrivate: true}, TargetTimeout: time.Second}
+	counter := &countingListener{}
+	listen := func(network, laddr string) (net.Listener, error) {
+		var err error
+		counter.Listener, err = net.Listen(network, laddr)
+		return counter, err
+	}
+	if err := s.ServerListen(addr, listen, nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &SSProxyPrococol{Cipher: s.Cipher, Password: s.Password, ServerAddr: addr,
+		Pool: &connection.PoolConfig{Size: 2, MaxIdle: 800 * time.Millisecond, Refill: 10 * time.Millisecond, Active: time.Minute}}
+	dial := client.ClientWrapDial(net.DialTimeout)
+	for i := 0; i < 4; i++ {
+		c, err := dial("tcp", l.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Fatalf("echoed %q, %v", b, err)
+		}
+		c.Close()
+
+		// past the aging of some, under the wait of the server
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	// the first was dialed, the others pooled
+	n := atomic.LoadInt32(&counter.n)
+	if n < 3 {
+		t.Fatalf("%d connections to the server, none pooled", n)
+	}
+	client.Close()
+	if _, err := dial("tcp", l.Addr().String(), time.Second); err != connection.ErrPoolClosed {
+		t.Fatalf("dialed after close: %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package protocol
 import (
 	"context"
 	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/dialer/fakedns"
+	"github.com/FTwOoO/go-ss/dialer/sniff"
 	"github.com/FTwOoO/go-ss/socks"
 	"io"
 	"log"
@@ -11,7 +13,32 @@ import (
 )
 
 func SocksServer(addr string, dial dialer.DialFunc, ctx context.Context) (listenAddr string, err error) {
-	l, err := net.Listen("tcp", addr)
+	c := &SocksConfig{Addr: addr, Dial: dial}
+	return c.Serve(ctx)
+}
+
+type SocksConfig struct {
+	Addr string
+	Dial dialer.DialFunc
+
+	// DialHost is used instead of Dial for IP targets the sniffer found a
+	// domain name for, so that rules can match it.
+	DialHost dialer.HostDialFunc
+
+	// Sniff peeks at the first bytes from the client for the TLS SNI or HTTP
+	// Host, waiting at most SniffTimeout. With SniffOverride an IP target is
+	// replaced with the domain name found.
+	Sniff         bool
+	SniffTimeout  time.Duration
+	SniffOverride bool
+
+	// FakeDNS maps targets in its range back to the domain names they were
+	// handed out for.
+	FakeDNS *fakedns.Pool
+}
+
+func (s *SocksConfig) Serve(ctx context.Context) (listenAddr string, err error) {
+	l, err := net.Listen("tcp", s.Addr)
 
 	if err != nil {
 		log.Printf("failed to listen: %v", err)
@@ -34,7 +61,7 @@ func SocksServer(addr string, dial dialer.DialFunc, ctx context.Context) (listen
 					continue
 				}
 
-				go handleConnection(c, dial)
+				go s.handleConnection(c)
 			}
 		}
 	}()
@@ -42,7 +69,7 @@ func SocksServer(addr string, dial dialer.DialFunc, ctx context.Context) (listen
 	return
 }
 
-func handleConnection(c net.Conn, dial dialer.DialFunc) {
+func (s *SocksConfig) handleConnection(c net.Conn) {
 	defer c.Close()
 	c.(*net.TCPConn).SetKeepAlive(true)
 
@@ -52,10 +79,45 @@ func handleConnection(c net.Conn, dial dialer.DialFunc) {
 		return
 	}
 
-	rc, err := dial("tcp", tgt.String(), 3*time.Second)
-	if err != nil {
-		log.Printf("failed to connect to server %v: %v", tgt.String(), err)
-		return
+	addr := tgt.String()
+	isDomain := tgt[0] == socks.AtypDomainName
+	var rc net.Conn
+
+	if s.FakeDNS != nil && !isDomain {
+		if a := s.FakeDNS.ResolveAddr(addr); a != addr {
+			addr = a
+			isDomain = true
+		}
+	}
+
+	if s.Sniff && !isDomain {
+		var domain string
+		c, domain = sniff.Peek(c, s.SniffTimeout, 0)
+
+		if domain != "" {
+			log.Printf("sniffed %s for %s", domain, addr)
+		}
+
+		switch {
+		case domain == "":
+		case s.SniffOverride:
+			_, port, _ := net.SplitHostPort(addr)
+			addr = net.JoinHostPort(domain, port)
+		case s.DialHost != nil:
+			rc, err = s.DialHost("tcp", addr, domain, 3*time.Second)
+			if err != nil {
+				log.Printf("failed to connect to server %v (%s): %v", addr, domain, err)
+				return
+			}
+		}
+	}
+
+	if rc == nil {
+		rc, err = s.Dial("tcp", addr, 3*time.Second)
+		if err != nil {
+			log.Printf("failed to connect to server %v: %v", addr, err)
+			return
+		}
 	}
 	defer rc.Close()
 
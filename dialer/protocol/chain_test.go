@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/dialer/rule"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func port(addr string) int {
+	_, p, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(p)
+	return n
+}
+
+// gss starts a shadowsocks server that may only connect to port next.
+func gss(t *testing.T, ctx context.Context, cipher, password, next string) *SSProxyPrococol {
+	addr := freeAddr(t)
+	s := &SSProxyPrococol{
+		Cipher:     cipher,
+		Password:   password,
+		ServerAddr: addr,
+		Outbound: &rule.Outbound{
+			AllowPrivate: true,
+			AllowPorts:   []rule.PortRange{{From: port(next), To: port(next)}},
+		},
+	}
+	if err := s.ServerListen(addr, net.Listen, nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+	return &SSProxyPrococol{Cipher: cipher, Password: password, ServerAddr: addr}
+}
+
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// httpConnectProxy serves CONNECT for user:pass only.
+func httpConnectProxy(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization")); !ok || u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		rc, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rc.Close()
+
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relay(c, rc)
+	}))
+	return l
+}
+
+func parseProxyAuth(h string) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {h}}}
+	return r.BasicAuth()
+}
+
+func chainRoundTrip(t *testing.T, dial dialer.DialFunc, target string) {
+	c, err := dial("tcp", target, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Fatalf("got %q", line)
+	}
+}
+
+func TestChain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	target := echoServer(t)
+	defer target.Close()
+
+	// B only reaches the target and A only reaches B, so a connection that
+	// gets through went client -> A -> B -> target
+	b := gss(t, ctx, "AEAD_AES_256_GCM", "second", target.Addr().String())
+	a := gss(t, ctx, "AEAD_CHACHA20_POLY1305", "first", b.ServerAddr)
+
+	t.Run("ss", func(t *testing.T) {
+		chainRoundTrip(t, dialer.Chain(net.DialTimeout, a, b), target.Addr().String())
+	})
+
+	t.Run("wrong order", func(t *testing.T) {
+		c, err := dialer.Chain(net.DialTimeout, b, a)("tcp", target.Addr().String(), time.Second)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		c.Write([]byte("ping\n"))
+		if _, err := c.Read(make([]byte, 5)); err == nil {
+			t.Fatal("B reached A")
+		}
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		socksAddr, err := SocksServer("127.0.0.1:0", net.DialTimeout, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hops := []dialer.ClientProtocol{&SocksProxy{Addr: socksAddr}, a, b}
+		chainRoundTrip(t, dialer.Chain(net.DialTimeout, hops...), target.Addr().String())
+	})
+
+	t.Run("http", func(t *testing.T) {
+		proxy := httpConnectProxy(t)
+		defer proxy.Close()
+
+		hops := []dialer.ClientProtocol{&HTTPProxy{Addr: proxy.Addr().String(), Username: "user", Password: "pass"}, a, b}
+		chainRoundTrip(t, dialer.Chain(net.DialTimeout, hops...), target.Addr().String())
+
+		wrong := &HTTPProxy{Addr: proxy.Addr().String(), Username: "user", Password: "wrong"}
+		if _, err := wrong.ClientWrapDial(net.DialTimeout)("tcp", target.Addr().String(), time.Second); err == nil {
+			t.Fatal("wrong password accepted")
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // from linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // from linux/netfilter_ipv6/ip6_tables.h
+)
+
+func listenRedir(addr string, tproxy bool) (net.Listener, error) {
+	if !tproxy {
+		return net.Listen("tcp", addr)
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination of a connection redirected by iptables.
+func originalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if a, ok := c.LocalAddr().(*net.TCPAddr); ok && a.IP.To4() == nil {
+			// a sockaddr_in6 fits in the ip6_mtuinfo the kernel would return
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			sa := info.Addr
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port)) // network byte order
+			addr = &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: int(port[0])<<8 | int(port[1])}
+			return
+		}
+
+		// a sockaddr_in fits in the 16 bytes of an ipv6_mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		b := mreq.Multiaddr
+		addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return addr, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package protocol
+
+import (
+	"errors"
+	"net"
+)
+
+var errRedirNotSupported = errors.New("transparent proxy is only supported on linux")
+
+func listenRedir(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errRedirNotSupported
+}
+
+func originalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errRedirNotSupported
+}
@@ -0,0 +1,50 @@
+package dialer
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var safeHTTPMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("OPTIONS "),
+	[]byte("TRACE "),
+}
+
+// IsReplayable tells whether the first bytes of a stream can be sent twice
+// without side effects on the target.
+func IsReplayable(b []byte) bool {
+	if len(b) > 0 && b[0] == recordHandshake {
+		return handshakeOnly(b)
+	}
+
+	for _, m := range safeHTTPMethods {
+		if bytes.HasPrefix(b, m) {
+			return true
+		}
+	}
+	return false
+}
+
+const recordHandshake = 0x16
+
+// handshakeOnly tells whether b holds nothing but TLS handshake records. A
+// ClientHello is harmless to send twice, the 0-RTT early data that may
+// follow it in application data records is not. The last record may be cut.
+func handshakeOnly(b []byte) bool {
+	for len(b) > 0 {
+		if b[0] != recordHandshake {
+			return false
+		}
+		if len(b) < 5 {
+			return true
+		}
+		n := 5 + int(binary.BigEndian.Uint16(b[3:5]))
+		if n >= len(b) {
+			return true
+		}
+		b = b[n:]
+	}
+	return true
+}
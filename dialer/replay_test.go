@@ -0,0 +1,24 @@
+package dialer
+
+import "testing"
+
+func TestIsReplayable(t *testing.T) {
+	hello := []byte{0x16, 0x03, 0x01, 0x00, 0x02, 0x01, 0x00}
+	early := []byte{0x17, 0x03, 0x03, 0x00, 0x01, 'x'}
+	for _, c := range []struct {
+		b    []byte
+		want bool
+	}{
+		{hello, true},
+		{append(append([]byte(nil), hello...), hello...), true},
+		{hello[:4], true},
+		{append(append([]byte(nil), hello...), early...), false},
+		{early, false},
+		{[]byte("GET / HTTP/1.1\r\n\r\n"), true},
+		{[]byte("POST / HTTP/1.1\r\n\r\n"), false},
+	} {
+		if got := IsReplayable(c.b); got != c.want {
+			t.Errorf("IsReplayable(%x) = %v", c.b, got)
+		}
+	}
+}
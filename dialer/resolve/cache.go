@@ -0,0 +1,100 @@
+package resolve
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTTL         = 5 * time.Minute
+	DefaultNegativeTTL = 30 * time.Second
+
+	maxCacheEntries = 4096
+)
+
+// Cache remembers lookups for TTL, and failed lookups for NegativeTTL.
+// Concurrent lookups of the same host wait for a single query.
+type Cache struct {
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	Lookup      func(host string) ([]net.IP, error) // net.LookupIP if nil
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+	done    chan struct{} // closed when the lookup finished
+}
+
+func (c *Cache) LookupIP(host string) ([]net.IP, error) {
+	now := time.Now()
+
+	c.lock.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	e, ok := c.entries[host]
+	if ok {
+		select {
+		case <-e.done:
+			if now.After(e.expires) {
+				ok = false
+			}
+		default: // in flight
+		}
+	}
+	if !ok {
+		if len(c.entries) >= maxCacheEntries {
+			c.expire(now)
+		}
+		e = &cacheEntry{done: make(chan struct{})}
+		c.entries[host] = e
+		c.lock.Unlock()
+
+		c.lookup(host, e)
+		return e.ips, e.err
+	}
+	c.lock.Unlock()
+
+	<-e.done
+	return e.ips, e.err
+}
+
+func (c *Cache) lookup(host string, e *cacheEntry) {
+	lookup := c.Lookup
+	if lookup == nil {
+		lookup = net.LookupIP
+	}
+	e.ips, e.err = lookup(host)
+
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	if e.err != nil || len(e.ips) == 0 {
+		ttl = c.NegativeTTL
+		if ttl == 0 {
+			ttl = DefaultNegativeTTL
+		}
+	}
+	e.expires = time.Now().Add(ttl)
+	close(e.done)
+}
+
+// expire must be called with c.lock held.
+func (c *Cache) expire(now time.Time) {
+	for host, e := range c.entries {
+		select {
+		case <-e.done:
+			if now.After(e.expires) {
+				delete(c.entries, host)
+			}
+		default:
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package resolve decides per domain whether the client sends the domain name
+// to the server or resolves it locally and sends an IP address.
+package resolve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+)
+
+type Policy int
+
+const (
+	Remote     Policy = iota // send the domain, the server resolves it
+	Local                    // resolve locally, send the first address
+	PreferIPv4               // resolve locally, send an IPv4 address if there is one
+	PreferIPv6               // resolve locally, send an IPv6 address if there is one
+)
+
+var policyNames = map[string]Policy{
+	"remote":      Remote,
+	"local":       Local,
+	"prefer-ipv4": PreferIPv4,
+	"prefer-ipv6": PreferIPv6,
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	p, ok := policyNames[strings.ToLower(s)]
+	if !ok {
+		return Remote, fmt.Errorf("unknown resolve policy %q", s)
+	}
+	return p, nil
+}
+
+func (p Policy) String() string {
+	for name, v := range policyNames {
+		if v == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Resolver rewrites the host of an address before it is sent to the server.
+// Hosts pins domains to addresses whatever the policy. Policies apply to a
+// domain and its subdomains, the most specific one wins, Default otherwise.
+type Resolver struct {
+	Hosts    map[string][]net.IP
+	Policies map[string]Policy
+	Default  Policy
+	Cache    *Cache
+}
+
+// ResolveAddr returns addr with its domain replaced by an IP address if the
+// hosts table or the policy for the domain says so.
+func (r *Resolver) ResolveAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	p := r.policy(host)
+	ips, ok := r.Hosts[host]
+	if !ok {
+		if p == Remote {
+			return addr, nil
+		}
+
+		cache := r.Cache
+		if cache == nil {
+			cache = defaultCache
+		}
+		ips, err = cache.LookupIP(host)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ip := pick(ips, p)
+	if ip == nil {
+		return "", fmt.Errorf("no address for %s", host)
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+var defaultCache = &Cache{}
+
+func (r *Resolver) policy(host string) Policy {
+	for {
+		if p, ok := r.Policies[host]; ok {
+			return p
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return r.Default
+		}
+		host = host[i+1:]
+	}
+}
+
+func pick(ips []net.IP, p Policy) net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+	for _, ip := range ips {
+		is4 := ip.To4() != nil
+		if (p == PreferIPv4 && is4) || (p == PreferIPv6 && !is4) {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+// WrapDial resolves the address before handing it to dial.
+func (r *Resolver) WrapDial(dial dialer.DialFunc) dialer.DialFunc {
+	return func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		a, err := r.ResolveAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		return dial(network, a, timeout)
+	}
+}
+
+// ParseHosts reads a hosts(5) style table: an address followed by the names
+// it is for. Text after '#' is ignored.
+func ParseHosts(rd io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	s := bufio.NewScanner(rd)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(stripComment(s.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected an address and host names", n)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, s.Err()
+}
+
+// ParsePolicies reads lines of a domain followed by its policy, e.g.
+// "example.com prefer-ipv4". Text after '#' is ignored.
+func ParsePolicies(rd io.Reader) (map[string]Policy, error) {
+	policies := make(map[string]Policy)
+	s := bufio.NewScanner(rd)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(stripComment(s.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a domain and a policy", n)
+		}
+		p, err := ParsePolicy(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		domain := strings.ToLower(strings.Trim(fields[0], "."))
+		policies[domain] = p
+	}
+	return policies, s.Err()
+}
+
+func LoadHosts(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHosts(f)
+}
+
+func LoadPolicies(path string) (map[string]Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePolicies(f)
+}
+
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
@@ -0,0 +1,129 @@
+package resolve
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolveAddr(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(`
+# pinned
+10.0.0.1   pinned.example.com alias.example.com.
+fd00::1    pinned.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := ParsePolicies(strings.NewReader(`
+example.com       local
+v6.example.com    prefer-ipv6
+.remote.example.com remote   # leading dot is ignored
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Resolver{
+		Hosts:    hosts,
+		Policies: policies,
+		Default:  Remote,
+		Cache: &Cache{Lookup: func(host string) ([]net.IP, error) {
+			if host == "missing.example.com" {
+				return nil, errors.New("no such host")
+			}
+			return []net.IP{net.ParseIP("fd00::2"), net.ParseIP("192.0.2.1")}, nil
+		}},
+	}
+
+	for addr, want := range map[string]string{
+		"pinned.example.com:443":     "10.0.0.1:443",
+		"Alias.Example.com.:80":      "10.0.0.1:80",
+		"www.example.com:80":         "[fd00::2]:80",
+		"a.v6.example.com:80":        "[fd00::2]:80",
+		"x.remote.example.com:80":    "x.remote.example.com:80",
+		"other.org:80":               "other.org:80",
+		"192.0.2.9:80":               "192.0.2.9:80",
+		"missing.example.com:80":     "",
+		"pinned.example.com:notport": "10.0.0.1:notport",
+	} {
+		got, err := r.ResolveAddr(addr)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", addr, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("%s: got %s, %v, want %s", addr, got, err, want)
+		}
+	}
+
+	r.Policies["pinned.example.com"] = PreferIPv6
+	if got, _ := r.ResolveAddr("pinned.example.com:443"); got != "[fd00::1]:443" {
+		t.Errorf("pinned with prefer-ipv6: got %s", got)
+	}
+	r.Default = PreferIPv4
+	if got, _ := r.ResolveAddr("other.org:80"); got != "192.0.2.1:80" {
+		t.Errorf("default prefer-ipv4: got %s", got)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := ParseHosts(strings.NewReader("example.com 10.0.0.1\n")); err == nil {
+		t.Error("hosts: no error for swapped fields")
+	}
+	if _, err := ParsePolicies(strings.NewReader("example.com nearby\n")); err == nil {
+		t.Error("policies: no error for unknown policy")
+	}
+}
+
+func TestCache(t *testing.T) {
+	var n int32
+	c := &Cache{
+		TTL:         50 * time.Millisecond,
+		NegativeTTL: time.Hour,
+		Lookup: func(host string) ([]net.IP, error) {
+			atomic.AddInt32(&n, 1)
+			time.Sleep(10 * time.Millisecond)
+			if host == "bad" {
+				return nil, errors.New("no such host")
+			}
+			return []net.IP{net.IPv4(192, 0, 2, 1)}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips, err := c.LookupIP("good"); err != nil || len(ips) != 1 {
+				t.Errorf("got %v, %v", ips, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n != 1 {
+		t.Fatalf("%d lookups for concurrent queries", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c.LookupIP("good")
+	if n != 2 {
+		t.Fatalf("expired entry not looked up again, %d lookups", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.LookupIP("bad"); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if n != 3 {
+		t.Fatalf("failure not cached, %d lookups", n)
+	}
+}
@@ -0,0 +1,205 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// List holds the filters of an AdBlock Plus style list such as GFWList.
+// Matching targets are proxied, targets matching an exception (@@) go direct.
+//
+// Filters are applied to Target.URL, so a filter that needs the path of the
+// URL (|http://example.com/page) can only match in a PAC file.
+type List struct {
+	proxy      filterSet
+	exceptions filterSet
+}
+
+type filterSet struct {
+	domains map[string]bool // ||example.com^ filters, matching subdomains too
+	regexps []*regexp.Regexp
+}
+
+func newFilterSet() filterSet {
+	return filterSet{domains: make(map[string]bool)}
+}
+
+func (s *filterSet) match(t *Target) bool {
+	for h := t.Host; h != ""; {
+		if s.domains[h] {
+			return true
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+
+	if len(s.regexps) == 0 {
+		return false
+	}
+	url := t.URL()
+	for _, re := range s.regexps {
+		if re.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *filterSet) len() int {
+	return len(s.domains) + len(s.regexps)
+}
+
+func (l *List) Match(t *Target) Action {
+	if l.exceptions.match(t) {
+		return Direct
+	}
+	if l.proxy.match(t) {
+		return Proxy
+	}
+	return Unknown
+}
+
+// Len returns the number of proxy filters and exception filters.
+func (l *List) Len() (proxy int, exceptions int) {
+	return l.proxy.len(), l.exceptions.len()
+}
+
+func LoadABP(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseABP(f)
+}
+
+// ParseABP reads a list in AdBlock Plus syntax, plain or base64 encoded as
+// GFWList is published. Filters that can't be used are logged and skipped.
+func ParseABP(r io.Reader) (*List, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b = decodeBase64List(b)
+
+	l := &List{proxy: newFilterSet(), exceptions: newFilterSet()}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '!' || line[0] == '[' || strings.Contains(line, "##") || strings.Contains(line, "#@#") {
+			continue
+		}
+
+		set := &l.proxy
+		if strings.HasPrefix(line, "@@") {
+			set = &l.exceptions
+			line = line[2:]
+		}
+
+		if err := set.add(line); err != nil {
+			log.Printf("rule: skip filter %q: %v", line, err)
+		}
+	}
+	return l, s.Err()
+}
+
+// decodeBase64List returns b decoded if the whole list is base64.
+func decodeBase64List(b []byte) []byte {
+	compact := bytes.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, b)
+
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(compact)))
+	n, err := base64.StdEncoding.Decode(decoded, compact)
+	if err != nil || !bytes.ContainsRune(decoded[:n], '\n') {
+		return b
+	}
+	return decoded[:n]
+}
+
+func (s *filterSet) add(filter string) error {
+	// /regex/
+	if len(filter) > 2 && filter[0] == '/' && filter[len(filter)-1] == '/' {
+		re, err := regexp.Compile(filter[1 : len(filter)-1])
+		if err != nil {
+			return err
+		}
+		s.regexps = append(s.regexps, re)
+		return nil
+	}
+
+	if i := strings.LastIndexByte(filter, '$'); i >= 0 {
+		filter = filter[:i] // options like $third-party don't apply to a proxy
+	}
+	filter = strings.ToLower(filter)
+	if filter == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(filter, "||") {
+		host := filter[2:]
+		host = strings.TrimSuffix(host, "^")
+		host = strings.TrimSuffix(host, "/")
+		if host != "" && !strings.ContainsAny(host, "/^*|:") {
+			s.domains[strings.TrimSuffix(host, ".")] = true
+			return nil
+		}
+	}
+
+	re, err := regexp.Compile(abpToRegexp(filter))
+	if err != nil {
+		return err
+	}
+	s.regexps = append(s.regexps, re)
+	return nil
+}
+
+// abpToRegexp converts a filter to a regular expression that is valid both
+// in Go and in JavaScript, so it can be reused in PAC files.
+func abpToRegexp(filter string) string {
+	var b strings.Builder
+
+	switch {
+	case strings.HasPrefix(filter, "||"):
+		b.WriteString(`^[\w\-]+:\/+(?:[^\/]+\.)?`)
+		filter = filter[2:]
+	case strings.HasPrefix(filter, "|"):
+		b.WriteString("^")
+		filter = filter[1:]
+	}
+
+	end := strings.HasSuffix(filter, "|")
+	filter = strings.TrimSuffix(filter, "|")
+
+	for _, r := range filter {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '^':
+			b.WriteString(`(?:[^\w\-.%]|$)`)
+		case '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	if end {
+		b.WriteString("$")
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package rule
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var abpCases = []struct {
+	addr   string
+	action Action
+}{
+	{"google.com:443", Proxy},
+	{"www.google.com:443", Proxy},
+	{"notgoogle.com:443", Unknown},
+	{"cn.google.com:443", Direct},
+	{"maps.cn.google.com:80", Direct},
+	{"youtube.com:443", Proxy},
+	{"direct.youtube.com:80", Direct},
+	{"direct.youtube.com:443", Proxy},
+	{"85.17.73.31:80", Proxy},
+	{"85.17.73.31:443", Unknown},
+	{"ssl.example.org:443", Proxy},
+	{"ssl.example.org:80", Unknown},
+	{"pbs.twimg.com:443", Proxy},
+	{"foo.blogspot.com:80", Proxy},
+	{"ads.example.net:80", Proxy},
+	{"example.com:80", Unknown},
+}
+
+func testABPList(t *testing.T, l *List) {
+	for _, c := range abpCases {
+		target, err := ParseTarget(c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := l.Match(target); a != c.action {
+			t.Errorf("%s: got %s, want %s", c.addr, a, c.action)
+		}
+	}
+}
+
+func TestParseABP(t *testing.T) {
+	l, err := LoadABP("testdata/abp.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testABPList(t, l)
+
+	if proxy, exceptions := l.Len(); proxy != 7 || exceptions != 2 {
+		t.Fatalf("got %d filters and %d exceptions", proxy, exceptions)
+	}
+}
+
+func TestParseABPBase64(t *testing.T) {
+	l, err := LoadABP("testdata/gfwlist.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testABPList(t, l)
+}
+
+func TestWritePAC(t *testing.T) {
+	l, err := LoadABP("testdata/gfwlist.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := l.WritePAC(&b, "SOCKS5 127.0.0.1:1080"); err != nil {
+		t.Fatal(err)
+	}
+
+	pac := b.String()
+	for _, s := range []string{
+		`var proxy = "SOCKS5 127.0.0.1:1080";`,
+		`"google.com":1`,
+		`"cn.google.com":1`,
+		`function FindProxyForURL(url, host)`,
+	} {
+		if !strings.Contains(pac, s) {
+			t.Errorf("PAC does not contain %s", s)
+		}
+	}
+}
+
+func TestABPSourceRefresh(t *testing.T) {
+	fixture, err := ioutil.ReadFile("testdata/gfwlist.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fixture)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "rule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &ABPSource{Path: filepath.Join(dir, "gfwlist.txt"), URL: ts.URL}
+	s.Run(context.Background())
+	testABPList(t, s.List())
+
+	saved, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, fixture) {
+		t.Fatal("downloaded list was not saved")
+	}
+
+	offline := &ABPSource{Path: s.Path, URL: "http://127.0.0.1:1/unreachable"}
+	offline.Run(context.Background())
+	testABPList(t, offline.List())
+}
@@ -0,0 +1,249 @@
+package rule
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ACL implements the access control list files of shadowsocks-libev:
+//
+//	[proxy_all]            proxy everything but [bypass_list] (alias [accept_all])
+//	[bypass_all]           bypass everything but [proxy_list] (alias [reject_all])
+//	[bypass_list]          alias [black_list]
+//	[proxy_list]           alias [white_list]
+//	[outbound_block_list]  targets the server refuses to connect to
+//
+// Entries are IP addresses, CIDRs or regular expressions matched against
+// domain names. A domain in both lists is proxied, an IP in both lists is
+// bypassed, as in libev.
+//
+// On a client the lists decide between bypassing (Direct) and Proxy. On a
+// server the bypass and proxy lists apply to client addresses: bypassed
+// clients are refused.
+type ACL struct {
+	Path string
+
+	lock sync.RWMutex
+	acl  *aclRules
+}
+
+type aclRules struct {
+	mode     Action // Unknown if the file has no [proxy_all] or [bypass_all]
+	bypass   aclList
+	proxy    aclList
+	outbound aclList
+}
+
+type aclList struct {
+	nets    []*net.IPNet
+	regexps []*regexp.Regexp
+}
+
+func (l *aclList) matchIP(ip net.IP) bool {
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *aclList) matchHost(host string) bool {
+	for _, re := range l.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *aclList) len() int {
+	return len(l.nets) + len(l.regexps)
+}
+
+func (l *aclList) add(entry string) error {
+	if _, n, err := net.ParseCIDR(entry); err == nil {
+		l.nets = append(l.nets, n)
+		return nil
+	}
+
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		l.nets = append(l.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+
+	re, err := regexp.Compile(entry)
+	if err != nil {
+		return err
+	}
+	l.regexps = append(l.regexps, re)
+	return nil
+}
+
+func LoadACL(path string) (*ACL, error) {
+	a := &ACL{Path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads Path again. The current rules are kept if that fails.
+func (a *ACL) Reload() error {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	acl, err := parseACL(f)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	a.acl = acl
+	a.lock.Unlock()
+
+	log.Printf("rule: loaded acl %s: %d bypass, %d proxy, %d outbound block entries", a.Path,
+		acl.bypass.len(), acl.proxy.len(), acl.outbound.len())
+	return nil
+}
+
+// ReloadOnSignal reloads the file whenever one of sig is received, until ctx
+// is done.
+func (a *ACL) ReloadOnSignal(ctx context.Context, sig ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if err := a.Reload(); err != nil {
+				log.Printf("rule: failed to reload acl %s: %v", a.Path, err)
+			}
+		}
+	}
+}
+
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl, err := parseACL(r)
+	if err != nil {
+		return nil, err
+	}
+	return &ACL{acl: acl}, nil
+}
+
+func parseACL(r io.Reader) (*aclRules, error) {
+	acl := &aclRules{}
+	var list *aclList
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		switch line {
+		case "[proxy_all]", "[accept_all]":
+			acl.mode = Proxy
+			continue
+		case "[bypass_all]", "[reject_all]":
+			acl.mode = Direct
+			continue
+		case "[bypass_list]", "[black_list]":
+			list = &acl.bypass
+			continue
+		case "[proxy_list]", "[white_list]":
+			list = &acl.proxy
+			continue
+		case "[outbound_block_list]":
+			list = &acl.outbound
+			continue
+		}
+
+		if line[0] == '[' {
+			log.Printf("rule: unknown acl section %s", line)
+			list = nil
+			continue
+		}
+		if list == nil {
+			continue
+		}
+
+		if err := list.add(line); err != nil {
+			log.Printf("rule: skip acl entry %q: %v", line, err)
+		}
+	}
+	return acl, s.Err()
+}
+
+func (a *ACL) rules() *aclRules {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.acl
+}
+
+// Match decides between Direct and Proxy for a client. It returns Unknown
+// if no list has t and the file sets no default.
+func (a *ACL) Match(t *Target) Action {
+	acl := a.rules()
+
+	if t.HasDomain() {
+		if acl.proxy.matchHost(t.Host) {
+			return Proxy
+		}
+		if acl.bypass.matchHost(t.Host) {
+			return Direct
+		}
+	}
+
+	if t.IP != nil {
+		if acl.bypass.matchIP(t.IP) {
+			return Direct
+		}
+		if acl.proxy.matchIP(t.IP) {
+			return Proxy
+		}
+	}
+	return acl.mode
+}
+
+// AllowClient tells whether a server accepts a client connecting from ip.
+func (a *ACL) AllowClient(ip net.IP) bool {
+	acl := a.rules()
+
+	if acl.bypass.matchIP(ip) {
+		return false
+	}
+	if acl.mode == Direct {
+		return acl.proxy.matchIP(ip)
+	}
+	return true
+}
+
+// BlockOutbound tells whether a server must refuse to connect to t.
+func (a *ACL) BlockOutbound(t *Target) bool {
+	acl := a.rules()
+
+	if t.HasDomain() && acl.outbound.matchHost(t.Host) {
+		return true
+	}
+	return t.IP != nil && acl.outbound.matchIP(t.IP)
+}
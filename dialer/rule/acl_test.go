@@ -0,0 +1,129 @@
+package rule
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestACLMatch(t *testing.T) {
+	acl, err := LoadACL("testdata/client.acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		addr   string
+		action Action
+	}{
+		{"127.0.0.1:80", Direct},
+		{"10.1.2.3:22", Direct},
+		{"[fe80::1]:80", Direct},
+		{"8.8.8.8:53", Proxy},
+		{"www.baidu.com:443", Direct},
+		{"gov.cn:80", Direct},
+		{"google.cn:443", Proxy},
+		{"www.google.com:443", Proxy},
+		{"203.0.113.7:80", Direct}, // an IP in both lists is bypassed
+		{"203.0.113.8:80", Proxy},
+	} {
+		target, err := ParseTarget(c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := acl.Match(target); a != c.action {
+			t.Errorf("%s: got %s, want %s", c.addr, a, c.action)
+		}
+	}
+}
+
+func TestACLModes(t *testing.T) {
+	target, _ := ParseTarget("example.com:80")
+
+	for _, c := range []struct {
+		acl    string
+		action Action
+	}{
+		{"[bypass_list]\n(^|\\.)cn$\n", Unknown},
+		{"[proxy_all]\n", Proxy},
+		{"[accept_all]\n", Proxy},
+		{"[bypass_all]\n", Direct},
+		{"[reject_all]\n[white_list]\nexample\\.com\n", Proxy},
+	} {
+		acl, err := ParseACL(strings.NewReader(c.acl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := acl.Match(target); a != c.action {
+			t.Errorf("%q: got %s, want %s", c.acl, a, c.action)
+		}
+	}
+}
+
+func TestACLServer(t *testing.T) {
+	acl, err := LoadACL("testdata/server.acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if acl.AllowClient(net.ParseIP("198.51.100.1")) {
+		t.Error("black listed client allowed")
+	}
+	if !acl.AllowClient(net.ParseIP("192.0.2.1")) {
+		t.Error("client refused")
+	}
+
+	for addr, blocked := range map[string]bool{
+		"127.0.0.1:80":             true,
+		"[::1]:80":                 true,
+		"169.254.169.254:80":       true,
+		"db.internal.example:5432": true,
+		"example.com:80":           false,
+		"8.8.8.8:53":               false,
+	} {
+		target, _ := ParseTarget(addr)
+		if acl.BlockOutbound(target) != blocked {
+			t.Errorf("%s: blocked should be %v", addr, blocked)
+		}
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.acl")
+	ioutil.WriteFile(path, []byte("[proxy_all]\n"), 0600)
+
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := ParseTarget("example.com:80")
+	if a := acl.Match(target); a != Proxy {
+		t.Fatalf("got %s", a)
+	}
+
+	ioutil.WriteFile(path, []byte("[bypass_all]\n"), 0600)
+	if err := acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a := acl.Match(target); a != Direct {
+		t.Fatalf("got %s after reload", a)
+	}
+
+	os.Remove(path)
+	if err := acl.Reload(); err == nil {
+		t.Fatal("reload of a missing file should fail")
+	}
+	if a := acl.Match(target); a != Direct {
+		t.Fatal("failed reload should keep the rules")
+	}
+}
@@ -0,0 +1,92 @@
+package rule
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/FTwOoO/go-ss/dialer/geoip"
+)
+
+// Private is the country code GeoIP gives to loopback, private and
+// link-local addresses, which are not in the databases.
+const Private = "PRIVATE"
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		privateNets = append(privateNets, n)
+	}
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GeoIP decides by the country of the target IP. Domain targets are only
+// looked up if Resolve is set, with the first address it returns.
+type GeoIP struct {
+	DB        *geoip.Reader
+	Countries map[string]Action // ISO 3166-1 codes or Private
+	Resolve   func(host string) ([]net.IP, error)
+}
+
+// ParseCountries adds a comma separated list of country codes to m with
+// action a.
+func ParseCountries(m map[string]Action, list string, a Action) {
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			m[c] = a
+		}
+	}
+}
+
+func (g *GeoIP) Match(t *Target) Action {
+	ip := t.IP
+	if ip == nil {
+		if g.Resolve == nil {
+			return Unknown
+		}
+		ips, err := g.Resolve(t.Host)
+		if err != nil || len(ips) == 0 {
+			return Unknown
+		}
+		ip = ips[0]
+	}
+
+	return g.MatchIP(ip)
+}
+
+func (g *GeoIP) MatchIP(ip net.IP) Action {
+	if isPrivate(ip) {
+		return g.Countries[Private]
+	}
+
+	country, err := g.DB.Country(ip)
+	if err != nil {
+		log.Printf("rule: geoip lookup of %s failed: %v", ip, err)
+		return Unknown
+	}
+	if country == "" {
+		return Unknown
+	}
+	return g.Countries[country]
+}
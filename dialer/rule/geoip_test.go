@@ -0,0 +1,79 @@
+package rule
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FTwOoO/go-ss/dialer/geoip"
+	"github.com/FTwOoO/go-ss/dialer/geoip/geoiptest"
+)
+
+func TestGeoIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.mmdb")
+	err = geoiptest.Write(path, map[string]string{
+		"1.0.1.0/24":    "CN",
+		"8.8.8.0/24":    "US",
+		"2001:da8::/32": "CN",
+	}, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := geoip.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &GeoIP{DB: db, Countries: make(map[string]Action)}
+	ParseCountries(g.Countries, "cn, private", Direct)
+	ParseCountries(g.Countries, "US", Proxy)
+
+	cases := []struct {
+		addr   string
+		action Action
+	}{
+		{"1.0.1.1:80", Direct},
+		{"[2001:da8::1]:443", Direct},
+		{"192.168.1.1:80", Direct},
+		{"127.0.0.1:1080", Direct},
+		{"8.8.8.8:53", Proxy},
+		{"9.9.9.9:53", Unknown},
+		{"cn.example:80", Unknown},
+	}
+	for _, c := range cases {
+		target, _ := ParseTarget(c.addr)
+		if a := g.Match(target); a != c.action {
+			t.Errorf("%s: got %s, want %s", c.addr, a, c.action)
+		}
+	}
+
+	g.Resolve = func(host string) ([]net.IP, error) {
+		switch host {
+		case "cn.example":
+			return []net.IP{net.ParseIP("1.0.1.2")}, nil
+		case "us.example":
+			return []net.IP{net.ParseIP("8.8.8.8")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	for addr, action := range map[string]Action{
+		"cn.example:80":      Direct,
+		"us.example:443":     Proxy,
+		"unknown.example:80": Unknown,
+	} {
+		target, _ := ParseTarget(addr)
+		if a := g.Match(target); a != action {
+			t.Errorf("%s: got %s, want %s", addr, a, action)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package rule
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var specialNets []*net.IPNet
+
+func init() {
+	specialNets = append(specialNets, privateNets...)
+	for _, cidr := range []string{
+		"192.0.0.0/24",   // IETF protocol assignments
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved, and broadcast
+		"::/128",         // unspecified
+		"64:ff9b::/96",   // well-known NAT64, embeds any IPv4 address
+		"64:ff9b:1::/48", // local use NAT64
+		"ff00::/8",       // multicast
+		"2001:db8::/32",  // documentation
+		"2002:a00::/24",  // 6to4 of 10.0.0.0/8
+		"2002:7f00::/24", // 6to4 of 127.0.0.0/8
+		"2002:a9fe::/32", // 6to4 of 169.254.0.0/16
+		"2002:ac10::/28", // 6to4 of 172.16.0.0/12
+		"2002:c0a8::/32", // 6to4 of 192.168.0.0/16
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		specialNets = append(specialNets, n)
+	}
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To int
+}
+
+func (r PortRange) contains(port int) bool {
+	return port >= r.From && port <= r.To
+}
+
+// Outbound keeps clients of the server out of the networks around it. Its
+// zero value blocks loopback, link-local, private, multicast and other
+// special addresses, so that a leaked password does not open up the LAN or
+// the cloud metadata service at 169.254.169.254.
+//
+// Deny and DenyPorts always block. Allow exempts ranges from the special
+// ones, unless AllowPrivate exempts them all, and leaves them to the rules
+// after it. If AllowPorts is set, other ports are blocked.
+//
+// Domain targets are only checked for their port, the server must check
+// again with each address the domain resolves to.
+type Outbound struct {
+	AllowPrivate bool
+	Allow        []*net.IPNet
+	Deny         []*net.IPNet
+	AllowPorts   []PortRange
+	DenyPorts    []PortRange
+}
+
+// Match returns Block for targets clients may not reach and Unknown
+// otherwise.
+func (o *Outbound) Match(t *Target) Action {
+	if inPorts(o.DenyPorts, t.Port) || (len(o.AllowPorts) > 0 && !inPorts(o.AllowPorts, t.Port)) {
+		return Block
+	}
+	if t.IP == nil {
+		return Unknown
+	}
+
+	switch {
+	case inNets(o.Deny, t.IP):
+		return Block
+	case inNets(o.Allow, t.IP):
+		return Unknown
+	case !o.AllowPrivate && inNets(specialNets, t.IP):
+		return Block
+	}
+	return Unknown
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func inPorts(ports []PortRange, port int) bool {
+	for _, r := range ports {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs or single addresses.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ParsePorts parses a comma separated list of ports and ranges like 6000-7000.
+func ParsePorts(list string) ([]PortRange, error) {
+	var ports []PortRange
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		from, to := s, s
+		if i := strings.IndexByte(s, '-'); i >= 0 {
+			from, to = s[:i], s[i+1:]
+		}
+		f, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		t, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || t < f {
+			return nil, fmt.Errorf("invalid port range %q", s)
+		}
+		ports = append(ports, PortRange{int(f), int(t)})
+	}
+	return ports, nil
+}
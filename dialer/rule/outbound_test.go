@@ -0,0 +1,84 @@
+package rule
+
+import (
+	"testing"
+)
+
+func TestOutbound(t *testing.T) {
+	var o Outbound
+	for addr, want := range map[string]Action{
+		"127.0.0.1:80":          Block,
+		"169.254.169.254:80":    Block,
+		"10.1.2.3:22":           Block,
+		"192.168.1.1:80":        Block,
+		"224.0.0.1:80":          Block,
+		"255.255.255.255:80":    Block,
+		"[::1]:80":              Block,
+		"[::ffff:127.0.0.1]:80": Block,
+		"[fe80::1]:80":          Block,
+		"[fd00::1]:80":          Block,
+		"[64:ff9b::a00:1]:80":   Block, // NAT64 of 10.0.0.1
+		"0.0.0.0:80":            Block,
+		"8.8.8.8:53":            Unknown,
+		"[2606:4700::1]:443":    Unknown,
+		"localhost:80":          Unknown, // checked after resolution
+	} {
+		tgt, _ := ParseTarget(addr)
+		if got := o.Match(tgt); got != want {
+			t.Errorf("%s: got %s, want %s", addr, got, want)
+		}
+	}
+
+	allow, _ := ParseCIDRs("192.168.1.0/24, 10.0.0.5")
+	deny, _ := ParseCIDRs("8.8.4.0/24")
+	allowPorts, _ := ParsePorts("22,80,443,8000-9000")
+	denyPorts, _ := ParsePorts("8080")
+	o = Outbound{Allow: allow, Deny: deny, AllowPorts: allowPorts, DenyPorts: denyPorts}
+	for addr, want := range map[string]Action{
+		"192.168.1.1:80":  Unknown,
+		"192.168.2.1:80":  Block,
+		"10.0.0.5:22":     Unknown,
+		"10.0.0.6:22":     Block,
+		"8.8.4.4:443":     Block,
+		"8.8.8.8:443":     Unknown,
+		"8.8.8.8:8500":    Unknown,
+		"8.8.8.8:8080":    Block,
+		"8.8.8.8:25":      Block,
+		"example.com:25":  Block,
+		"example.com:443": Unknown,
+	} {
+		tgt, _ := ParseTarget(addr)
+		if got := o.Match(tgt); got != want {
+			t.Errorf("%s: got %s, want %s", addr, got, want)
+		}
+	}
+
+	// an allowed range is still up to the rules after
+	tgt, _ := ParseTarget("192.168.1.1:80")
+	if got := (Matchers{&o, &Outbound{Deny: allow}}).Match(tgt); got != Block {
+		t.Errorf("allowed range then denied: got %s", got)
+	}
+
+	o = Outbound{AllowPrivate: true}
+	tgt, _ = ParseTarget("127.0.0.1:80")
+	if got := o.Match(tgt); got != Unknown {
+		t.Errorf("AllowPrivate: got %s", got)
+	}
+}
+
+func TestParseOutboundLists(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "10.0.0", "x/8"} {
+		if _, err := ParseCIDRs(list); err == nil {
+			t.Errorf("%q: no error", list)
+		}
+	}
+	for _, list := range []string{"70000", "9000-8000", "a-b", "-1"} {
+		if _, err := ParsePorts(list); err == nil {
+			t.Errorf("%q: no error", list)
+		}
+	}
+	ports, err := ParsePorts(" 80, 1000-2000 ,")
+	if err != nil || len(ports) != 2 || ports[1] != (PortRange{1000, 2000}) {
+		t.Errorf("got %v, %v", ports, err)
+	}
+}
@@ -0,0 +1,101 @@
+package rule
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"text/template"
+)
+
+var pacTemplate = template.Must(template.New("pac").Parse(`var proxy = {{.Proxy}};
+var proxyDomains = {{.ProxyDomains}};
+var proxyRegexps = compile({{.ProxyRegexps}});
+var directDomains = {{.DirectDomains}};
+var directRegexps = compile({{.DirectRegexps}});
+
+function compile(sources) {
+	var res = [];
+	for (var i = 0; i < sources.length; i++) {
+		res.push(new RegExp(sources[i]));
+	}
+	return res;
+}
+
+function matchDomain(domains, host) {
+	for (var h = host; ; ) {
+		if (domains.hasOwnProperty(h)) {
+			return true;
+		}
+		var i = h.indexOf(".");
+		if (i < 0) {
+			return false;
+		}
+		h = h.substring(i + 1);
+	}
+}
+
+function matchRegexps(res, url) {
+	for (var i = 0; i < res.length; i++) {
+		if (res[i].test(url)) {
+			return true;
+		}
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (matchDomain(directDomains, host) || matchRegexps(directRegexps, url)) {
+		return "DIRECT";
+	}
+	if (matchDomain(proxyDomains, host) || matchRegexps(proxyRegexps, url)) {
+		return proxy;
+	}
+	return "DIRECT";
+}
+`))
+
+// WritePAC writes a proxy auto-config script sending the targets of the list
+// to proxy, e.g. "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080".
+func (l *List) WritePAC(w io.Writer, proxy string) error {
+	proxyDomains, proxyRegexps := l.proxy.js()
+	directDomains, directRegexps := l.exceptions.js()
+	p, _ := json.Marshal(proxy)
+
+	return pacTemplate.Execute(w, map[string]string{
+		"Proxy":         string(p),
+		"ProxyDomains":  proxyDomains,
+		"ProxyRegexps":  proxyRegexps,
+		"DirectDomains": directDomains,
+		"DirectRegexps": directRegexps,
+	})
+}
+
+func (s *filterSet) js() (domains string, regexps string) {
+	// encoding/json sorts map keys, the output is stable
+	m := make(map[string]int, len(s.domains))
+	for k := range s.domains {
+		m[k] = 1
+	}
+	b, _ := json.Marshal(m)
+	domains = string(b)
+
+	r := make([]string, 0, len(s.regexps))
+	for _, re := range s.regexps {
+		r = append(r, re.String())
+	}
+	b, _ = json.Marshal(r)
+	regexps = string(b)
+	return
+}
+
+// PACHandler serves the PAC file of the list returned by list, which is
+// called on every request so that list updates are picked up.
+func PACHandler(list func() *List, proxy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		if err := list().WritePAC(w, proxy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package rule
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer/cachefile"
+)
+
+// ABPSource keeps a List loaded from Path and, if URL is set, refreshes it
+// from URL every Interval. Downloaded lists are saved to Path so the last good
+// copy is used on the next start.
+type ABPSource struct {
+	Path     string
+	URL      string
+	Interval time.Duration
+	Client   *http.Client // http.DefaultClient if nil
+
+	lock sync.RWMutex
+	list *List
+}
+
+func (s *ABPSource) List() *List {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.list == nil {
+		return &List{proxy: newFilterSet(), exceptions: newFilterSet()}
+	}
+	return s.list
+}
+
+func (s *ABPSource) Match(t *Target) Action {
+	s.lock.RLock()
+	l := s.list
+	s.lock.RUnlock()
+
+	if l == nil {
+		return Unknown
+	}
+	return l.Match(t)
+}
+
+func (s *ABPSource) set(l *List) {
+	s.lock.Lock()
+	s.list = l
+	s.lock.Unlock()
+
+	proxy, exceptions := l.Len()
+	log.Printf("rule: loaded %d filters and %d exceptions", proxy, exceptions)
+}
+
+// Load reads the list from Path.
+func (s *ABPSource) Load() error {
+	l, err := LoadABP(s.Path)
+	if err != nil {
+		return err
+	}
+	s.set(l)
+	return nil
+}
+
+// Refresh downloads the list from URL and saves it to Path. The current list
+// is kept if the download fails.
+func (s *ABPSource) Refresh() error {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: %s", s.URL, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	l, err := ParseABP(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if proxy, exceptions := l.Len(); proxy+exceptions == 0 {
+		return fmt.Errorf("get %s: no filters in list", s.URL)
+	}
+
+	if s.Path != "" {
+		if err := cachefile.Write(s.Path, b); err != nil {
+			log.Printf("rule: failed to save %s: %v", s.Path, err)
+		}
+	}
+	s.set(l)
+	return nil
+}
+
+// Run loads the list and keeps it up to date until ctx is done.
+func (s *ABPSource) Run(ctx context.Context) {
+	if s.Path != "" {
+		if err := s.Load(); err != nil && !os.IsNotExist(err) {
+			log.Printf("rule: failed to load %s: %v", s.Path, err)
+		}
+	}
+
+	if s.URL == "" {
+		return
+	}
+
+	for {
+		if err := s.Refresh(); err != nil {
+			log.Printf("rule: failed to refresh list: %v", err)
+		}
+
+		if s.Interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.Interval):
+		}
+	}
+}
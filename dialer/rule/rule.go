@@ -0,0 +1,143 @@
+// Package rule decides per target whether a connection goes direct, through
+// the proxy or is refused.
+package rule
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+)
+
+type Action int
+
+const (
+	Unknown Action = iota // no rule matched
+	Direct
+	Proxy
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Direct:
+		return "direct"
+	case Proxy:
+		return "proxy"
+	case Block:
+		return "block"
+	}
+	return "unknown"
+}
+
+var ErrBlocked = errors.New("target blocked by rule")
+
+// Target is the destination of a connection as seen by the rules.
+type Target struct {
+	Host string // domain name or IP literal
+	Port int
+	IP   net.IP // set when the address is known, Host may still be a domain
+}
+
+func ParseTarget(addr string) (*Target, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Target{Host: strings.ToLower(strings.TrimSuffix(host, ".")), Port: int(p)}
+	t.IP = net.ParseIP(host)
+	return t, nil
+}
+
+// HasDomain tells whether Host is a domain name rather than an IP literal.
+func (t *Target) HasDomain() bool {
+	return t.IP == nil || net.ParseIP(t.Host) == nil
+}
+
+func (t *Target) String() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+// URL is a stand-in for the URL being fetched, built only from what a SOCKS
+// server knows, so that URL based rules can be applied to a host and port.
+func (t *Target) URL() string {
+	scheme := "http"
+	if t.Port == 443 {
+		scheme = "https"
+	}
+
+	host := t.Host
+	if !t.HasDomain() && t.IP.To4() == nil {
+		host = "[" + host + "]"
+	}
+	if (scheme == "http" && t.Port != 80) || (scheme == "https" && t.Port != 443) {
+		host += ":" + strconv.Itoa(t.Port)
+	}
+	return scheme + "://" + host + "/"
+}
+
+type Matcher interface {
+	// Match returns Unknown if none of its rules apply to t.
+	Match(t *Target) Action
+}
+
+// Matchers tries each Matcher in turn, the first decision wins.
+type Matchers []Matcher
+
+func (ms Matchers) Match(t *Target) Action {
+	for _, m := range ms {
+		if a := m.Match(t); a != Unknown {
+			return a
+		}
+	}
+	return Unknown
+}
+
+// Router dials a target directly or through the proxy according to Rules.
+// Targets no rule decides on go through Fallback, or Proxy if Fallback is nil.
+type Router struct {
+	Rules    Matcher
+	Proxy    dialer.DialFunc
+	Direct   dialer.DialFunc
+	Fallback dialer.DialFunc
+}
+
+func (r *Router) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	return r.DialHost(network, addr, "", timeout)
+}
+
+// DialHost matches the rules against host, a domain name known for the IP
+// address addr, as well as the IP, but still connects to addr.
+func (r *Router) DialHost(network, addr, host string, timeout time.Duration) (net.Conn, error) {
+	t, err := ParseTarget(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		t.Host = strings.ToLower(host)
+	}
+
+	switch r.Rules.Match(t) {
+	case Direct:
+		return r.Direct(network, addr, timeout)
+	case Proxy:
+		return r.Proxy(network, addr, timeout)
+	case Block:
+		log.Printf("rule: %s blocked", addr)
+		return nil, ErrBlocked
+	}
+
+	if r.Fallback != nil {
+		return r.Fallback(network, addr, timeout)
+	}
+	return r.Proxy(network, addr, timeout)
+}
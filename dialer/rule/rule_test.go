@@ -0,0 +1,35 @@
+package rule
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouterDialHost(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader("[proxy_all]\n[bypass_list]\n(^|\\.)example\\.cn$\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var route string
+	dial := func(name string) func(string, string, time.Duration) (net.Conn, error) {
+		return func(network, addr string, timeout time.Duration) (net.Conn, error) {
+			route = name + " " + addr
+			return nil, errors.New("not connecting in test")
+		}
+	}
+	r := &Router{Rules: acl, Proxy: dial("proxy"), Direct: dial("direct")}
+
+	r.Dial("tcp", "203.0.113.1:443", time.Second)
+	if route != "proxy 203.0.113.1:443" {
+		t.Fatalf("got %s", route)
+	}
+
+	r.DialHost("tcp", "203.0.113.1:443", "www.Example.cn", time.Second)
+	if route != "direct 203.0.113.1:443" {
+		t.Fatalf("sniffed host not used by rules: %s", route)
+	}
+}
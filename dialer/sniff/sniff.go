@@ -0,0 +1,238 @@
+// Package sniff finds the domain name a client connects to in the first
+// bytes it sends: the SNI of a TLS ClientHello or the Host header of an
+// HTTP/1 request.
+package sniff
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout  = 300 * time.Millisecond
+	DefaultMaxBytes = 8 * 1024
+)
+
+// Domain returns the domain name found in b. more tells whether b looks like
+// the start of a ClientHello or an HTTP request that needs more bytes.
+func Domain(b []byte) (domain string, more bool) {
+	if len(b) == 0 {
+		return "", true
+	}
+	if b[0] == 0x16 {
+		return TLSServerName(b)
+	}
+	return HTTPHost(b)
+}
+
+// TLSServerName parses the server name extension of a ClientHello.
+func TLSServerName(b []byte) (name string, more bool) {
+	// record header: type, version, length
+	if len(b) < 5 {
+		return "", true
+	}
+	if b[0] != 0x16 || b[1] != 3 {
+		return "", false
+	}
+	recordLen := int(b[3])<<8 | int(b[4])
+	if len(b) < 5+recordLen {
+		return "", true
+	}
+	b = b[5 : 5+recordLen]
+
+	// handshake header: type, length
+	if len(b) < 4 || b[0] != 1 {
+		return "", false
+	}
+	helloLen := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[4:]
+	if helloLen < len(b) {
+		b = b[:helloLen]
+	}
+
+	// client version, random
+	if len(b) < 2+32 {
+		return "", false
+	}
+	b = b[2+32:]
+
+	var ok bool
+	if b, ok = skip(b, 1); !ok { // session id
+		return "", false
+	}
+	if b, ok = skip(b, 2); !ok { // cipher suites
+		return "", false
+	}
+	if b, ok = skip(b, 1); !ok { // compression methods
+		return "", false
+	}
+
+	if len(b) < 2 {
+		return "", false
+	}
+	extLen := int(b[0])<<8 | int(b[1])
+	b = b[2:]
+	if extLen < len(b) {
+		b = b[:extLen]
+	}
+
+	for len(b) >= 4 {
+		typ := int(b[0])<<8 | int(b[1])
+		n := int(b[2])<<8 | int(b[3])
+		b = b[4:]
+		if len(b) < n {
+			return "", false
+		}
+		ext := b[:n]
+		b = b[n:]
+
+		if typ != 0 { // server_name
+			continue
+		}
+
+		if len(ext) < 2 {
+			return "", false
+		}
+		list := ext[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			nameLen := int(list[1])<<8 | int(list[2])
+			list = list[3:]
+			if len(list) < nameLen {
+				return "", false
+			}
+			if nameType == 0 {
+				return strings.ToLower(string(list[:nameLen])), false
+			}
+			list = list[nameLen:]
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// skip skips a vector with a length prefix of n bytes.
+func skip(b []byte, n int) ([]byte, bool) {
+	if len(b) < n {
+		return nil, false
+	}
+	l := 0
+	for _, c := range b[:n] {
+		l = l<<8 | int(c)
+	}
+	if len(b) < n+l {
+		return nil, false
+	}
+	return b[n+l:], true
+}
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// HTTPHost parses the Host header of an HTTP/1 request.
+func HTTPHost(b []byte) (host string, more bool) {
+	sp := bytes.IndexByte(b, ' ')
+	if sp < 0 {
+		// the method may still be incomplete
+		for _, m := range httpMethods {
+			if len(b) < len(m) && strings.HasPrefix(m, string(b)) {
+				return "", true
+			}
+		}
+		return "", false
+	}
+
+	method := string(b[:sp])
+	known := false
+	for _, m := range httpMethods {
+		if m == method {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return "", false
+	}
+
+	complete := true
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		complete = false
+		end = len(b)
+	}
+
+	lines := bytes.Split(b[:end], []byte("\r\n"))
+	if !complete {
+		lines = lines[:len(lines)-1] // may be cut short
+	}
+	for i, line := range lines {
+		if i == 0 {
+			continue // request line
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon < 0 || !strings.EqualFold(string(line[:colon]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(line[colon+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(strings.Trim(host, "[]")), false
+	}
+
+	return "", !complete
+}
+
+// Peek reads the first bytes of c for at most timeout to find the domain
+// name. The returned conn reads the peeked bytes again before the rest of c.
+// Protocols where the server speaks first just cost timeout.
+func Peek(c net.Conn, timeout time.Duration, maxBytes int) (net.Conn, string) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	buf := make([]byte, 0, maxBytes)
+	var domain string
+	var rest io.Reader = c
+	more := true
+
+	c.SetReadDeadline(time.Now().Add(timeout))
+	for more && len(buf) < maxBytes {
+		n, err := c.Read(buf[len(buf):maxBytes])
+		buf = buf[:len(buf)+n]
+		if n > 0 {
+			domain, more = Domain(buf)
+		}
+		if err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				rest = errReader{err}
+			}
+			break
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+
+	return &peekedConn{Conn: c, r: io.MultiReader(bytes.NewReader(buf), rest)}, domain
+}
+
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(b []byte) (int, error) {
+	return 0, r.err
+}
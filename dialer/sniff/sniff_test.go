@@ -0,0 +1,116 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func clientHello(t *testing.T, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	go func() {
+		tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		c1.Close()
+	}()
+
+	b := make([]byte, 16*1024)
+	n, err := io.ReadAtLeast(c2, b, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordLen := int(b[3])<<8 | int(b[4])
+	if _, err := io.ReadFull(c2, b[n:5+recordLen]); err != nil && n < 5+recordLen {
+		t.Fatal(err)
+	}
+	return b[:5+recordLen]
+}
+
+func TestTLSServerName(t *testing.T) {
+	hello := clientHello(t, "WWW.Example.com")
+
+	if name, more := TLSServerName(hello); name != "www.example.com" || more {
+		t.Fatalf("got %q, %v", name, more)
+	}
+	if name, more := Domain(hello[:len(hello)/2]); name != "" || !more {
+		t.Fatalf("half a ClientHello: got %q, %v", name, more)
+	}
+	if name, _ := TLSServerName(clientHello(t, "")); name != "" {
+		t.Fatalf("ClientHello without SNI: got %q", name)
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	for req, want := range map[string]struct {
+		host string
+		more bool
+	}{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n":                         {"example.com", false},
+		"POST /x HTTP/1.1\r\nUser-Agent: t\r\nhost: Example.com:8080\r\n\r\n": {"example.com", false},
+		"GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n":                            {"::1", false},
+		"GET / HTTP/1.1\r\nHost: exam":                                        {"", true},
+		"GET / HTTP/1.1\r\nAccept: */*\r\n\r\n":                               {"", false},
+		"GE":                                                                  {"", true},
+		"SSH-2.0-OpenSSH_7.4\r\n":                                             {"", false},
+	} {
+		host, more := HTTPHost([]byte(req))
+		if host != want.host || more != want.more {
+			t.Errorf("%q: got %q, %v", req, host, more)
+		}
+	}
+}
+
+func TestPeek(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\nbody"
+	go func() {
+		// arrives in pieces
+		c2.Write([]byte(req[:10]))
+		time.Sleep(20 * time.Millisecond)
+		c2.Write([]byte(req[10:]))
+		c2.Close()
+	}()
+
+	c, domain := Peek(c1, time.Second, 0)
+	if domain != "example.com" {
+		t.Fatalf("got %q", domain)
+	}
+
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != req {
+		t.Fatalf("peeked bytes not replayed: %q", b)
+	}
+}
+
+func TestPeekServerSpeaksFirst(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	start := time.Now()
+	c, domain := Peek(c1, 50*time.Millisecond, 0)
+	if domain != "" {
+		t.Fatalf("got %q", domain)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("peek took %s", d)
+	}
+
+	go c2.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("got %q", b)
+	}
+}
@@ -0,0 +1,157 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/dialer/protocol"
+)
+
+// Config describes a shadowsocks server.
+type Config struct {
+	Name     string
+	Addr     string
+	Cipher   string
+	Password string
+	Weight   int
+}
+
+// ParseHop parses a hop to connect through, a socks5:// or http:// proxy url
+// or a shadowsocks server as ParseConfig does.
+func ParseHop(s, cipher, password string) (dialer.ClientProtocol, error) {
+	if strings.HasPrefix(s, "socks5://") || strings.HasPrefix(s, "socks5h://") || strings.HasPrefix(s, "http://") {
+		return protocol.ParseProxyURL(s)
+	}
+
+	sc, err := ParseConfig(s, cipher, password)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.SSProxyPrococol{Cipher: sc.Cipher, Password: sc.Password, ServerAddr: sc.Addr}, nil
+}
+
+// ParseConfig parses a server given as "host:port", as
+// "cipher:password@host:port", or as an ss:// URL (SIP002, or the older
+// ss://base64(cipher:password@host:port)). cipher and password are used when
+// the server does not have its own.
+func ParseConfig(s, cipher, password string) (*Config, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "ss://") {
+		return parseURL(s)
+	}
+
+	c := &Config{Addr: s, Cipher: cipher, Password: password}
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		userinfo := s[:i]
+		c.Addr = s[i+1:]
+		j := strings.IndexByte(userinfo, ':')
+		if j < 0 {
+			return nil, fmt.Errorf("server %q: expected cipher:password@host:port", s)
+		}
+		c.Cipher, c.Password = userinfo[:j], userinfo[j+1:]
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return nil, fmt.Errorf("server %q: %v", s, err)
+	}
+	c.Name = c.Addr
+	return c, nil
+}
+
+// ParseConfigs parses a comma separated list of servers.
+func ParseConfigs(list, cipher, password string) ([]*Config, error) {
+	var configs []*Config
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		c, err := ParseConfig(s, cipher, password)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+func parseURL(s string) (*Config, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var userinfo string
+	if u.User == nil {
+		// ss://base64(cipher:password@host:port)#name
+		b, err := decodeBase64(u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("server %q: %v", s, err)
+		}
+		i := strings.LastIndexByte(string(b), '@')
+		if i < 0 {
+			return nil, fmt.Errorf("server %q: no credentials", s)
+		}
+		userinfo = string(b[:i])
+		u.Host = string(b[i+1:])
+	} else if p, ok := u.User.Password(); ok {
+		// cipher and password in plain text, allowed for AEAD ciphers
+		userinfo = u.User.Username() + ":" + p
+	} else {
+		b, err := decodeBase64(u.User.Username())
+		if err != nil {
+			return nil, fmt.Errorf("server %q: %v", s, err)
+		}
+		userinfo = string(b)
+	}
+
+	i := strings.IndexByte(userinfo, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("server %q: expected cipher:password", s)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("server %q: no port", s)
+	}
+
+	c := &Config{
+		Name:     u.Fragment,
+		Addr:     u.Host,
+		Cipher:   userinfo[:i],
+		Password: userinfo[i+1:],
+	}
+	if c.Name == "" {
+		c.Name = c.Addr
+	}
+	return c, nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// ParseWeights sets the weights of configs from a comma separated list in
+// the same order.
+func ParseWeights(configs []*Config, list string) error {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	weights := strings.Split(list, ",")
+	if len(weights) != len(configs) {
+		return fmt.Errorf("%d weights for %d servers", len(weights), len(configs))
+	}
+	for i, w := range weights {
+		n, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid weight %q", w)
+		}
+		configs[i].Weight = n
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+// Package upstream spreads the client's connections over several servers,
+// moving on to the next one when a server fails.
+package upstream
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer"
+)
+
+const (
+	DefaultMinBackoff      = 5 * time.Second
+	DefaultMaxBackoff      = 5 * time.Minute
+	DefaultMaxReplayBuffer = 16 * 1024
+)
+
+var ErrNoServer = errors.New("no upstream server")
+
+// Server is one way to reach the targets, usually a shadowsocks server.
+type Server struct {
+	Name   string
+	Dial   dialer.DialFunc
+	Weight int    // for Weighted and Hash, 1 if 0
+	Close  func() // frees what Dial keeps once a Subscription drops the server, may be nil
+
+	active int32 // connections open through it
+
+	lock     sync.Mutex
+	failures int
+	retryAt  time.Time
+	status   Status
+}
+
+// Available tells whether the server is not backing off after a failure.
+func (s *Server) Available() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !time.Now().Before(s.retryAt)
+}
+
+func (s *Server) failed(err error, min, max time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failures++
+	backoff := max
+	if s.failures < 32 && min<<uint(s.failures-1) < max {
+		backoff = min << uint(s.failures-1)
+	}
+	s.retryAt = time.Now().Add(backoff)
+	log.Printf("upstream %s failed, retry in %s: %v", s.Name, backoff, err)
+}
+
+func (s *Server) succeeded() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.failures > 0 {
+		log.Printf("upstream %s is back", s.Name)
+	}
+	s.failures = 0
+	s.retryAt = time.Time{}
+}
+
+// Group dials through the first available server in order, the one a
+// Checker found to be fastest, or the one Strategy picks. If dialing fails,
+// or the first read fails before the application got any data, the bytes
+// written so far (up to MaxReplayBuffer) are replayed through the next one.
+// Once the server took them, they are only replayed if sending them twice
+// is harmless, see dialer.IsReplayable: a server closing without an answer
+// may have forwarded them to a target that did the same.
+// Failed servers back off exponentially between MinBackoff and MaxBackoff.
+type Group struct {
+	Strategy        Strategy
+	MinBackoff      time.Duration
+	MaxBackoff      time.Duration
+	MaxReplayBuffer int
+
+	lock      sync.RWMutex
+	servers   []*Server
+	preferred *Server // set by Checker
+}
+
+func NewGroup(servers []*Server) *Group {
+	return &Group{servers: servers}
+}
+
+func (g *Group) Servers() []*Server {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.servers
+}
+
+// SetServers replaces the servers, connections already made are kept.
+func (g *Group) SetServers(servers []*Server) {
+	g.lock.Lock()
+	g.servers = servers
+	if !g.contains(g.preferred) {
+		g.preferred = nil
+	}
+	g.lock.Unlock()
+}
+
+// candidates returns the servers to try in turn for addr: the available
+// ones first, in the order of Strategy or with the preferred one leading,
+// and those that failed health checks last, then those backing off, the
+// soonest to retry first.
+func (g *Group) candidates(addr string) []*Server {
+	g.lock.RLock()
+	servers, preferred := g.servers, g.preferred
+	g.lock.RUnlock()
+	if g.Strategy != nil {
+		preferred = nil
+	}
+
+	var available, unhealthy, waiting []*Server
+	first := preferred != nil && preferred.Available() && !preferred.unhealthy()
+	if first {
+		available = append(available, preferred)
+	}
+	for _, s := range servers {
+		switch {
+		case s == preferred && first:
+		case !s.Available():
+			waiting = append(waiting, s)
+		case s.unhealthy():
+			unhealthy = append(unhealthy, s)
+		default:
+			available = append(available, s)
+		}
+	}
+	if g.Strategy != nil && len(available) > 1 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		available = g.Strategy.Order(available, host)
+	}
+	available = append(available, unhealthy...)
+	sort.SliceStable(waiting, func(i, j int) bool {
+		waiting[i].lock.Lock()
+		a := waiting[i].retryAt
+		waiting[i].lock.Unlock()
+		waiting[j].lock.Lock()
+		b := waiting[j].retryAt
+		waiting[j].lock.Unlock()
+		return a.Before(b)
+	})
+	return append(available, waiting...)
+}
+
+func (g *Group) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	c := &conn{
+		g:          g,
+		network:    network,
+		addr:       addr,
+		timeout:    timeout,
+		candidates: g.candidates(addr),
+		replayable: true,
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.dialNext(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (g *Group) failed(s *Server, err error) {
+	min, max := g.MinBackoff, g.MaxBackoff
+	if min == 0 {
+		min = DefaultMinBackoff
+	}
+	if max == 0 {
+		max = DefaultMaxBackoff
+	}
+	s.failed(err, min, max)
+}
+
+func (g *Group) maxReplayBuffer() int {
+	if g.MaxReplayBuffer == 0 {
+		return DefaultMaxReplayBuffer
+	}
+	return g.MaxReplayBuffer
+}
+
+type conn struct {
+	net.Conn
+	g       *Group
+	network string
+	addr    string
+	timeout time.Duration
+
+	lock        sync.Mutex
+	server      *Server
+	candidates  []*Server // not tried yet
+	established bool      // the application read from it
+	replayable  bool
+	buf         []byte // written before established
+	writes      int
+	delivered   bool // a write of buf went through to the current server
+	switching   bool // dialNext is dialing or replaying without the lock
+	closed      bool
+
+	readDeadline, writeDeadline time.Time
+}
+
+var errClosed = errors.New("use of closed connection")
+
+// dialNext must be called with c.lock held, it dials the remaining
+// candidates until one connects and replays c.buf to it. The lock is
+// released while dialing and writing so that Close and the deadlines are
+// not held up by a stalled server, Write only buffers meanwhile.
+func (c *conn) dialNext() error {
+	c.switching = true
+	defer func() { c.switching = false }()
+
+	err := ErrNoServer
+	for len(c.candidates) > 0 && !c.closed {
+		s := c.candidates[0]
+		c.candidates = c.candidates[1:]
+
+		c.lock.Unlock()
+		rc, derr := s.Dial(c.network, c.addr, c.timeout)
+		c.lock.Lock()
+		if err = derr; err != nil {
+			c.g.failed(s, err)
+			continue
+		}
+		if c.closed {
+			rc.Close()
+			return errClosed
+		}
+
+		rc.SetReadDeadline(c.readDeadline)
+		rc.SetWriteDeadline(c.writeDeadline)
+		for written := 0; err == nil && written < len(c.buf) && !c.closed; {
+			b := c.buf[written:]
+			c.lock.Unlock()
+			_, err = rc.Write(b)
+			c.lock.Lock()
+			written += len(b)
+		}
+		if err != nil || c.closed {
+			rc.Close()
+			if err == nil {
+				return errClosed
+			}
+			c.g.failed(s, err)
+			continue
+		}
+
+		if c.Conn != nil {
+			c.Conn.Close()
+			atomic.AddInt32(&c.server.active, -1)
+		}
+		atomic.AddInt32(&s.active, 1)
+		c.Conn = rc
+		c.server = s
+		c.delivered = len(c.buf) > 0
+		return nil
+	}
+	if c.closed {
+		return errClosed
+	}
+	return err
+}
+
+// retry tells whether c may move on to the next server after err, read
+// before any data. That is when nothing reached the server, or what did is
+// harmless to send again: the server may have forwarded it and only closed
+// because the target did.
+func (c *conn) retry(err error) bool {
+	if err == nil || c.closed || !c.replayable || len(c.candidates) == 0 ||
+		(!c.readDeadline.IsZero() && isTimeout(err)) {
+		return false
+	}
+	if c.delivered && !(c.writes == 1 && dialer.IsReplayable(c.buf)) {
+		log.Printf("upstream %s: %s failed after the request was sent, not sending it again: %v", c.server.Name, c.addr, err)
+		return false
+	}
+	return true
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	rc, established := c.Conn, c.established
+	c.lock.Unlock()
+
+	if established {
+		return rc.Read(b)
+	}
+
+	for {
+		n, err := rc.Read(b)
+
+		c.lock.Lock()
+		if n > 0 {
+			if !c.established {
+				c.established = true
+				c.buf = nil
+				c.server.succeeded()
+			}
+			c.lock.Unlock()
+			return n, err
+		}
+		if rc != c.Conn || !c.retry(err) {
+			c.lock.Unlock()
+			return n, err
+		}
+
+		// the server may also close the connection because the target is
+		// down, so only errors other than EOF count against it
+		if err != io.EOF {
+			c.g.failed(c.server, err)
+		}
+		log.Printf("upstream %s: %s failed before any data, trying the next server: %v", c.server.Name, c.addr, err)
+		if derr := c.dialNext(); derr != nil {
+			c.lock.Unlock()
+			return 0, err
+		}
+		rc = c.Conn
+		c.lock.Unlock()
+	}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	c.writes++
+	if c.switching {
+		// dialNext replays it
+		c.buf = append(c.buf, b...)
+		c.lock.Unlock()
+		return len(b), nil
+	}
+	if c.established || !c.replayable || len(c.buf)+len(b) > c.g.maxReplayBuffer() {
+		c.replayable = false
+		c.buf = nil
+		rc := c.Conn
+		c.lock.Unlock()
+		return rc.Write(b)
+	}
+	c.buf = append(c.buf, b...)
+	rc := c.Conn
+	c.lock.Unlock()
+
+	// b is buffered before it is written, a Read moving to the next server
+	// meanwhile replays it there
+	_, err := rc.Write(b)
+
+	c.lock.Lock()
+	if rc == c.Conn {
+		if err == nil {
+			c.delivered = true
+		} else {
+			// b is kept for the next server, Read notices the broken connection
+			rc.Close()
+		}
+	}
+	c.lock.Unlock()
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		atomic.AddInt32(&c.server.active, -1)
+	}
+	return c.Conn.Close()
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
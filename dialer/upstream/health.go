@@ -0,0 +1,239 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCheckTarget   = "www.gstatic.com:80"
+	DefaultCheckInterval = time.Minute
+	DefaultCheckTimeout  = 5 * time.Second
+	DefaultFailThreshold = 2
+	DefaultSwitchMargin  = 0.2
+	rttSmoothing         = 0.3 // weight of a new sample in Status.RTT
+)
+
+// Status is what the health checks found out about a server.
+type Status struct {
+	Name      string
+	Checked   bool // false until the first probe finished
+	Healthy   bool
+	RTT       time.Duration // smoothed time to the first byte of the answer
+	LastRTT   time.Duration
+	LastCheck time.Time
+	LastError string
+	Failures  int // consecutive failed probes
+	Preferred bool
+}
+
+func (s *Server) Status() Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := s.status
+	st.Name = s.Name
+	return st
+}
+
+// unhealthy tells whether health checks found the server down.
+func (s *Server) unhealthy() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.status.Checked && !s.status.Healthy
+}
+
+func (s *Server) probed(rtt time.Duration, err error, failThreshold int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := &s.status
+	st.LastCheck = time.Now()
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+		if !st.Checked || st.Failures >= failThreshold {
+			if st.Healthy || !st.Checked {
+				log.Printf("upstream %s is unhealthy: %v", s.Name, err)
+			}
+			st.Healthy = false
+		}
+		st.Checked = true
+		return
+	}
+
+	if st.Checked && !st.Healthy {
+		log.Printf("upstream %s is healthy, %s", s.Name, rtt)
+	}
+	if st.RTT == 0 {
+		st.RTT = rtt
+	} else {
+		st.RTT = time.Duration(float64(st.RTT)*(1-rttSmoothing) + float64(rtt)*rttSmoothing)
+	}
+	st.Checked = true
+	st.Healthy = true
+	st.LastRTT = rtt
+	st.LastError = ""
+	st.Failures = 0
+
+	// a working server needs no back off
+	s.failures = 0
+	s.retryAt = time.Time{}
+}
+
+// Checker probes the servers of Group every Interval with a request to
+// Target through the server, timing the first byte of the answer. New
+// connections go to the healthy server with the lowest RTT, which only
+// changes when another one is faster by SwitchMargin (a fraction of the RTT)
+// or the current one becomes unhealthy. A server is unhealthy after
+// FailThreshold probes in a row failed.
+type Checker struct {
+	Group         *Group
+	Target        string
+	Request       []byte // an HTTP HEAD request to Target if nil
+	Interval      time.Duration
+	Timeout       time.Duration
+	FailThreshold int
+	SwitchMargin  float64
+}
+
+// Run checks the servers until ctx is done.
+func (c *Checker) Run(ctx context.Context) {
+	interval := c.Interval
+	if interval == 0 {
+		interval = DefaultCheckInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		c.Check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Check probes all servers once, in parallel, and picks the preferred one.
+func (c *Checker) Check() {
+	failThreshold := c.FailThreshold
+	if failThreshold == 0 {
+		failThreshold = DefaultFailThreshold
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range c.Group.Servers() {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			rtt, err := c.Probe(s)
+			s.probed(rtt, err, failThreshold)
+		}(s)
+	}
+	wg.Wait()
+
+	margin := c.SwitchMargin
+	if margin == 0 {
+		margin = DefaultSwitchMargin
+	}
+	c.Group.choose(margin)
+}
+
+// Probe connects to Target through s, sends Request and returns the time it
+// took until the first byte of the answer.
+func (c *Checker) Probe(s *Server) (time.Duration, error) {
+	target := c.Target
+	if target == "" {
+		target = DefaultCheckTarget
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultCheckTimeout
+	}
+	req := c.Request
+	if req == nil {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return 0, err
+		}
+		req = []byte(fmt.Sprintf("HEAD / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host))
+	}
+
+	start := time.Now()
+	rc, err := s.Dial("tcp", target, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	rc.SetDeadline(start.Add(timeout))
+	if _, err := rc.Write(req); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(rc, make([]byte, 1)); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Status returns the health of each server.
+func (g *Group) Status() []Status {
+	g.lock.RLock()
+	preferred := g.preferred
+	g.lock.RUnlock()
+
+	var st []Status
+	for _, s := range g.Servers() {
+		ss := s.Status()
+		ss.Preferred = s == preferred
+		st = append(st, ss)
+	}
+	return st
+}
+
+// choose makes the healthy server with the lowest RTT the preferred one,
+// unless the current one is healthy and not slower by more than margin.
+func (g *Group) choose(margin float64) {
+	var best *Server
+	var bestRTT time.Duration
+	for _, s := range g.Servers() {
+		st := s.Status()
+		if st.Healthy && (best == nil || st.RTT < bestRTT) {
+			best, bestRTT = s, st.RTT
+		}
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if best != nil && !g.contains(best) {
+		return // the servers changed meanwhile
+	}
+	cur := g.preferred
+	if cur != nil && cur != best && best != nil {
+		st := cur.Status()
+		if st.Healthy && float64(bestRTT) > float64(st.RTT)*(1-margin) {
+			return
+		}
+	}
+	if best != cur && best != nil {
+		log.Printf("upstream %s preferred, %s", best.Name, bestRTT)
+	}
+	g.preferred = best
+}
+
+// contains must be called with g.lock held.
+func (g *Group) contains(s *Server) bool {
+	for _, ss := range g.servers {
+		if ss == s {
+			return true
+		}
+	}
+	return false
+}
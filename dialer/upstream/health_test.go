@@ -0,0 +1,177 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer/protocol"
+	"github.com/FTwOoO/go-ss/dialer/rule"
+)
+
+// delayConn holds back the first byte it reads by delay.
+type delayConn struct {
+	net.Conn
+	delay func() time.Duration
+	once  sync.Once
+}
+
+func (c *delayConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.once.Do(func() { time.Sleep(c.delay()) })
+	return n, err
+}
+
+type delay struct {
+	lock sync.Mutex
+	d    time.Duration
+}
+
+func (d *delay) get() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.d
+}
+
+func (d *delay) set(v time.Duration) {
+	d.lock.Lock()
+	d.d = v
+	d.lock.Unlock()
+}
+
+// ssServer starts a shadowsocks server and returns stand-ins for it, each
+// adding its own delay to the first byte.
+func ssServer(t *testing.T, ctx context.Context) (newServer func(name string, d *delay) *Server) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ss := &protocol.SSProxyPrococol{
+		Cipher:   "AEAD_CHACHA20_POLY1305",
+		Password: "health",
+		Outbound: &rule.Outbound{AllowPrivate: true},
+	}
+	if err := ss.ServerListen(addr, net.Listen, nil, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return func(name string, d *delay) *Server {
+		client := &protocol.SSProxyPrococol{Cipher: ss.Cipher, Password: ss.Password, ServerAddr: addr}
+		dial := client.ClientWrapDial(func(network, addr string, timeout time.Duration) (net.Conn, error) {
+			c, err := net.DialTimeout(network, addr, timeout)
+			if err != nil {
+				return nil, err
+			}
+			return &delayConn{Conn: c, delay: d.get}, nil
+		})
+		return &Server{Name: name, Dial: dial}
+	}
+}
+
+// httpTarget answers every request with a status line.
+func httpTarget(t *testing.T) (addr string, stop func()) {
+	return listen(t, func(c net.Conn) {
+		defer c.Close()
+		c.Read(make([]byte, 1024))
+		c.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	})
+}
+
+func TestCheckerPrefersFastest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	target, stop := httpTarget(t)
+	defer stop()
+	newServer := ssServer(t, ctx)
+
+	fastDelay := &delay{d: 20 * time.Millisecond}
+	slowDelay := &delay{d: 150 * time.Millisecond}
+	fast := newServer("fast", fastDelay)
+	slow := newServer("slow", slowDelay)
+	dead := deadServer("dead")
+	g := NewGroup([]*Server{dead, slow, fast})
+
+	c := &Checker{Group: g, Target: target, Timeout: 2 * time.Second}
+	c.Check()
+
+	st := g.Status()
+	if !st[0].Checked || st[0].Healthy || st[0].LastError == "" {
+		t.Fatalf("dead: %+v", st[0])
+	}
+	if !st[1].Healthy || !st[2].Healthy {
+		t.Fatalf("slow: %+v, fast: %+v", st[1], st[2])
+	}
+	if st[2].RTT < 20*time.Millisecond || st[2].RTT >= st[1].RTT {
+		t.Fatalf("fast %s, slow %s", st[2].RTT, st[1].RTT)
+	}
+	if !st[2].Preferred {
+		t.Fatal("fast not preferred")
+	}
+	if cs := g.candidates(""); cs[0] != fast || cs[1] != slow {
+		t.Fatalf("candidates %s, %s", cs[0].Name, cs[1].Name)
+	}
+
+	// slow gets a bit faster than fast, not enough to switch
+	fastDelay.set(60 * time.Millisecond)
+	slowDelay.set(55 * time.Millisecond)
+	for i := 0; i < 8; i++ {
+		c.Check()
+		if !fast.Status().Preferred && g.Status()[1].Preferred {
+			t.Fatalf("switched to slow at %s vs %s", slow.Status().RTT, fast.Status().RTT)
+		}
+	}
+
+	slowDelay.set(5 * time.Millisecond)
+	for i := 0; i < 8; i++ {
+		c.Check()
+	}
+	if !g.Status()[1].Preferred {
+		t.Fatalf("slow not preferred at %s vs %s", slow.Status().RTT, fast.Status().RTT)
+	}
+
+	// the preferred server going down switches at once
+	g.SetServers([]*Server{dead, deadServer("slow is gone"), fast})
+	c.Check()
+	if cs := g.candidates(""); cs[0] != fast {
+		t.Fatalf("candidates start with %s", cs[0].Name)
+	}
+}
+
+func TestCheckerThreshold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	target, stop := httpTarget(t)
+	defer stop()
+	s := ssServer(t, ctx)("flaky", &delay{})
+	g := NewGroup([]*Server{s})
+	c := &Checker{Group: g, Target: target, Timeout: time.Second}
+
+	c.Check()
+	if !s.Status().Healthy {
+		t.Fatalf("%+v", s.Status())
+	}
+
+	dial := s.Dial
+	s.Dial = deadServer("").Dial
+	c.Check()
+	if st := s.Status(); !st.Healthy || st.Failures != 1 {
+		t.Fatalf("one failed probe: %+v", st)
+	}
+	c.Check()
+	if st := s.Status(); st.Healthy {
+		t.Fatalf("two failed probes: %+v", st)
+	}
+
+	s.Dial = dial
+	c.Check()
+	if st := s.Status(); !st.Healthy || st.Failures != 0 {
+		t.Fatalf("recovered: %+v", st)
+	}
+}
@@ -0,0 +1,172 @@
+package upstream
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy spreads connections over the servers of a Group. Order returns
+// servers, the available ones in configuration order, in the order to try
+// them for a connection to host.
+type Strategy interface {
+	Order(servers []*Server, host string) []*Server
+}
+
+func ParseStrategy(name string) (Strategy, error) {
+	switch strings.ToLower(name) {
+	case "", "failover":
+		return nil, nil
+	case "round-robin":
+		return &RoundRobin{}, nil
+	case "weighted":
+		return &Weighted{}, nil
+	case "least-conn":
+		return LeastConn{}, nil
+	case "hash":
+		return &Hash{}, nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %q", name)
+}
+
+func weight(s *Server) int {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+// RoundRobin starts each connection at the next server.
+type RoundRobin struct {
+	next uint32
+}
+
+func (r *RoundRobin) Order(servers []*Server, host string) []*Server {
+	i := int(atomic.AddUint32(&r.next, 1)-1) % len(servers)
+	return append(append([]*Server(nil), servers[i:]...), servers[:i]...)
+}
+
+// Weighted starts each connection at a server picked at random, in
+// proportion to its Weight.
+type Weighted struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func (w *Weighted) Order(servers []*Server, host string) []*Server {
+	total := 0
+	for _, s := range servers {
+		total += weight(s)
+	}
+
+	w.lock.Lock()
+	if w.rand == nil {
+		w.rand = rand.New(rand.NewSource(rand.Int63()))
+	}
+	n := w.rand.Intn(total)
+	w.lock.Unlock()
+
+	for i, s := range servers {
+		if n -= weight(s); n < 0 {
+			order := append([]*Server{s}, servers[:i]...)
+			return append(order, servers[i+1:]...)
+		}
+	}
+	return servers
+}
+
+// LeastConn starts each connection at the server with the fewest open ones.
+type LeastConn struct{}
+
+func (LeastConn) Order(servers []*Server, host string) []*Server {
+	order := append([]*Server(nil), servers...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return atomic.LoadInt32(&order[i].active) < atomic.LoadInt32(&order[j].active)
+	})
+	return order
+}
+
+const hashReplicas = 64 // points on the ring per unit of weight
+
+// Hash sends all connections to a host through the same server, so that
+// sites see one exit address. When a server goes away only the hosts it had
+// move to others.
+type Hash struct {
+	lock sync.Mutex
+	key  string // the names and weights ring was built for
+	ring []hashPoint
+}
+
+// hashPoint points at a server by its index, the ring is kept for a list of
+// the same names and weights even if the servers in it were replaced.
+type hashPoint struct {
+	hash  uint32
+	index int
+}
+
+func (h *Hash) Order(servers []*Server, host string) []*Server {
+	ring := h.ringFor(servers)
+
+	k := hashKey(host)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= k })
+
+	order := make([]*Server, 0, len(servers))
+	seen := make(map[*Server]bool, len(servers))
+	for j := 0; j < len(ring) && len(order) < len(servers); j++ {
+		s := servers[ring[(i+j)%len(ring)].index]
+		if !seen[s] {
+			seen[s] = true
+			order = append(order, s)
+		}
+	}
+	return order
+}
+
+func (h *Hash) ringFor(servers []*Server) []hashPoint {
+	var key strings.Builder
+	for _, s := range servers {
+		key.WriteString(s.Name)
+		key.WriteString("*")
+		key.WriteString(strconv.Itoa(weight(s)))
+		key.WriteString(",")
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.key == key.String() && h.ring != nil {
+		return h.ring
+	}
+
+	var ring []hashPoint
+	seen := make(map[string]int, len(servers))
+	for index, s := range servers {
+		// a second server of the same name gets points of its own
+		name := s.Name
+		if seen[s.Name]++; seen[s.Name] > 1 {
+			name += "/" + strconv.Itoa(seen[s.Name])
+		}
+		for i := 0; i < hashReplicas*weight(s); i++ {
+			k := hashKey(name + "#" + strconv.Itoa(i))
+			ring = append(ring, hashPoint{k, index})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].index < ring[j].index
+	})
+	h.key, h.ring = key.String(), ring
+	return ring
+}
+
+func hashKey(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,172 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func names(servers []*Server) string {
+	s := ""
+	for _, server := range servers {
+		s += server.Name
+	}
+	return s
+}
+
+func TestRoundRobin(t *testing.T) {
+	servers := []*Server{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	r := &RoundRobin{}
+	for _, want := range []string{"abc", "bca", "cab", "abc"} {
+		if got := names(r.Order(servers, "example.com")); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	servers := []*Server{{Name: "a", Weight: 3}, {Name: "b"}}
+	w := &Weighted{}
+	n := 0
+	for i := 0; i < 4000; i++ {
+		order := w.Order(servers, "example.com")
+		if len(order) != 2 {
+			t.Fatalf("got %s", names(order))
+		}
+		if order[0].Name == "a" {
+			n++
+		}
+	}
+	if n < 2800 || n > 3200 {
+		t.Fatalf("a first %d times out of 4000, want about 3000", n)
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	addr, stop := listen(t, echo)
+	defer stop()
+
+	a, b := server("a", addr), server("b", addr)
+	g := &Group{Strategy: LeastConn{}}
+	g.SetServers([]*Server{a, b})
+
+	dial := func() *conn {
+		c, err := g.Dial("tcp", "example.com:80", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.(*conn)
+	}
+
+	c1, c2 := dial(), dial()
+	if c1.server != a || c2.server != b {
+		t.Fatalf("got %s, %s", c1.server.Name, c2.server.Name)
+	}
+	c3, c4 := dial(), dial()
+	if c3.server != a || c4.server != b {
+		t.Fatalf("got %s, %s", c3.server.Name, c4.server.Name)
+	}
+	c1.Close()
+	c1.Close() // counted once
+	c3.Close()
+	if c5 := dial(); c5.server != a {
+		t.Fatalf("got %s, want a with two connections less", c5.server.Name)
+	}
+	if a.active != 1 || b.active != 2 {
+		t.Fatalf("active a %d, b %d", a.active, b.active)
+	}
+}
+
+func TestHash(t *testing.T) {
+	servers := []*Server{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	h := &Hash{}
+
+	first := make(map[string]*Server)
+	count := make(map[*Server]int)
+	for i := 0; i < 2000; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		order := h.Order(servers, host)
+		if len(order) != len(servers) {
+			t.Fatalf("got %s", names(order))
+		}
+		if again := h.Order(servers, host); again[0] != order[0] {
+			t.Fatalf("%s moved from %s to %s", host, order[0].Name, again[0].Name)
+		}
+		first[host] = order[0]
+		count[order[0]]++
+	}
+	for _, s := range servers {
+		if count[s] < 300 || count[s] > 700 {
+			t.Errorf("%s got %d of 2000 hosts", s.Name, count[s])
+		}
+	}
+
+	// without c only the hosts of c move, to the server that was next for them
+	rest := []*Server{servers[0], servers[1], servers[3]}
+	for host, s := range first {
+		got := h.Order(rest, host)[0]
+		if s != servers[2] && got != s {
+			t.Fatalf("%s moved from %s to %s", host, s.Name, got.Name)
+		}
+		if s == servers[2] && got != h.Order(servers, host)[1] {
+			t.Fatalf("%s moved to %s, not its second choice", host, got.Name)
+		}
+	}
+}
+
+func TestHashReplacedServers(t *testing.T) {
+	h := &Hash{}
+	old := []*Server{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	h.Order(old, "example.com")
+
+	// same names, new servers, as after a password change
+	servers := []*Server{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	for i := 0; i < 100; i++ {
+		for _, s := range h.Order(servers, fmt.Sprintf("host%d.example.com", i)) {
+			if s != servers[0] && s != servers[1] && s != servers[2] {
+				t.Fatalf("ordered a server not in the list: %p", s)
+			}
+		}
+	}
+
+	// servers of the same name share the hosts
+	twins := []*Server{{Name: "a"}, {Name: "a"}}
+	count := make(map[*Server]int)
+	for i := 0; i < 1000; i++ {
+		count[h.Order(twins, fmt.Sprintf("host%d.example.com", i))[0]]++
+	}
+	if count[twins[0]] < 300 || count[twins[1]] < 300 {
+		t.Fatalf("%d and %d of 1000 hosts on servers of the same name", count[twins[0]], count[twins[1]])
+	}
+}
+
+func TestGroupStrategyKeepsFailover(t *testing.T) {
+	addr, stop := listen(t, echo)
+	defer stop()
+
+	dead := deadServer("dead")
+	g := &Group{Strategy: &Hash{}}
+	g.SetServers([]*Server{dead, server("a", addr)})
+
+	for i := 0; i < 10; i++ {
+		c, err := g.Dial("tcp", fmt.Sprintf("host%d.example.com:443", i), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if dead.Available() {
+		t.Fatal("dead server not backing off")
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, name := range []string{"", "failover", "round-robin", "weighted", "least-conn", "hash"} {
+		if _, err := ParseStrategy(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := ParseStrategy("random"); err == nil {
+		t.Error("random: no error")
+	}
+}
@@ -0,0 +1,242 @@
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FTwOoO/go-ss/dialer/cachefile"
+)
+
+// sip008 is the online configuration format of SIP008.
+type sip008 struct {
+	Version int `json:"version"`
+	Servers []struct {
+		ID         string `json:"id"`
+		Remarks    string `json:"remarks"`
+		Server     string `json:"server"`
+		ServerPort int    `json:"server_port"`
+		Password   string `json:"password"`
+		Method     string `json:"method"`
+		Plugin     string `json:"plugin"`
+	} `json:"servers"`
+}
+
+// ParseSubscription parses a SIP008 JSON document, or a list of ss:// links
+// one per line, plain or base64 encoded. Servers needing a plugin and links
+// that do not parse are skipped.
+func ParseSubscription(b []byte) ([]*Config, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '{' {
+		var doc sip008
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+
+		var configs []*Config
+		for _, s := range doc.Servers {
+			if s.Plugin != "" {
+				log.Printf("upstream: skipping %s, plugin %s is not supported", s.Remarks, s.Plugin)
+				continue
+			}
+			if s.Server == "" || s.ServerPort == 0 || s.Method == "" {
+				return nil, fmt.Errorf("server %q: missing server, server_port or method", s.Remarks)
+			}
+			c := &Config{
+				Name:     s.Remarks,
+				Addr:     net.JoinHostPort(s.Server, strconv.Itoa(s.ServerPort)),
+				Cipher:   s.Method,
+				Password: s.Password,
+			}
+			if c.Name == "" {
+				c.Name = c.Addr
+			}
+			configs = append(configs, c)
+		}
+		return configs, nil
+	}
+
+	if !bytes.Contains(b, []byte("ss://")) {
+		d, err := decodeBase64(string(bytes.Join(bytes.Fields(b), nil)))
+		if err != nil || !bytes.Contains(d, []byte("ss://")) {
+			return nil, fmt.Errorf("neither SIP008 JSON nor a list of ss:// links")
+		}
+		b = d
+	}
+
+	var configs []*Config
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, "ss://") {
+			continue
+		}
+		if strings.Contains(line, "plugin=") {
+			log.Printf("upstream: skipping %s, plugins are not supported", linkHost(line))
+			continue
+		}
+		c, err := ParseConfig(line, "", "")
+		if err != nil {
+			// the error has the password in it
+			log.Printf("upstream: skipping %s, the link does not parse", linkHost(line))
+			continue
+		}
+		configs = append(configs, c)
+	}
+	return configs, s.Err()
+}
+
+// linkHost returns the host:port of an ss:// link for the logs, the rest of
+// the link holds the password, the whole of it in the legacy form.
+func linkHost(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.User == nil || u.Host == "" {
+		return "a server"
+	}
+	return u.Host
+}
+
+// Subscription keeps the servers of Group in line with the list at URL, an
+// http(s) URL or a local file, checked every Interval. The last good list is
+// saved to Path and loaded from there on start. Static servers come first.
+// Servers that did not change are kept with their state, connections through
+// the others stay open until they are done.
+type Subscription struct {
+	URL      string
+	Path     string
+	Interval time.Duration
+	Client   *http.Client // http.DefaultClient if nil
+
+	Group     *Group
+	Static    []*Server
+	NewServer func(*Config) *Server
+
+	lock    sync.Mutex
+	servers map[Config]*Server
+}
+
+// Load applies the list saved at Path.
+func (s *Subscription) Load() error {
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+	configs, err := ParseSubscription(b)
+	if err != nil {
+		return err
+	}
+	s.Apply(configs)
+	return nil
+}
+
+// Refresh fetches the list from URL, applies it and saves it to Path. The
+// current servers are kept if that fails.
+func (s *Subscription) Refresh() error {
+	b, err := s.fetch()
+	if err != nil {
+		return err
+	}
+
+	configs, err := ParseSubscription(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.URL, err)
+	}
+	if len(configs) == 0 {
+		return fmt.Errorf("%s: no servers in list", s.URL)
+	}
+
+	if s.Path != "" {
+		if err := cachefile.Write(s.Path, b); err != nil {
+			log.Printf("upstream: failed to save %s: %v", s.Path, err)
+		}
+	}
+	s.Apply(configs)
+	return nil
+}
+
+func (s *Subscription) fetch() ([]byte, error) {
+	if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+		return ioutil.ReadFile(s.URL)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: %s", s.URL, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Apply makes configs, after Static, the servers of Group. The servers no
+// longer listed are closed.
+func (s *Subscription) Apply(configs []*Config) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	servers := make(map[Config]*Server, len(configs))
+	list := append([]*Server(nil), s.Static...)
+	added := 0
+	for _, c := range configs {
+		if _, ok := servers[*c]; ok {
+			continue // listed twice
+		}
+		server, ok := s.servers[*c]
+		if !ok {
+			server = s.NewServer(c)
+			added++
+		}
+		servers[*c] = server
+		list = append(list, server)
+	}
+	removed := len(s.servers) - (len(servers) - added)
+
+	dropped := s.servers
+	s.servers = servers
+	s.Group.SetServers(list)
+	for c, server := range dropped {
+		if _, ok := servers[c]; !ok && server.Close != nil {
+			server.Close()
+		}
+	}
+	if added > 0 || removed > 0 {
+		log.Printf("upstream: %d servers, %d added, %d removed", len(servers), added, removed)
+	}
+}
+
+// Run keeps the list up to date until ctx is done, Load applies the saved
+// one until the first Refresh.
+func (s *Subscription) Run(ctx context.Context) {
+	for {
+		if err := s.Refresh(); err != nil {
+			log.Printf("upstream: failed to refresh servers: %v", err)
+		}
+
+		if s.Interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.Interval):
+		}
+	}
+}
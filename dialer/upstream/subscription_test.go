@@ -0,0 +1,170 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const sip008Doc = `{
+  "version": 1,
+  "servers": [
+    {"id": "1", "remarks": "Tokyo", "server": "127.0.0.1", "server_port": %s, "password": "a", "method": "chacha20-ietf-poly1305"},
+    {"id": "2", "remarks": "Osaka", "server": "::1", "server_port": 8388, "password": "b", "method": "aes-256-gcm"},
+    {"id": "3", "remarks": "Plugin", "server": "example.com", "server_port": 443, "password": "c", "method": "aes-256-gcm", "plugin": "v2ray-plugin"}
+  ],
+  "bytes_used": 1024
+}`
+
+func TestParseSubscription(t *testing.T) {
+	configs, err := ParseSubscription([]byte(`{"version": 1, "servers": [
+		{"remarks": "Osaka", "server": "::1", "server_port": 8388, "password": "b", "method": "aes-256-gcm"},
+		{"remarks": "Plugin", "server": "example.com", "server_port": 443, "password": "c", "method": "aes-256-gcm", "plugin": "obfs-local"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 || *configs[0] != (Config{Name: "Osaka", Addr: "[::1]:8388", Cipher: "aes-256-gcm", Password: "b"}) {
+		t.Fatalf("got %+v", configs)
+	}
+
+	links := "ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1\n" +
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.2:8888/?plugin=obfs-local#Plugin\n" +
+		"ss://YWVzLTEyOC1nY206dGVzdA@example.org#NoPort\n" +
+		"ss://aes-256-gcm:secret@example.com:443#Example2\n"
+	for _, b := range []string{links, base64.StdEncoding.EncodeToString([]byte(links))} {
+		configs, err := ParseSubscription([]byte(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(configs) != 2 || configs[0].Name != "Example1" || configs[1].Addr != "example.com:443" {
+			t.Fatalf("got %+v", configs)
+		}
+	}
+
+	for link, want := range map[string]string{
+		"ss://YWVzLTEyOC1nY206dGVzdA@example.org#NoPort":             "example.org",
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0QGV4YW1wbGUuY29tOjQ0Mw#Legacy": "a server",
+	} {
+		if got := linkHost(link); got != want {
+			t.Errorf("linkHost(%q) = %q, want %q", link, got, want)
+		}
+	}
+
+	for _, b := range []string{`{"servers": [{"server": "x"}]}`, "not a list", `{"servers": `} {
+		if _, err := ParseSubscription([]byte(b)); err == nil {
+			t.Errorf("%q: no error", b)
+		}
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	addr, stop := listen(t, echo)
+	defer stop()
+	_, port, _ := net.SplitHostPort(addr)
+
+	var lock sync.Mutex
+	doc := []byte(fmt.Sprintf(sip008Doc, port))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if doc == nil {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Write(doc)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "subscription")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var closed []string
+	newServer := func(c *Config) *Server {
+		return &Server{Name: c.Name, Dial: func(network, _ string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(network, c.Addr, timeout)
+		}, Close: func() { closed = append(closed, c.Name) }}
+	}
+
+	static := deadServer("static")
+	g := NewGroup(nil)
+	sub := &Subscription{
+		URL:       srv.URL,
+		Path:      filepath.Join(dir, "servers.json"),
+		Group:     g,
+		Static:    []*Server{static},
+		NewServer: newServer,
+	}
+	if err := sub.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(g.Servers()); got != "staticTokyoOsaka" {
+		t.Fatalf("got %s", got)
+	}
+	tokyo := g.Servers()[1]
+
+	// a live connection through Tokyo
+	c, err := g.Dial("tcp", "example.com:80", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "before", "before")
+
+	// Osaka goes away, Kyoto comes in
+	lock.Lock()
+	doc = []byte(`{"version": 1, "servers": [
+		{"remarks": "Kyoto", "server": "127.0.0.2", "server_port": 8388, "password": "d", "method": "aes-256-gcm"},
+		{"remarks": "Tokyo", "server": "127.0.0.1", "server_port": ` + port + `, "password": "a", "method": "chacha20-ietf-poly1305"}]}`)
+	lock.Unlock()
+	if err := sub.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(g.Servers()); got != "staticKyotoTokyo" {
+		t.Fatalf("got %s", got)
+	}
+	if g.Servers()[2] != tokyo {
+		t.Fatal("unchanged server was replaced")
+	}
+	if fmt.Sprint(closed) != "[Osaka]" {
+		t.Fatalf("closed %v", closed)
+	}
+	roundTrip(t, c, "after", "after")
+
+	// a failed refresh keeps the servers
+	lock.Lock()
+	doc = nil
+	lock.Unlock()
+	if err := sub.Refresh(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := names(g.Servers()); got != "staticKyotoTokyo" {
+		t.Fatalf("got %s", got)
+	}
+
+	// offline start from the saved list
+	g2 := NewGroup(nil)
+	sub2 := &Subscription{URL: srv.URL, Path: sub.Path, Group: g2, NewServer: newServer}
+	if err := sub2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(g2.Servers()); got != "KyotoTokyo" {
+		t.Fatalf("got %s", got)
+	}
+
+	// a local file works as well
+	sub3 := &Subscription{URL: sub.Path, Group: NewGroup(nil), NewServer: newServer}
+	if err := sub3.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+}
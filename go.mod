@@ -6,4 +6,5 @@ require (
 	github.com/FTwOoO/kcp-go v2.0.4-0.20180602030233-b203637efd51+incompatible
 	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da
 	golang.org/x/crypto v0.0.0-20190618222545-ea8f1a30c443
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
 )
@@ -3,15 +3,24 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/FTwOoO/go-ss/core"
+	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/dialer/connection"
+	"github.com/FTwOoO/go-ss/dialer/detour"
+	"github.com/FTwOoO/go-ss/dialer/fakedns"
+	"github.com/FTwOoO/go-ss/dialer/geoip"
 	"github.com/FTwOoO/go-ss/dialer/protocol"
-	"github.com/FTwOoO/kcp-go"
+	"github.com/FTwOoO/go-ss/dialer/resolve"
+	"github.com/FTwOoO/go-ss/dialer/rule"
+	"github.com/FTwOoO/go-ss/dialer/upstream"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -19,35 +28,291 @@ import (
 
 type ClientConfig struct {
 	*protocol.SSProxyPrococol
-	Detour bool
-	UseKcp bool
+
+	// tried in order when a server fails, SSProxyPrococol.ServerAddr is
+	// used alone if empty
+	Servers []*upstream.Config
+
+	// SOCKS5 or HTTP proxy the network forces connections through
+	Proxy dialer.ClientProtocol
+
+	// hops to reach the servers through, so they never see the client
+	Chain []dialer.ClientProtocol
+
+	// round-robin, weighted, least-conn or hash, failover in order if empty
+	Balance string
+
+	// SIP008 JSON or ss:// links at a URL or in a file, added to Servers and
+	// refreshed every SubscribeInterval, the last good copy kept in SubscribeCache
+	Subscribe         string
+	SubscribeCache    string
+	SubscribeInterval time.Duration
+
+	// probe the servers through to CheckTarget to prefer the fastest, off if 0
+	CheckInterval time.Duration
+	CheckTarget   string
+
+	Detour      bool
+	DetourCache string
+
+	// tcp if empty, kcp, or auto for sessions over both moving the traffic
+	// to kcp while tcp is lossy, kcp cannot go through Proxy
+	Transport string
+	KCP       *connection.KCPConfig
+
+	// AdBlock Plus style list (GFWList) of targets to proxy, the others go direct
+	ABPList         string
+	ABPListURL      string
+	ABPListInterval time.Duration
+	PACListen       string
+
+	ACL string // shadowsocks-libev acl file, reloaded on SIGHUP
+
+	// MaxMind country database, targets in GeoIPDirect countries go direct
+	GeoIP        string
+	GeoIPDirect  string
+	GeoIPProxy   string
+	GeoIPResolve bool
+
+	Sniff         bool
+	SniffOverride bool
+
+	// transparent proxy for connections redirected by iptables
+	RedirListen string
+	TProxy      bool
+
+	// fake-IP DNS server, the transparent and SOCKS inbounds send the
+	// domains back to the server instead of the fake IPs
+	FakeDNSListen   string
+	FakeDNSRange    string
+	FakeDNSCache    string
+	FakeDNSUpstream string
+
+	// hosts(5) style table pinning domains to addresses, and the policy for
+	// sending domains to the server or resolving them locally
+	Hosts           string
+	ResolvePolicies string
+	ResolveDefault  string
 }
 
 func StartClient(c *ClientConfig) context.CancelFunc {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	tcpDial := net.DialTimeout
-	kcpDial := func(network, address string, timeout time.Duration) (net.Conn, error) {
-		return kcp.Dial(address)
+	var dial dialer.DialFunc = net.DialTimeout
+
+	switch c.Transport {
+	case "", "tcp":
+	case "kcp":
+		dial = c.KCP.Dial
+	case "auto":
+		mc := connection.NewMultiConnectionManager(c.Password)
+		mc.KCP = c.KCP
+		mc.Scheduler = &connection.Adaptive{}
+		mc.Probe = connection.DefaultProbe
+		dial = mc.DialTimeout
+	default:
+		panic(fmt.Errorf("unknown transport %q", c.Transport))
 	}
 
-	var dial = tcpDial
+	if c.Proxy != nil {
+		if c.Transport == "kcp" || c.Transport == "auto" {
+			panic("kcp can not go through a proxy")
+		}
+		dial = c.Proxy.ClientWrapDial(dial)
+	}
 
-	if c.UseKcp {
-		dial = kcpDial
+	if len(c.Chain) > 0 {
+		dial = dialer.Chain(dial, c.Chain...)
+	}
+
+	var direct dialer.DialFunc = net.DialTimeout
+
+	if c.Hosts != "" || c.ResolvePolicies != "" || c.ResolveDefault != "" {
+		r, err := loadResolver(c.Hosts, c.ResolvePolicies, c.ResolveDefault)
+		if err != nil {
+			panic(err)
+		}
+		c.SSProxyPrococol.Resolver = r
+		direct = r.WrapDial(net.DialTimeout)
 	}
 
 	proxyDial := c.SSProxyPrococol.ClientWrapDial(dial)
+	if len(c.Servers) > 0 || c.Subscribe != "" {
+		newServer := func(sc *upstream.Config) *upstream.Server {
+			ss := &protocol.SSProxyPrococol{
+				Cipher:     sc.Cipher,
+				Password:   sc.Password,
+				ServerAddr: sc.Addr,
+				Resolver:   c.SSProxyPrococol.Resolver,
+				Mux:        c.SSProxyPrococol.Mux,
+				Pool:       c.SSProxyPrococol.Pool,
+			}
+			return &upstream.Server{
+				Name:   sc.Name,
+				Dial:   ss.ClientWrapDial(dial),
+				Weight: sc.Weight,
+				Close:  func() { ss.Close() },
+			}
+		}
+
+		var servers []*upstream.Server
+		for _, sc := range c.Servers {
+			servers = append(servers, newServer(sc))
+		}
+		group := upstream.NewGroup(servers)
+		proxyDial = group.Dial
 
-	if c.Detour == true { //deprecated
-		//proxyDial = detour.GenDial(proxyDial, net.DialTimeout)
+		strategy, err := upstream.ParseStrategy(c.Balance)
+		if err != nil {
+			panic(err)
+		}
+		group.Strategy = strategy
+
+		if c.Subscribe != "" {
+			sub := &upstream.Subscription{
+				URL:       c.Subscribe,
+				Path:      c.SubscribeCache,
+				Interval:  c.SubscribeInterval,
+				Group:     group,
+				Static:    servers,
+				NewServer: newServer,
+			}
+			// through the servers once there are some, through -proxy and
+			// -chain before, kcp only reaches the servers
+			bootstrap := dial
+			if c.Transport == "kcp" || c.Transport == "auto" {
+				bootstrap = dialer.Chain(direct, c.Chain...)
+			}
+			sub.Client = proxyHTTPClient(func(network, addr string, timeout time.Duration) (net.Conn, error) {
+				if len(group.Servers()) == 0 {
+					return bootstrap(network, addr, timeout)
+				}
+				return group.Dial(network, addr, timeout)
+			})
+			if c.SubscribeCache != "" {
+				if err := sub.Load(); err != nil && !os.IsNotExist(err) {
+					log.Printf("failed to load servers from %s: %v", c.SubscribeCache, err)
+				}
+			}
+			go sub.Run(ctx)
+		}
+
+		// health checks still keep unhealthy servers last with a strategy
+		if c.CheckInterval > 0 && (len(servers) > 1 || c.Subscribe != "") {
+			checker := &upstream.Checker{Group: group, Target: c.CheckTarget, Interval: c.CheckInterval}
+			go checker.Run(ctx)
+		}
+	}
+	socksDial := proxyDial
+
+	if c.Detour {
+		store := detour.NewStore(c.DetourCache)
+		if err := store.Load(); err != nil {
+			log.Printf("failed to load detour cache %s: %v", c.DetourCache, err)
+		}
+		go store.AutoSave(time.Minute, ctx.Done())
+
+		d := &detour.Detour{Proxy: proxyDial, Direct: direct, Store: store}
+		socksDial = d.Dial
+	}
+
+	var rules rule.Matchers
+	var fallback dialer.DialFunc = socksDial
+
+	if c.ACL != "" {
+		acl, err := rule.LoadACL(c.ACL)
+		if err != nil {
+			panic(err)
+		}
+		go acl.ReloadOnSignal(ctx, syscall.SIGHUP)
+		rules = append(rules, acl)
+	}
+
+	if c.ABPList != "" || c.ABPListURL != "" {
+		abp := &rule.ABPSource{
+			Path:     c.ABPList,
+			URL:      c.ABPListURL,
+			Interval: c.ABPListInterval,
+			Client:   proxyHTTPClient(proxyDial),
+		}
+		go abp.Run(ctx)
+		rules = append(rules, abp)
+
+		if !c.Detour {
+			fallback = direct
+		}
+
+		if c.PACListen != "" {
+			mux := http.NewServeMux()
+			proxy := "SOCKS5 " + c.ListenAddr + "; SOCKS " + c.ListenAddr
+			mux.Handle("/proxy.pac", rule.PACHandler(abp.List, proxy))
+			go func() {
+				log.Println(http.ListenAndServe(c.PACListen, mux))
+			}()
+		}
+	}
+
+	if c.GeoIP != "" {
+		db, err := geoip.Open(c.GeoIP)
+		if err != nil {
+			panic(err)
+		}
+		g := &rule.GeoIP{DB: db, Countries: make(map[string]rule.Action)}
+		rule.ParseCountries(g.Countries, c.GeoIPDirect, rule.Direct)
+		rule.ParseCountries(g.Countries, c.GeoIPProxy, rule.Proxy)
+		if c.GeoIPResolve {
+			g.Resolve = net.LookupIP
+			if r := c.SSProxyPrococol.Resolver; r != nil {
+				g.Resolve = r.Cache.LookupIP
+			}
+		}
+		rules = append(rules, g)
+	}
+
+	var pool *fakedns.Pool
+	if c.FakeDNSListen != "" {
+		var err error
+		pool, err = fakedns.NewPool(c.FakeDNSRange, c.FakeDNSCache)
+		if err != nil {
+			panic(err)
+		}
+		if err := pool.Load(); err != nil {
+			log.Printf("failed to load fake dns cache %s: %v", c.FakeDNSCache, err)
+		}
+		go pool.AutoSave(time.Minute, ctx.Done())
+
+		dns := &fakedns.Server{Pool: pool, Upstream: c.FakeDNSUpstream}
+		if _, err := dns.ListenAndServe(c.FakeDNSListen, ctx); err != nil {
+			panic(err)
+		}
 	}
 
-	_, err := protocol.SocksServer(c.ListenAddr, proxyDial, ctx)
+	socks := &protocol.SocksConfig{
+		Addr:          c.ListenAddr,
+		Dial:          socksDial,
+		Sniff:         c.Sniff,
+		SniffOverride: c.SniffOverride,
+		FakeDNS:       pool,
+	}
+
+	if len(rules) > 0 {
+		r := &rule.Router{Rules: rules, Proxy: proxyDial, Direct: direct, Fallback: fallback}
+		socks.Dial = r.Dial
+		socks.DialHost = r.DialHost
+	}
+
+	_, err := socks.Serve(ctx)
 
 	if err != nil {
 		panic(err)
 	}
+
+	if c.RedirListen != "" {
+		redir := &protocol.RedirConfig{Addr: c.RedirListen, Dial: socks.Dial, TProxy: c.TProxy, FakeDNS: pool}
+		if _, err := redir.Serve(ctx); err != nil {
+			panic(err)
+		}
+	}
 	//proxy_setup.InitSocksProxySetting(socksListenAddr, ctx)
 	return cancel
 }
@@ -57,32 +322,196 @@ func main() {
 	//systray.Run(onReady, onExit)
 
 	var flags struct {
-		ListenAddr string
-		Detour     bool
-		Server     string
-		Cipher     string
-		Password   string
+		ListenAddr  string
+		Detour      bool
+		DetourCache string
+		Server      string
+		Transport   string
+		KCPMode     string
+		Mux         bool
+		Pool        int
+		Cipher      string
+		Password    string
+
+		ABPList         string
+		ABPListURL      string
+		ABPListInterval time.Duration
+		PACListen       string
+		ACL             string
+
+		GeoIP        string
+		GeoIPDirect  string
+		GeoIPProxy   string
+		GeoIPResolve bool
+
+		Sniff         bool
+		SniffOverride bool
+
+		Chain             string
+		Proxy             string
+		Balance           string
+		Weights           string
+		Subscribe         string
+		SubscribeCache    string
+		SubscribeInterval time.Duration
+		CheckInterval     time.Duration
+		CheckTarget       string
+
+		RedirListen     string
+		TProxy          bool
+		FakeDNSListen   string
+		FakeDNSRange    string
+		FakeDNSCache    string
+		FakeDNSUpstream string
+
+		Hosts           string
+		ResolvePolicies string
+		ResolveDefault  string
 	}
 
-	flag.BoolVar(&flags.Detour, "detour", false, "client connect address or url")
-	flag.StringVar(&flags.Server, "server", "", "client connect address or url")
+	flag.BoolVar(&flags.Detour, "detour", false, "connect directly first, use the proxy for sites that look blocked")
+	flag.StringVar(&flags.DetourCache, "detour-cache", defaultCachePath("detour.json"), "file to remember blocked sites in, empty to keep them in memory")
+	flag.StringVar(&flags.Server, "server", "", "comma separated servers, host:port, cipher:password@host:port or ss:// url, tried in order")
 	flag.StringVar(&flags.ListenAddr, "listen", "", "client connect address or url")
+	flag.StringVar(&flags.Transport, "transport", "tcp", "transport to the servers: tcp, kcp, or auto for both, moving to kcp while tcp is lossy (the server needs auto too)")
+	kcpConfig := connection.DefaultKCPConfig("")
+	kcpFlags(kcpConfig, &flags.KCPMode)
+	muxConfig := connection.DefaultMuxConfig()
+	flag.BoolVar(&flags.Mux, "mux", false, "carry the connections as streams over a few to each server (the server needs -mux too)")
+	flag.IntVar(&muxConfig.MaxStreams, "mux-streams", muxConfig.MaxStreams, "streams per mux connection")
+	flag.IntVar(&muxConfig.Conns, "mux-conns", muxConfig.Conns, "mux connections per server")
+	flag.DurationVar(&muxConfig.KeepAlive, "mux-keepalive", muxConfig.KeepAlive, "how often to ping a mux connection, 0 to stop")
+	flag.DurationVar(&muxConfig.IdleTimeout, "mux-idle", muxConfig.IdleTimeout, "how long a mux connection without streams is kept, 0 to keep it")
+	poolConfig := connection.DefaultPoolConfig()
+	flag.IntVar(&flags.Pool, "pool", 0, "connections to each server to keep dialed ahead, 0 for none")
+	flag.DurationVar(&poolConfig.MaxIdle, "pool-idle", poolConfig.MaxIdle, "longest a pooled connection is kept, under the server's -target-timeout")
+	flag.DurationVar(&poolConfig.Active, "pool-active", poolConfig.Active, "how long the pool is kept full after the last connection")
 	flag.StringVar(&flags.Cipher, "cipher", "AEAD_CHACHA20_POLY1305", "available ciphers: "+strings.Join(core.ListCipher(), " "))
 	flag.StringVar(&flags.Password, "password", "", "password")
+	flag.StringVar(&flags.ABPList, "gfwlist", "", "AdBlock Plus style list (plain or base64) of sites to proxy, others go direct")
+	flag.StringVar(&flags.ABPListURL, "gfwlist-url", "", "url to download the list from, saved to the -gfwlist file")
+	flag.DurationVar(&flags.ABPListInterval, "gfwlist-interval", 24*time.Hour, "how often to download the list again, 0 to download once")
+	flag.StringVar(&flags.PACListen, "pac", "", "address to serve the list as http://<address>/proxy.pac")
+	flag.StringVar(&flags.ACL, "acl", "", "shadowsocks-libev acl file deciding bypass or proxy, reloaded on SIGHUP")
+	flag.StringVar(&flags.GeoIP, "geoip", "", "MaxMind country database (.mmdb)")
+	flag.StringVar(&flags.GeoIPDirect, "geoip-direct", "CN,private", "comma separated country codes (or private) to connect to directly")
+	flag.StringVar(&flags.GeoIPProxy, "geoip-proxy", "", "comma separated country codes to always proxy")
+	flag.BoolVar(&flags.GeoIPResolve, "geoip-resolve", false, "resolve domains locally to look up their country")
+	flag.BoolVar(&flags.Sniff, "sniff", false, "find the domain of IP targets in the TLS SNI or HTTP Host for rules and logs")
+	flag.BoolVar(&flags.SniffOverride, "sniff-override", false, "send the sniffed domain to the server instead of the IP")
+	flag.StringVar(&flags.Proxy, "proxy", "", "socks5:// or http:// proxy to connect to the servers through, env to take it from ALL_PROXY, HTTPS_PROXY or HTTP_PROXY")
+	flag.StringVar(&flags.Chain, "chain", "", "comma separated hops to reach the servers through in order, ss://, socks5:// or http:// urls")
+	flag.StringVar(&flags.Balance, "balance", "", "spread connections over the servers: round-robin, weighted, least-conn or hash (by target host), in order if empty")
+	flag.StringVar(&flags.Weights, "weights", "", "comma separated weights of the servers for -balance weighted or hash")
+	flag.StringVar(&flags.Subscribe, "subscribe", "", "url or file of a SIP008 server list or ss:// links to add to -server")
+	flag.StringVar(&flags.SubscribeCache, "subscribe-cache", defaultCachePath("servers.txt"), "file to keep the last good server list in")
+	flag.DurationVar(&flags.SubscribeInterval, "subscribe-interval", time.Hour, "how often to fetch the server list again, 0 to fetch once")
+	flag.DurationVar(&flags.CheckInterval, "check-interval", upstream.DefaultCheckInterval, "how often to probe the servers to prefer the fastest, 0 to stop")
+	flag.StringVar(&flags.CheckTarget, "check-target", upstream.DefaultCheckTarget, "host:port the probes connect to through each server")
+	flag.StringVar(&flags.RedirListen, "redir", "", "transparent proxy address for connections redirected by iptables (linux)")
+	flag.BoolVar(&flags.TProxy, "tproxy", false, "the -redir address receives TPROXY connections instead of REDIRECT")
+	flag.StringVar(&flags.FakeDNSListen, "fakedns", "", "address to serve fake-IP DNS on, e.g. 127.0.0.1:5353")
+	flag.StringVar(&flags.FakeDNSRange, "fakedns-range", fakedns.DefaultRange, "IPv4 range to hand out fake IPs from")
+	flag.StringVar(&flags.FakeDNSCache, "fakedns-cache", defaultCachePath("fakedns.json"), "file to keep the fake IPs in across restarts, empty to keep them in memory")
+	flag.StringVar(&flags.FakeDNSUpstream, "fakedns-upstream", "", "DNS server for queries other than A and AAAA, e.g. 8.8.8.8:53")
+	flag.StringVar(&flags.Hosts, "hosts", "", "hosts(5) style file pinning domains to addresses")
+	flag.StringVar(&flags.ResolvePolicies, "resolve-rules", "", "file of \"<domain> <policy>\" lines, policy is one of remote, local, prefer-ipv4, prefer-ipv6")
+	flag.StringVar(&flags.ResolveDefault, "resolve", "", "policy for domains without a rule, remote if empty")
 	flag.Parse()
 
+	servers, err := upstream.ParseConfigs(flags.Server, flags.Cipher, flags.Password)
+	if err != nil {
+		panic(err)
+	}
+	if err := upstream.ParseWeights(servers, flags.Weights); err != nil {
+		panic(err)
+	}
+
+	if kcpConfig.Key == "" {
+		kcpConfig.Key = flags.Password
+	}
+	if err := kcpConfig.SetMode(flags.KCPMode); err != nil {
+		panic(err)
+	}
+
+	var proxy dialer.ClientProtocol
+	switch flags.Proxy {
+	case "":
+	case "env":
+		p, err := protocol.ProxyFromEnvironment()
+		if err != nil {
+			panic(err)
+		}
+		if p != nil {
+			proxy = p
+		}
+	default:
+		if proxy, err = protocol.ParseProxyURL(flags.Proxy); err != nil {
+			panic(err)
+		}
+	}
+
+	var chain []dialer.ClientProtocol
+	for _, h := range strings.Split(flags.Chain, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		hop, err := upstream.ParseHop(h, flags.Cipher, flags.Password)
+		if err != nil {
+			panic(err)
+		}
+		chain = append(chain, hop)
+	}
+
 	shadowsocks := &protocol.SSProxyPrococol{
 		Cipher:     flags.Cipher,
 		Password:   flags.Password,
 		ServerAddr: flags.Server,
 		ListenAddr: flags.ListenAddr,
 	}
+	if flags.Mux {
+		shadowsocks.Mux = muxConfig
+	}
+	if flags.Pool > 0 {
+		poolConfig.Size = flags.Pool
+		shadowsocks.Pool = poolConfig
+	}
 
-	//fmt.Printf("detour flag: %v", flags.Detour)
-	//os.Exit(1)
 	cancel := StartClient(&ClientConfig{
-		SSProxyPrococol: shadowsocks,
-		Detour:          flags.Detour,
+		SSProxyPrococol:   shadowsocks,
+		Servers:           servers,
+		Chain:             chain,
+		Proxy:             proxy,
+		Balance:           flags.Balance,
+		Subscribe:         flags.Subscribe,
+		SubscribeCache:    flags.SubscribeCache,
+		SubscribeInterval: flags.SubscribeInterval,
+		CheckInterval:     flags.CheckInterval,
+		CheckTarget:       flags.CheckTarget,
+		Detour:            flags.Detour,
+		DetourCache:       flags.DetourCache,
+		Transport:         flags.Transport,
+		KCP:               kcpConfig,
+		ABPList:           flags.ABPList,
+		ABPListURL:        flags.ABPListURL,
+		ABPListInterval:   flags.ABPListInterval,
+		PACListen:         flags.PACListen,
+		ACL:               flags.ACL,
+		GeoIP:             flags.GeoIP,
+		GeoIPDirect:       flags.GeoIPDirect,
+		GeoIPProxy:        flags.GeoIPProxy,
+		GeoIPResolve:      flags.GeoIPResolve,
+		Sniff:             flags.Sniff,
+		SniffOverride:     flags.SniffOverride,
+		RedirListen:       flags.RedirListen,
+		TProxy:            flags.TProxy,
+		FakeDNSListen:     flags.FakeDNSListen,
+		FakeDNSRange:      flags.FakeDNSRange,
+		FakeDNSCache:      flags.FakeDNSCache,
+		FakeDNSUpstream:   flags.FakeDNSUpstream,
+		Hosts:             flags.Hosts,
+		ResolvePolicies:   flags.ResolvePolicies,
+		ResolveDefault:    flags.ResolveDefault,
 	})
 
 	go func() {
@@ -99,3 +528,65 @@ func main() {
 	time.Sleep(3 * time.Second)
 	log.Printf("program exit")
 }
+
+// defaultCachePath returns where the client keeps name across restarts,
+// empty to keep it in memory if there is no home directory.
+func defaultCachePath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gsc", name)
+}
+
+func loadResolver(hosts, policies, def string) (r *resolve.Resolver, err error) {
+	r = &resolve.Resolver{Cache: &resolve.Cache{}}
+
+	if hosts != "" {
+		if r.Hosts, err = resolve.LoadHosts(hosts); err != nil {
+			return nil, err
+		}
+	}
+	if policies != "" {
+		if r.Policies, err = resolve.LoadPolicies(policies); err != nil {
+			return nil, err
+		}
+	}
+	if def != "" {
+		if r.Default, err = resolve.ParsePolicy(def); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// proxyHTTPClient fetches through the proxy, the lists are usually hosted on
+// blocked sites.
+func proxyHTTPClient(dial dialer.DialFunc) *http.Client {
+	return &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return dial(network, addr, 10*time.Second)
+			},
+		},
+	}
+}
+
+// kcpFlags registers the flags tuning c, the server has the same ones. The
+// timing flags only count with -kcp-mode manual.
+func kcpFlags(c *connection.KCPConfig, mode *string) {
+	flag.StringVar(mode, "kcp-mode", "fast", "kcp preset: "+strings.Join(connection.KCPModes, ", ")+" or manual")
+	flag.IntVar(&c.NoDelay, "kcp-nodelay", c.NoDelay, "kcp nodelay with -kcp-mode manual")
+	flag.IntVar(&c.Interval, "kcp-interval", c.Interval, "kcp interval in ms with -kcp-mode manual")
+	flag.IntVar(&c.Resend, "kcp-resend", c.Resend, "kcp fast resend with -kcp-mode manual")
+	flag.IntVar(&c.NoCongestion, "kcp-nc", c.NoCongestion, "1 to turn kcp congestion control off with -kcp-mode manual")
+	flag.IntVar(&c.SndWnd, "kcp-sndwnd", c.SndWnd, "kcp send window in packets")
+	flag.IntVar(&c.RcvWnd, "kcp-rcvwnd", c.RcvWnd, "kcp receive window in packets")
+	flag.IntVar(&c.MTU, "kcp-mtu", c.MTU, "kcp mtu, the same as the server's")
+	flag.IntVar(&c.DataShard, "kcp-datashard", c.DataShard, "reed-solomon data shards, 0 to turn FEC off, the same as the server's")
+	flag.IntVar(&c.ParityShard, "kcp-parityshard", c.ParityShard, "reed-solomon parity shards, the same as the server's")
+	flag.IntVar(&c.DSCP, "kcp-dscp", c.DSCP, "DSCP of the kcp packets, e.g. 46 for EF")
+	flag.StringVar(&c.Crypt, "kcp-crypt", c.Crypt, "kcp block crypt: none, "+strings.Join(connection.KCPCrypts, ", "))
+	flag.StringVar(&c.Key, "kcp-key", "", "kcp crypt key, -password if empty")
+}
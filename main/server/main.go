@@ -3,9 +3,15 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/FTwOoO/go-ss/core"
 	"github.com/FTwOoO/go-ss/dialer"
+	"github.com/FTwOoO/go-ss/dialer/connection"
+	"github.com/FTwOoO/go-ss/dialer/geoip"
+	"github.com/FTwOoO/go-ss/dialer/outbound"
 	"github.com/FTwOoO/go-ss/dialer/protocol"
+	"github.com/FTwOoO/go-ss/dialer/rule"
+	"github.com/FTwOoO/go-ss/dialer/upstream"
 	"log"
 	"net"
 	"os"
@@ -19,38 +25,164 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	var flags struct {
-		Server   string
-		Cipher   string
-		Password string
-		Socks    string
+		Server        string
+		Transport     string
+		KCPMode       string
+		Mux           bool
+		TargetTimeout time.Duration
+		Cipher        string
+		Password      string
+		Socks         string
+		ACL           string
+
+		GeoIP      string
+		GeoIPBlock string
+
+		OutboundAllowPrivate bool
+		OutboundAllow        string
+		OutboundDeny         string
+		OutboundAllowPorts   string
+		OutboundDenyPorts    string
+
+		Bind        string
+		Interface   string
+		Family      string
+		Exit        string
+		Upstream    string
+		UpstreamACL string
 	}
 
 	flag.StringVar(&flags.Server, "server", "", "server add to listen")
+	flag.StringVar(&flags.Transport, "transport", "tcp", "comma separated transports to listen with: tcp, kcp (on the udp port of -server), or auto alone for clients with -transport auto")
+	kcpConfig := connection.DefaultKCPConfig("")
+	kcpFlags(kcpConfig, &flags.KCPMode)
+	muxConfig := connection.DefaultMuxConfig()
+	flag.BoolVar(&flags.Mux, "mux", false, "accept clients carrying their connections as streams with -mux")
+	flag.IntVar(&muxConfig.MaxStreams, "mux-streams", muxConfig.MaxStreams, "streams a client may open per mux connection")
+	flag.DurationVar(&muxConfig.KeepAlive, "mux-keepalive", muxConfig.KeepAlive, "how often to ping a mux connection, 0 to stop")
+	flag.DurationVar(&flags.TargetTimeout, "target-timeout", protocol.DefaultTargetTimeout, "how long a client may take to send its target, over the -pool-idle of clients")
 	flag.StringVar(&flags.Cipher, "cipher", "AEAD_CHACHA20_POLY1305", "available ciphers: "+strings.Join(core.ListCipher(), " "))
 	flag.StringVar(&flags.Password, "password", "", "password")
+	flag.StringVar(&flags.ACL, "acl", "", "shadowsocks-libev acl file, reloaded on SIGHUP")
+	flag.StringVar(&flags.GeoIP, "geoip", "", "MaxMind country database (.mmdb)")
+	flag.StringVar(&flags.GeoIPBlock, "geoip-block", "", "comma separated country codes (or private) the server refuses to connect to")
+	flag.BoolVar(&flags.OutboundAllowPrivate, "outbound-allow-private", false, "let clients reach loopback, private and link-local addresses")
+	flag.StringVar(&flags.OutboundAllow, "outbound-allow", "", "comma separated CIDRs clients may reach even if private")
+	flag.StringVar(&flags.OutboundDeny, "outbound-deny", "", "comma separated CIDRs clients may not reach")
+	flag.StringVar(&flags.OutboundAllowPorts, "outbound-allow-ports", "", "comma separated ports or ranges (e.g. 80,443,8000-9000) clients may reach, all if empty")
+	flag.StringVar(&flags.OutboundDenyPorts, "outbound-deny-ports", "", "comma separated ports or ranges clients may not reach, e.g. 25")
+	flag.StringVar(&flags.Bind, "bind", "", "comma separated source addresses to connect to targets from, one IPv4 and one IPv6")
+	flag.StringVar(&flags.Interface, "interface", "", "network interface to connect to targets through (linux)")
+	flag.StringVar(&flags.Family, "family", "", "addresses of targets to use: prefer-ipv4, prefer-ipv6, ipv4 or ipv6, any if empty")
+	flag.StringVar(&flags.Exit, "exit", "", "comma separated <client cidr>=<source addresses joined by +, or interface>, e.g. 10.8.0.0/16=203.0.113.5")
+	flag.StringVar(&flags.Upstream, "upstream", "", "socks5://, http:// or ss:// proxy to connect to targets through")
+	flag.StringVar(&flags.UpstreamACL, "upstream-acl", "", "shadowsocks-libev acl file, targets in its proxy list go through -upstream, all if empty")
 	flag.Parse()
 
-	var shadowsocks dialer.ProxyProtocol = &protocol.SSProxyPrococol{
-		Cipher:   flags.Cipher,
-		Password: flags.Password,
+	ss := &protocol.SSProxyPrococol{
+		Cipher:        flags.Cipher,
+		Password:      flags.Password,
+		TargetTimeout: flags.TargetTimeout,
+	}
+	if flags.Mux {
+		ss.Mux = muxConfig
 	}
 
-	err := shadowsocks.ServerListen(flags.Server, net.Listen, nil, ctx)
-	if err != nil {
+	if flags.ACL != "" {
+		acl, err := rule.LoadACL(flags.ACL)
+		if err != nil {
+			panic(err)
+		}
+		ss.ACL = acl
+		go acl.ReloadOnSignal(ctx, syscall.SIGHUP)
+	}
+
+	targets := &rule.Outbound{AllowPrivate: flags.OutboundAllowPrivate}
+	var err error
+	if targets.Allow, err = rule.ParseCIDRs(flags.OutboundAllow); err != nil {
+		panic(err)
+	}
+	if targets.Deny, err = rule.ParseCIDRs(flags.OutboundDeny); err != nil {
+		panic(err)
+	}
+	if targets.AllowPorts, err = rule.ParsePorts(flags.OutboundAllowPorts); err != nil {
 		panic(err)
 	}
+	if targets.DenyPorts, err = rule.ParsePorts(flags.OutboundDenyPorts); err != nil {
+		panic(err)
+	}
+	rules := rule.Matchers{targets}
+
+	if flags.GeoIP != "" {
+		db, err := geoip.Open(flags.GeoIP)
+		if err != nil {
+			panic(err)
+		}
+		g := &rule.GeoIP{DB: db, Countries: make(map[string]rule.Action)}
+		rule.ParseCountries(g.Countries, flags.GeoIPBlock, rule.Block)
+		rules = append(rules, g)
+	}
+	ss.Outbound = rules
 
-	/*
+	out := &outbound.Dialer{Source: outbound.Source{Interface: flags.Interface}}
+	if out.IPs, err = outbound.ParseIPs(flags.Bind); err != nil {
+		panic(err)
+	}
+	if out.Family, err = outbound.ParseFamily(flags.Family); err != nil {
+		panic(err)
+	}
+	if out.Users, err = outbound.ParseUsers(flags.Exit); err != nil {
+		panic(err)
+	}
+	if flags.Upstream != "" {
+		hop, err := upstream.ParseHop(flags.Upstream, flags.Cipher, flags.Password)
+		if err != nil {
+			panic(err)
+		}
+		out.Upstream = hop.ClientWrapDial(net.DialTimeout)
 
-		kcpListen :=  func(net, laddr string) (net.Listener, error) {
-			return kcp.Listen(laddr)
-		}*/
+		if flags.UpstreamACL != "" {
+			acl, err := rule.LoadACL(flags.UpstreamACL)
+			if err != nil {
+				panic(err)
+			}
+			out.Rules = acl
+			go acl.ReloadOnSignal(ctx, syscall.SIGHUP)
+		}
+	}
 
-	err = shadowsocks.ServerListen(flags.Server, net.Listen, nil, ctx)
-	if err != nil {
+	if kcpConfig.Key == "" {
+		kcpConfig.Key = flags.Password
+	}
+	if err := kcpConfig.SetMode(flags.KCPMode); err != nil {
 		panic(err)
 	}
 
+	var shadowsocks dialer.ProxyProtocol = ss
+
+	for _, t := range strings.Split(flags.Transport, ",") {
+		var listen func(network, laddr string) (net.Listener, error)
+		switch strings.TrimSpace(t) {
+		case "tcp":
+			listen = net.Listen
+		case "kcp":
+			listen = kcpConfig.Listen
+		case "auto":
+			mc := connection.NewMultiConnectionManager(flags.Password)
+			mc.KCP = kcpConfig
+			mc.SessionScheduler = func() connection.Scheduler { return &connection.Adaptive{} }
+			mc.Probe = connection.DefaultProbe
+			listen = mc.Listen
+		default:
+			panic(fmt.Errorf("unknown transport %q", t))
+		}
+
+		err = shadowsocks.ServerListen(flags.Server, listen, nil, ctx, dialer.WithOutbound(out))
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGIO, syscall.SIGABRT)
 	signalMsg := <-quit
@@ -61,3 +193,21 @@ func main() {
 	time.Sleep(3 * time.Second)
 	log.Printf("program exit")
 }
+
+// kcpFlags registers the flags tuning c, the client has the same ones. The
+// timing flags only count with -kcp-mode manual.
+func kcpFlags(c *connection.KCPConfig, mode *string) {
+	flag.StringVar(mode, "kcp-mode", "fast", "kcp preset: "+strings.Join(connection.KCPModes, ", ")+" or manual")
+	flag.IntVar(&c.NoDelay, "kcp-nodelay", c.NoDelay, "kcp nodelay with -kcp-mode manual")
+	flag.IntVar(&c.Interval, "kcp-interval", c.Interval, "kcp interval in ms with -kcp-mode manual")
+	flag.IntVar(&c.Resend, "kcp-resend", c.Resend, "kcp fast resend with -kcp-mode manual")
+	flag.IntVar(&c.NoCongestion, "kcp-nc", c.NoCongestion, "1 to turn kcp congestion control off with -kcp-mode manual")
+	flag.IntVar(&c.SndWnd, "kcp-sndwnd", c.SndWnd, "kcp send window in packets")
+	flag.IntVar(&c.RcvWnd, "kcp-rcvwnd", c.RcvWnd, "kcp receive window in packets")
+	flag.IntVar(&c.MTU, "kcp-mtu", c.MTU, "kcp mtu")
+	flag.IntVar(&c.DataShard, "kcp-datashard", c.DataShard, "reed-solomon data shards, 0 to turn FEC off")
+	flag.IntVar(&c.ParityShard, "kcp-parityshard", c.ParityShard, "reed-solomon parity shards")
+	flag.IntVar(&c.DSCP, "kcp-dscp", c.DSCP, "DSCP of the kcp packets, e.g. 46 for EF")
+	flag.StringVar(&c.Crypt, "kcp-crypt", c.Crypt, "kcp block crypt: none, "+strings.Join(connection.KCPCrypts, ", "))
+	flag.StringVar(&c.Key, "kcp-key", "", "kcp crypt key, -password if empty")
+}
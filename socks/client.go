@@ -0,0 +1,69 @@
+package socks
+
+import (
+	"errors"
+	"io"
+)
+
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	MethodNoAuth       = 0
+	MethodUserPass     = 2
+	MethodNoAcceptable = 0xff
+)
+
+var ErrAuthFailed = errors.New("SOCKS authentication failed")
+
+// ClientHandshake asks the SOCKS5 server on rw to connect to addr, with
+// username and password (RFC 1929) if username is not empty.
+func ClientHandshake(rw io.ReadWriter, addr Addr, username, password string) error {
+	// write VER NMETHODS METHODS
+	greeting := []byte{5, 1, MethodNoAuth}
+	if username != "" {
+		greeting = []byte{5, 2, MethodNoAuth, MethodUserPass}
+	}
+	if _, err := rw.Write(greeting); err != nil {
+		return err
+	}
+
+	// read VER METHOD
+	buf := make([]byte, MaxAddrLen)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	switch {
+	case buf[1] == MethodUserPass && username != "":
+		if len(username) > 255 || len(password) > 255 {
+			return ErrAuthFailed
+		}
+		// write VER ULEN UNAME PLEN PASSWD
+		req := append([]byte{1, byte(len(username))}, username...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := rw.Write(req); err != nil {
+			return err
+		}
+		// read VER STATUS
+		if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return ErrAuthFailed
+		}
+	case buf[1] != MethodNoAuth:
+		return ErrAuthFailed
+	}
+
+	// write VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := rw.Write(append([]byte{5, CmdConnect, 0}, addr...)); err != nil {
+		return err
+	}
+	// read VER REP RSV ATYP BND.ADDR BND.PORT
+	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return Error(buf[1])
+	}
+	_, err := readAddr(rw, buf)
+	return err
+}